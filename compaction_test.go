@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"nosql-db/pkg/datatypes"
+	"nosql-db/pkg/db"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+//TestCompactionWithWrites compacts a collection while writers keep writing, updating and deleting objects:
+//every acknowledged write must be found afterwards, and after reloading the collection
+func TestCompactionWithWrites(t *testing.T) {
+	dir := t.TempDir()
+	database, err := db.Open(dir, db.Options{Fsync: db.FsyncNever})
+	if err != nil {
+		t.Fatal(err)
+	}
+	collection, err := database.CreateCollection("test", db.EngineFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := collection.Db.(*db.Access)
+	for i := 0; i < 200; i++ {
+		store.Write(fmt.Sprintf(`{"id": "old%03d", "version": 0}`, i))
+	}
+	//Dead records for the compaction to drop
+	store.Delete(`{"version": 0, "id": {"$gte": "old100"}}`)
+
+	//expected maps every id to its version once the writers are done, -1 for deleted
+	expected := make(map[string]int)
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				id, version := fmt.Sprintf("w%d-%03d", w, i), 1
+				var err error
+				switch {
+				case i%10 == 9:
+					//Delete one written earlier by this writer
+					id, version = fmt.Sprintf("w%d-%03d", w, i-6), -1
+					_, err = store.DeleteByID(id)
+				case i%5 == 4:
+					//Update one of the objects written before the compaction
+					id, version = fmt.Sprintf("old%03d", w*25+i/5), 2
+					_, err = store.Update(id, `{"version": 2}`)
+				default:
+					_, err = store.Write(fmt.Sprintf(`{"id": "%s", "version": 1}`, id))
+				}
+				if err != nil {
+					t.Errorf("%s: %v", id, err)
+					return
+				}
+				lock.Lock()
+				expected[id] = version
+				lock.Unlock()
+			}
+		}(w)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := store.Compact(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+	if _, err := store.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		id := fmt.Sprintf("old%03d", i)
+		if _, found := expected[id]; !found {
+			expected[id] = 0
+		}
+	}
+
+	check := func(store db.StorageEngine) {
+		live := 0
+		for id, version := range expected {
+			obj, err := store.Get(id)
+			if version == -1 {
+				if err == nil {
+					t.Errorf("Expected %s to be deleted, got %v", id, obj)
+				}
+				continue
+			}
+			live++
+			if err != nil || obj["version"] != float64(version) {
+				t.Errorf("Expected %s at version %d, got %v (%v)", id, version, obj, err)
+			}
+		}
+		if all, _ := store.Read(`{"version": {"$gte": 0}}`); len(all) != live {
+			t.Errorf("Expected %d objects, got %d", live, len(all))
+		}
+		if report, err := store.(*db.Access).Verify(false); err != nil || len(report.Problems) != 0 {
+			t.Errorf("Expected no problems, got %v (%v)", report.Problems, err)
+		}
+	}
+	check(store)
+	database.Close()
+
+	database, err = db.Open(dir, db.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	reloaded, _ := database.Collection("test")
+	check(reloaded.Db)
+}
+
+//TestCompactionRecovery simulates a crash while a compaction was swapping its files in: with the marker
+//written, the swap is finished on reload, and without it the compaction files are discarded
+func TestCompactionRecovery(t *testing.T) {
+	extensions := []string{datatypes.DBFileExtension, datatypes.IndexFileExtension,
+		datatypes.AttributeFileExtension, datatypes.ValueIndexFileExtension}
+
+	for _, withMarker := range []bool{true, false} {
+		dir := t.TempDir()
+		base := filepath.Join(dir, "test", "test")
+		database, err := db.Open(dir, db.Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		collection, err := database.CreateCollection("test", db.EngineFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		collection.Db.Write(`{"id": "jo", "name": "Jo"}`)
+		database.Close()
+		before := make(map[string][]byte)
+		for _, extension := range extensions {
+			before[extension], _ = os.ReadFile(base + extension)
+		}
+
+		//The files of the compaction are those of the collection with one more object
+		database, _ = db.Open(dir, db.Options{})
+		collection, _ = database.Collection("test")
+		collection.Db.Write(`{"id": "al", "name": "Al"}`)
+		database.Close()
+		for _, extension := range extensions {
+			if err := os.Rename(base+extension, base+extension+".compact"); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(base+extension, before[extension], 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if withMarker {
+			if err := os.WriteFile(base+".compacted", nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		database, err = db.Open(dir, db.Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		collection, _ = database.Collection("test")
+		objects, _ := collection.Db.Read(`{"name": {"$gte": ""}}`)
+		expected := []string{"Jo"}
+		if withMarker {
+			expected = []string{"Al", "Jo"}
+		}
+		if got := names(objects); !equalStrings(got, expected) {
+			t.Errorf("With marker %v: expected %v, got %v", withMarker, expected, got)
+		}
+		if report, err := collection.Db.(*db.Access).Verify(false); err != nil || len(report.Problems) != 0 {
+			t.Errorf("With marker %v: expected no problems, got %v (%v)", withMarker, report.Problems, err)
+		}
+		database.Close()
+
+		leftovers, _ := filepath.Glob(base + ".*compact*")
+		if len(leftovers) != 0 {
+			t.Errorf("With marker %v: expected the compaction files to be gone, got %v", withMarker, leftovers)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"nosql-db/pkg/datatypes"
+	"nosql-db/pkg/db"
+	"sync"
+	"testing"
+)
+
+//TestConcurrentAccess runs readers and writers in parallel on a single collection (run it with -race).
+//Writers always keep `a` and `b` equal, so a reader seeing them differ has read a torn object.
+func TestConcurrentAccess(t *testing.T) {
+	database, err := db.Open(t.TempDir(), db.Options{Fsync: db.FsyncNever})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	collection, err := database.CreateCollection("test", db.EngineFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := collection.Db
+	const writers, objects = 4, 50
+	for i := 0; i < objects; i++ {
+		store.Write(fmt.Sprintf(`{"id": "shared%02d", "a": 0, "b": 0}`, i))
+	}
+
+	done := make(chan struct{})
+	var readers sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		readers.Add(1)
+		go func(r int) {
+			defer readers.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				var found []datatypes.JS
+				if r%2 == 0 {
+					obj, err := store.Get(fmt.Sprintf("shared%02d", i%objects))
+					if err != nil {
+						t.Errorf("Reading shared%02d: %v", i%objects, err)
+						return
+					}
+					found = append(found, obj)
+				} else {
+					objects, err := store.Read(`{"a": {"$gte": 0}}`)
+					if err != nil {
+						t.Errorf("Querying: %v", err)
+						return
+					}
+					found = objects
+				}
+				for _, obj := range found {
+					if obj["a"] != obj["b"] {
+						t.Errorf("Read a torn object %v", obj)
+						return
+					}
+				}
+			}
+		}(r)
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 1; i <= 50; i++ {
+				id := fmt.Sprintf("shared%02d", (w*50+i)%objects)
+				if _, err := store.Write(fmt.Sprintf(`{"id": "%s", "a": %d, "b": %d}`, id, i, i)); err != nil {
+					t.Error(err)
+					return
+				}
+				if _, err := store.Write(fmt.Sprintf(`{"id": "own%d-%03d", "a": %d, "b": %d}`, w, i, i, i)); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(done)
+	readers.Wait()
+
+	if all, _ := store.Read(`{"a": {"$gte": 0}}`); len(all) != objects+writers*50 {
+		t.Errorf("Expected %d objects, got %d", objects+writers*50, len(all))
+	}
+	if report, err := store.(*db.Access).Verify(false); err != nil || len(report.Problems) != 0 {
+		t.Errorf("Expected no problems, got %v (%v)", report.Problems, err)
+	}
+}
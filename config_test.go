@@ -0,0 +1,62 @@
+package main
+
+import (
+	"nosql-db/pkg/config"
+	"nosql-db/pkg/db"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+//TestConfig checks flags override environment variables, which override the configuration file
+func TestConfig(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "nosqldb.json")
+	os.WriteFile(file, []byte(`{"dataDir": "`+filepath.ToSlash(dir)+`", "listenAddress": ":1", "fsync": "never", "compactionInterval": "1h"}`), 0644)
+	t.Setenv("NOSQLDB_CONFIG", file)
+	t.Setenv("NOSQLDB_LISTEN_ADDRESS", ":2")
+
+	cfg, args, err := config.Load([]string{"-fsync", "always", "verify", "-repair"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.DataDir != filepath.ToSlash(dir) || cfg.ListenAddress != ":2" || cfg.Fsync != db.FsyncAlways || cfg.CompactionInterval != time.Hour {
+		t.Errorf("Unexpected configuration %+v", cfg)
+	}
+	if !equalStrings(args, []string{"verify", "-repair"}) {
+		t.Errorf("Expected the arguments after the flags to be left, got %v", args)
+	}
+
+	if _, _, err := config.Load([]string{"-fsync", "sometimes"}); err == nil {
+		t.Error("Expected an error for an unknown fsync policy")
+	}
+	os.WriteFile(file, []byte(`{"dataDirectory": "/tmp"}`), 0644)
+	if _, _, err := config.Load(nil); err == nil {
+		t.Error("Expected an error for an unknown setting")
+	}
+}
+
+//TestDataDirIsolation checks instances with different data directories do not see each other's collections
+func TestDataDirIsolation(t *testing.T) {
+	first := db.Options{DataDir: filepath.Join(t.TempDir(), "first"), Fsync: db.FsyncNever}
+	second := db.Options{DataDir: filepath.Join(t.TempDir(), "second"), Fsync: db.FsyncAlways}
+	db.InitCollections(first)
+	db.InitCollections(second)
+
+	collection := db.CreateCollection("test", first)
+	collection.Db.Write(`{"id": "jo"}`)
+	collection.Db.Close()
+
+	if collections := db.LoadCollections(second); len(collections) != 0 {
+		t.Errorf("Expected no collection in the second data directory, got %d", len(collections))
+	}
+	reloaded, ok := db.LoadCollections(first)["test"]
+	if !ok {
+		t.Fatal("Expected the collection to be found in the first data directory")
+	}
+	defer reloaded.Db.Close()
+	if objects, err := reloaded.Db.Read(`{"id": "jo"}`); err != nil || len(objects) != 1 {
+		t.Errorf("Expected the object written without fsync to be read back, got %v (%v)", objects, err)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"nosql-db/pkg/db"
+	"path/filepath"
+	"testing"
+)
+
+//TestOpenClose uses the database as a library: bad input comes back as errors, and data survives closing it
+func TestOpenClose(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "data")
+	database, err := db.Open(dir, db.Options{Fsync: db.FsyncNever})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, engine := range []string{db.EngineFile, db.EngineLSM} {
+		collection, err := database.CreateCollection(engine, engine)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, bad := range []string{`{"id": "jo"`, `null`, `{"id": 3}`} {
+			if _, err := collection.Db.Write(bad); err == nil {
+				t.Errorf("%s: expected an error writing %s", engine, bad)
+			}
+		}
+		if _, err := collection.Db.Read(`[1`); err == nil {
+			t.Errorf("%s: expected an error reading with malformed JSON", engine)
+		}
+		if _, err := collection.Db.Write(`{"id": "jo", "age": 53}`); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := database.CreateCollection(db.EngineFile, db.EngineMemory); !errors.Is(err, db.ErrCollectionExists) {
+		t.Errorf("Expected creating an existing collection to fail, got %v", err)
+	}
+	if _, err := database.CreateCollection("../outside", db.EngineFile); err == nil {
+		t.Error("Expected an error for a collection name with a path separator")
+	}
+	collection, _ := database.Collection(db.EngineFile)
+	if err := database.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := collection.Db.Write(`{"id": "al"}`); !errors.Is(err, db.ErrClosed) {
+		t.Errorf("Expected writing to a closed collection to fail, got %v", err)
+	}
+	if _, err := database.Collection(db.EngineFile); err != db.ErrDatabaseClosed {
+		t.Errorf("Expected the closed database to refuse use, got %v", err)
+	}
+
+	database, err = db.Open(dir, db.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	for _, name := range database.CollectionNames() {
+		collection, _ := database.Collection(name)
+		if objects, err := collection.Db.Read(`{"id": "jo"}`); err != nil || len(objects) != 1 || objects[0]["age"] != 53.0 {
+			t.Errorf("%s: expected Jo to be read back, got %v (%v)", name, objects, err)
+		}
+	}
+	if names := database.CollectionNames(); len(names) != 2 {
+		t.Errorf("Expected the 2 collections to be reopened, got %v", names)
+	}
+}
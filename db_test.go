@@ -1,8 +1,11 @@
 package main
 
 import (
+	"fmt"
+	"io"
 	"log"
 	"nosql-db/pkg/api"
+	"nosql-db/pkg/config"
 	"nosql-db/pkg/db"
 	"os"
 	"runtime/pprof"
@@ -26,8 +29,10 @@ func TestDbWrite(t *testing.T) {
 	defer pprof.StopCPUProfile()
 
 	//Actual testing
-	db.InitCollections()
-	s := api.NewServer()
+	s, err := api.NewServer(config.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	collection := s.MapCollection(collectionName)
 
@@ -54,8 +59,10 @@ func TestDbRead(t *testing.T) {
 	defer pprof.StopCPUProfile()
 
 	//Actual testing
-	db.InitCollections()
-	s := api.NewServer()
+	s, err := api.NewServer(config.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	collection := s.MapCollection(collectionName)
 
@@ -64,3 +71,49 @@ func TestDbRead(t *testing.T) {
 	}
 
 }
+
+//BenchmarkEngineWrite compares writing objects to collections stored in files and in an LSM tree
+func BenchmarkEngineWrite(b *testing.B) {
+	for _, engine := range []string{db.EngineFile, db.EngineLSM} {
+		b.Run(engine, func(b *testing.B) {
+			store := benchmarkCollection(b, engine)
+			defer store.Close()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				store.Write(fmt.Sprintf(`{"id": "user%d", "name": "Jo", "age": %d}`, i, i%100))
+			}
+		})
+	}
+}
+
+//BenchmarkEngineReadByID compares reading objects by id from collections stored in files and in an LSM tree
+func BenchmarkEngineReadByID(b *testing.B) {
+	const objects = 1000
+	for _, engine := range []string{db.EngineFile, db.EngineLSM} {
+		b.Run(engine, func(b *testing.B) {
+			store := benchmarkCollection(b, engine)
+			defer store.Close()
+			for i := 0; i < objects; i++ {
+				store.Write(fmt.Sprintf(`{"id": "user%d", "name": "Jo", "age": %d}`, i, i%100))
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				store.Read(fmt.Sprintf(`{"id": "user%d"}`, i%objects))
+			}
+		})
+	}
+}
+
+//benchmarkCollection returns the engine of a fresh collection, in a temporary data directory
+func benchmarkCollection(b *testing.B, engine string) db.StorageEngine {
+	options := db.Options{DataDir: b.TempDir(), Fsync: db.FsyncAlways}
+	log.SetOutput(io.Discard)
+	b.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	db.InitCollections(options)
+	collection, err := db.CreateCollectionWithEngine("bench", engine, options)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return collection.Db
+}
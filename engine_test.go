@@ -0,0 +1,217 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"nosql-db/pkg/datatypes"
+	"nosql-db/pkg/db"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//TestStorageEngines runs the same operations against every storage engine
+func TestStorageEngines(t *testing.T) {
+	for _, engine := range []string{db.EngineFile, db.EngineMemory, db.EngineLSM} {
+		t.Run(engine, func(t *testing.T) {
+			options := testOptions(t)
+			db.InitCollections(options)
+			collection, err := db.CreateCollectionWithEngine("test", engine, options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			store := collection.Db
+			for _, doc := range []string{
+				`{"id": "jo", "name": "Jo", "age": 53, "tags": ["a"]}`,
+				`{"id": "al", "name": "Al", "age": 20}`,
+				`{"name": "Bo", "age": 35, "tags": ["a", "b"]}`,
+			} {
+				if _, err := store.Write(doc); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if _, err := store.Update("jo", `{"age": 54, "tags": null}`); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := store.Update("nobody", `{"age": 1}`); err == nil {
+				t.Error("Expected an error updating a missing object")
+			}
+			objects, _ := store.Read(`{"id": "jo"}`)
+			if len(objects) != 1 || objects[0]["age"] != 54.0 || objects[0]["tags"] != nil {
+				t.Errorf("Expected Jo to be updated, got %v", objects)
+			}
+			objects, _ = store.Read(`{"tags": "a", "age": {"$gt": 30}}`)
+			if got := names(objects); !equalStrings(got, []string{"Bo"}) {
+				t.Errorf("Expected [Bo], got %v", got)
+			}
+
+			//Objects read must not be shared with the engine
+			objects[0]["name"] = "changed"
+			objects, _ = store.Read(`{"name": "Bo"}`)
+			if len(objects) != 1 {
+				t.Errorf("Expected Bo to be left untouched, got %v", objects)
+			}
+
+			page, err := db.Find(store, `{}`, db.ReadOptions{Sort: []db.SortKey{{Path: "age"}}, Limit: 2})
+			if err != nil || !equalStrings(pageNames(page), []string{"Al", "Bo"}) || page.Cursor == "" {
+				t.Errorf("Expected a first page of [Al Bo], got %v (%v)", pageNames(page), err)
+			}
+
+			result, _ := store.Delete(`{"age": {"$lt": 40}}`)
+			if result["deleteCount"] != 2 {
+				t.Errorf("Expected 2 objects deleted, got %v", result)
+			}
+
+			var scanned []datatypes.JS
+			store.Scan(func(obj datatypes.JS) bool {
+				scanned = append(scanned, obj)
+				return true
+			})
+			if got := names(scanned); !equalStrings(got, []string{"Jo"}) {
+				t.Errorf("Expected to scan [Jo], got %v", got)
+			}
+
+			if _, err := store.Replace("jo", `{"name": "Jo", "city": "Oslo"}`); err != nil {
+				t.Fatal(err)
+			}
+			if obj, err := store.Get("jo"); err != nil || obj["city"] != "Oslo" || obj["age"] != nil || obj["id"] != "jo" {
+				t.Errorf("Expected Jo to be replaced, got %v (%v)", obj, err)
+			}
+			if objects, _ := store.Read(`{"age": 54}`); len(objects) != 0 {
+				t.Errorf("Expected the replaced attributes to be gone, got %v", objects)
+			}
+			if _, err := store.Replace("jo", `{"id": "al"}`); !errors.Is(err, db.ErrInvalidDocument) {
+				t.Errorf("Expected an error replacing Jo with another id, got %v", err)
+			}
+			if _, err := store.Replace("al", `{"name": "Al"}`); !errors.Is(err, db.ErrNotFound) {
+				t.Errorf("Expected an error replacing a deleted object, got %v", err)
+			}
+			if obj, err := store.DeleteByID("jo"); err != nil || obj["city"] != "Oslo" {
+				t.Errorf("Expected the deleted Jo back, got %v (%v)", obj, err)
+			}
+			if _, err := store.Get("jo"); !errors.Is(err, db.ErrNotFound) {
+				t.Errorf("Expected Jo to be deleted, got %v", err)
+			}
+			if _, err := store.DeleteByID("jo"); !errors.Is(err, db.ErrNotFound) {
+				t.Errorf("Expected an error deleting Jo twice, got %v", err)
+			}
+			if err := store.Close(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+//TestLSMEngine flushes and merges segments of an LSM collection, then checks nothing is lost on reopening
+func TestLSMEngine(t *testing.T) {
+	base := filepath.Join(t.TempDir(), "test")
+	options := db.LSMOptions{MemtableSize: 512, MergeThreshold: 3}
+	store, err := db.OpenLSMEngine(base, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 200; i++ {
+		if _, err := store.Write(fmt.Sprintf(`{"id": "user%03d", "age": %d}`, i, i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//Overwrite and delete objects already flushed to segments
+	for i := 0; i < 200; i += 10 {
+		store.Update(fmt.Sprintf("user%03d", i), `{"updated": true}`)
+	}
+	store.Delete(`{"age": {"$gte": 150}}`)
+
+	check := func(store *db.LSMEngine) {
+		objects, _ := store.Read(`{"updated": true}`)
+		if len(objects) != 15 {
+			t.Errorf("Expected 15 updated objects, got %d", len(objects))
+		}
+		if objects, err := store.Read(`{"id": "user100"}`); err != nil || len(objects) != 1 || objects[0]["updated"] != true {
+			t.Errorf("Expected user100 to be updated, got %v (%v)", objects, err)
+		}
+		if _, err := store.Read(`{"id": "user160"}`); err == nil {
+			t.Error("Expected user160 to be deleted")
+		}
+		count := 0
+		store.Scan(func(obj datatypes.JS) bool {
+			count++
+			return true
+		})
+		if count != 150 {
+			t.Errorf("Expected 150 objects, got %d", count)
+		}
+	}
+	check(store)
+	//Merges run in the background, and closing drops one still running
+	var segments []string
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		segments, _ = filepath.Glob(base + "-*" + datatypes.LSMSegmentExtension)
+		if len(segments) > 0 && len(segments) <= 4 {
+			break
+		}
+	}
+	if len(segments) == 0 || len(segments) > 4 {
+		t.Errorf("Expected segments to be flushed and merged, got %d segment files", len(segments))
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = db.OpenLSMEngine(base, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	check(store)
+}
+
+//TestLSMEngineClose closes an LSM collection while writers keep flushing and merging segments:
+//closing must not break a merge midway, and every write acknowledged before it must be found on reopening
+func TestLSMEngineClose(t *testing.T) {
+	base := filepath.Join(t.TempDir(), "test")
+	options := db.LSMOptions{MemtableSize: 256, MergeThreshold: 2}
+	for round := 0; round < 10; round++ {
+		store, err := db.OpenLSMEngine(base, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var written int64
+		var wg sync.WaitGroup
+		for w := 0; w < 4; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; ; i++ {
+					if _, err := store.Write(fmt.Sprintf(`{"id": "r%d-w%d-%04d"}`, round, w, i)); err != nil {
+						if !errors.Is(err, db.ErrClosed) {
+							t.Error(err)
+						}
+						return
+					}
+					atomic.AddInt64(&written, 1)
+				}
+			}(w)
+		}
+		for atomic.LoadInt64(&written) < 200 {
+			runtime.Gosched()
+		}
+		if err := store.Close(); err != nil {
+			t.Fatal(err)
+		}
+		wg.Wait()
+
+		store, err = db.OpenLSMEngine(base, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		found, _ := store.Read(fmt.Sprintf(`{"id": {"$regex": "^r%d-"}}`, round))
+		if int64(len(found)) != written {
+			t.Errorf("Round %d: expected %d objects, got %d", round, written, len(found))
+		}
+		store.Close()
+	}
+}
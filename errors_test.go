@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"nosql-db/pkg/api"
+	"nosql-db/pkg/config"
+	"strings"
+	"testing"
+)
+
+//TestErrorResponses checks errors are reported with their HTTP status, code and request ID
+func TestErrorResponses(t *testing.T) {
+	cfg := config.Default()
+	cfg.DataDir = t.TempDir()
+	s, err := api.NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("X-Request-Id", "req-1")
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, r)
+		return resp
+	}
+	do("POST", "/collections", `{"name": "people"}`)
+	do("POST", "/collections/people/indexes", `{"name": "byEmail", "fields": ["email"], "unique": true}`)
+	do("POST", "/collections/people/docs", `{"id": "jo", "email": "jo@example.com"}`)
+
+	cases := []struct {
+		method, path, body string
+		status             int
+		code               string
+	}{
+		{"POST", "/collections/people/docs", `{"id": "jo"`, http.StatusBadRequest, "invalidDocument"},
+		{"POST", "/collections/people/docs", `{"id": "al", "note": "say \"hi\"", "bad": }`, http.StatusBadRequest, "invalidDocument"},
+		{"POST", "/collections/people/query", `{"age": {"$near": 1}}`, http.StatusBadRequest, "invalidDocument"},
+		{"POST", "/collections/people/query?limit=-1", `{}`, http.StatusBadRequest, "invalidRequest"},
+		{"POST", "/collections/people/query", `{"id": "nobody"}`, http.StatusNotFound, "notFound"},
+		{"PATCH", "/collections/people/docs/nobody", `{"age": 1}`, http.StatusNotFound, "notFound"},
+		{"DELETE", "/collections/nobody/docs/jo", ``, http.StatusNotFound, "collectionMissing"},
+		{"POST", "/collections/people/docs", `{"id": "al", "email": "jo@example.com"}`, http.StatusConflict, "conflict"},
+		{"GET", "/collections/people/compact", ``, http.StatusMethodNotAllowed, "methodNotAllowed"},
+	}
+	for _, c := range cases {
+		resp := do(c.method, c.path, c.body)
+		var body map[string]interface{}
+		if err := json.Unmarshal(resp.Body.Bytes(), &body); err != nil {
+			t.Errorf("%s %s: expected a JSON body, got %s", c.method, c.path, resp.Body)
+			continue
+		}
+		if resp.Code != c.status || body["code"] != c.code || body["requestId"] != "req-1" || body["error"] == "" {
+			t.Errorf("%s %s: expected %d %s, got %d %v", c.method, c.path, c.status, c.code, resp.Code, body)
+		}
+	}
+
+	if resp := do("POST", "/collections/people/query", `{"id": "jo"}`); resp.Code != http.StatusOK || resp.Header().Get("X-Request-Id") != "req-1" {
+		t.Errorf("Expected reading Jo to succeed with the request ID, got %d %v", resp.Code, resp.Header())
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"math/rand"
+	"nosql-db/pkg/datatypes"
+	"nosql-db/pkg/db"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+)
+
+//createIndexes creates value indexes on `collection`, and waits for them to be built
+func createIndexes(t *testing.T, collection *db.Collection, specs ...db.IndexSpec) {
+	for _, spec := range specs {
+		if _, err := collection.Db.(*db.Access).CreateIndex(spec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for _, info := range collection.Db.(*db.Access).Indexes() {
+		for info.State != db.IndexStateReady && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+			for _, current := range collection.Db.(*db.Access).Indexes() {
+				if current.Name == info.Name {
+					info = current
+				}
+			}
+		}
+		if info.State != db.IndexStateReady {
+			t.Fatalf("Index %s was not built in time", info.Name)
+		}
+	}
+}
+
+//TestBTree checks the B-tree against a plain map, through enough inserts and removals to split and merge nodes
+func TestBTree(t *testing.T) {
+	tree := datatypes.NewBTree()
+	expected := make(map[string]bool)
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 20000; i++ {
+		key := strconv.Itoa(random.Intn(5000))
+		if random.Intn(3) == 0 {
+			tree.Remove(key, "id")
+			delete(expected, key)
+		} else {
+			tree.Add(key, "id")
+			expected[key] = true
+		}
+	}
+
+	var keys []string
+	for key := range expected {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if tree.Len() != len(keys) {
+		t.Fatalf("Expected %d keys, got %d", len(keys), tree.Len())
+	}
+
+	var got []string
+	tree.Ascend("2", func(key string, ids []string) bool {
+		got = append(got, key)
+		return len(got) < 100
+	})
+	first := sort.SearchStrings(keys, "2")
+	if !equalStrings(got, keys[first:first+100]) {
+		t.Errorf("Ascending from 2: expected %v, got %v", keys[first:first+100], got)
+	}
+}
+
+func TestValueIndexes(t *testing.T) {
+	options := testOptions(t)
+	collection := newTestCollection(t, options,
+		`{"id": "jo", "name": "Jo", "age": 53, "tags": ["a", "b"]}`,
+		`{"id": "al", "name": "Al", "age": 20, "tags": ["b"]}`,
+		`{"id": "bo", "name": "Bo", "age": 35}`,
+		`{"id": "cy", "name": "Cy", "age": "unknown"}`,
+	)
+	createIndexes(t, collection,
+		db.IndexSpec{Name: "byAge", Fields: []string{"age"}, Type: db.IndexTypeBTree},
+		db.IndexSpec{Name: "byTag", Fields: []string{"tags"}, Type: db.IndexTypeHash},
+	)
+	if _, err := collection.Db.(*db.Access).CreateIndex(db.IndexSpec{Name: "byTag", Fields: []string{"name"}}); err == nil {
+		t.Error("Expected an error creating an index twice")
+	}
+
+	//Indexes must be kept up to date
+	collection.Db.Write(`{"id": "di", "name": "Di", "age": 62, "tags": ["a"]}`)
+	collection.Db.Update("jo", `{"age": 54}`)
+	collection.Db.Delete(`{"name": "Al"}`)
+
+	cases := []struct {
+		query    string
+		expected []string
+	}{
+		{`{"age": 54}`, []string{"Jo"}},
+		{`{"age": 53}`, []string{}},
+		{`{"age": {"$gt": 35}}`, []string{"Di", "Jo"}},
+		{`{"age": {"$gte": 35, "$lt": 60}}`, []string{"Bo", "Jo"}},
+		{`{"age": {"$lte": "z"}}`, []string{"Cy"}},
+		{`{"tags": "a"}`, []string{"Di", "Jo"}},
+		{`{"tags": {"$in": ["b", "c"]}}`, []string{"Jo"}},
+		{`{"tags": "a", "age": {"$lt": 60}}`, []string{"Jo"}},
+	}
+	check := func(collection *db.Collection) {
+		for _, c := range cases {
+			objects, err := collection.Db.Read(c.query)
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", c.query, err)
+				continue
+			}
+			if got := names(objects); !equalStrings(got, c.expected) {
+				t.Errorf("%s: expected %v, got %v", c.query, c.expected, got)
+			}
+		}
+	}
+	check(collection)
+
+	//Indexes are loaded back from disk, and survive compaction
+	collection.Db.(*db.Access).Compact()
+	reloaded := db.LoadCollections(options)["test"]
+	if len(reloaded.Db.(*db.Access).Indexes()) != 2 {
+		t.Fatalf("Expected 2 indexes after reloading, got %v", reloaded.Db.(*db.Access).Indexes())
+	}
+	check(&reloaded)
+
+	if err := reloaded.Db.(*db.Access).DropIndex("byAge"); err != nil {
+		t.Fatal(err)
+	}
+	check(&reloaded)
+}
+
+func TestCompoundAndPartialIndexes(t *testing.T) {
+	collection := newTestCollection(t, testOptions(t),
+		`{"name": "Jo", "tenant": "acme", "createdAt": 10, "status": "active"}`,
+		`{"name": "Al", "tenant": "acme", "createdAt": 20, "status": "closed"}`,
+		`{"name": "Bo", "tenant": "acme", "createdAt": 30, "status": "active"}`,
+		`{"name": "Cy", "tenant": "initech", "createdAt": 20, "status": "active"}`,
+		`{"name": "Di", "createdAt": 40, "status": "active"}`,
+	)
+	createIndexes(t, collection,
+		db.IndexSpec{Name: "byTenantDate", Fields: []string{"tenant", "createdAt"}, Type: db.IndexTypeBTree},
+		db.IndexSpec{Name: "activeByDate", Fields: []string{"createdAt"}, Type: db.IndexTypeBTree,
+			Filter: datatypes.JS{"status": "active"}},
+	)
+	if _, err := collection.Db.(*db.Access).CreateIndex(db.IndexSpec{Name: "bad", Fields: []string{"a"},
+		Filter: datatypes.JS{"$or": []interface{}{datatypes.JS{"a": 1}}}}); err == nil {
+		t.Error("Expected an error for a partial index filter which is not a conjunction")
+	}
+
+	collection.Db.Write(`{"name": "Ed", "tenant": "acme", "createdAt": 20, "status": "active"}`)
+
+	cases := []struct {
+		query    string
+		expected []string
+	}{
+		{`{"tenant": "acme"}`, []string{"Al", "Bo", "Ed", "Jo"}},
+		{`{"tenant": "acme", "createdAt": 20}`, []string{"Al", "Ed"}},
+		{`{"tenant": "acme", "createdAt": {"$gt": 10, "$lte": 30}}`, []string{"Al", "Bo", "Ed"}},
+		{`{"tenant": {"$in": ["acme", "initech"]}, "createdAt": {"$lt": 20}}`, []string{"Jo"}},
+		{`{"createdAt": {"$gte": 20}, "status": "active"}`, []string{"Bo", "Cy", "Di", "Ed"}},
+		//Not covered by the partial index, which does not hold closed objects
+		{`{"createdAt": {"$gte": 20}}`, []string{"Al", "Bo", "Cy", "Di", "Ed"}},
+	}
+	for _, c := range cases {
+		objects, err := collection.Db.Read(c.query)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", c.query, err)
+			continue
+		}
+		if got := names(objects); !equalStrings(got, c.expected) {
+			t.Errorf("%s: expected %v, got %v", c.query, c.expected, got)
+		}
+	}
+}
+
+func TestUniqueIndexes(t *testing.T) {
+	collection := newTestCollection(t, testOptions(t),
+		`{"id": "jo", "name": "Jo", "email": "jo@example.com", "tenant": "acme"}`,
+		`{"id": "al", "name": "Al", "email": "al@example.com", "tenant": "acme"}`,
+		`{"id": "bo", "name": "Bo", "tenant": "acme"}`,
+	)
+	createIndexes(t, collection,
+		db.IndexSpec{Name: "byEmail", Fields: []string{"email"}, Unique: true},
+		db.IndexSpec{Name: "byTenantName", Fields: []string{"tenant", "name"}, Type: db.IndexTypeBTree, Unique: true},
+	)
+
+	_, err := collection.Db.Write(`{"name": "Cy", "email": "jo@example.com"}`)
+	dupErr, ok := err.(*db.DuplicateKeyError)
+	if !ok {
+		t.Fatalf("Expected a duplicate key error, got %v", err)
+	}
+	if dupErr.Index != "byEmail" || dupErr.ID != "jo" || dupErr.Key["email"] != "jo@example.com" {
+		t.Errorf("Unexpected duplicate key error %+v", dupErr)
+	}
+	if _, err := collection.Db.Update("al", `{"name": "Jo"}`); err == nil {
+		t.Error("Expected an error updating an object to a compound key already taken")
+	}
+
+	//Objects can be rewritten with their own keys, and objects missing the fields are not constrained
+	if _, err := collection.Db.Update("jo", `{"email": "jo@example.com", "age": 53}`); err != nil {
+		t.Errorf("Unexpected error updating an object with its own key: %v", err)
+	}
+	if _, err := collection.Db.Write(`{"name": "Cy"}`); err != nil {
+		t.Errorf("Unexpected error writing an object without the indexed fields: %v", err)
+	}
+	collection.Db.Delete(`{"name": "Al"}`)
+	if _, err := collection.Db.Write(`{"name": "Di", "email": "al@example.com"}`); err != nil {
+		t.Errorf("Unexpected error reusing the key of a deleted object: %v", err)
+	}
+
+	objects, _ := collection.Db.Read(`{"email": {"$exists": true}}`)
+	if got := names(objects); !equalStrings(got, []string{"Di", "Jo"}) {
+		t.Errorf("Expected [Di Jo], got %v", got)
+	}
+	//Objects updated together cannot share a key either, and none is updated then
+	_, err = collection.Db.UpdateMany(`{"name": {"$in": ["Bo", "Cy"]}}`, `{"$set": {"email": "bo@example.com"}}`)
+	if dupErr, ok := err.(*db.DuplicateKeyError); !ok || dupErr.Index != "byEmail" {
+		t.Errorf("Expected a duplicate key error updating objects to the same key, got %v", err)
+	}
+	if objects, _ := collection.Db.Read(`{"email": "bo@example.com"}`); len(objects) != 0 {
+		t.Errorf("Expected no object to be updated, got %v", objects)
+	}
+
+	if _, err := collection.Db.(*db.Access).CreateIndex(db.IndexSpec{Name: "byTenant", Fields: []string{"tenant"}, Unique: true}); err == nil {
+		t.Error("Expected an error creating a unique index over duplicate keys")
+	}
+	if len(collection.Db.(*db.Access).Indexes()) != 2 {
+		t.Errorf("Expected the failed index not to be registered, got %v", collection.Db.(*db.Access).Indexes())
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"nosql-db/pkg/datatypes"
+	"nosql-db/pkg/db"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+//TestMigration opens a collection written by a build predating the versioned binary format (testdata/legacy,
+//where Al was updated, leaving two index entries for him), and checks documents, attribute chains and integrity
+//survive the migration
+func TestMigration(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "legacy"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, extension := range []string{datatypes.DBFileExtension, datatypes.IndexFileExtension, datatypes.AttributeFileExtension} {
+		data, err := os.ReadFile(filepath.Join("testdata", "legacy", "legacy"+extension))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "legacy", "legacy"+extension), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//Opened twice: the migration happens once, and the migrated files are read back as they are
+	for i := 0; i < 2; i++ {
+		database, err := db.Open(dir, db.Options{Fsync: db.FsyncNever})
+		if err != nil {
+			t.Fatal(err)
+		}
+		collection, err := database.Collection("legacy")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cases := []struct {
+			query    string
+			expected []string
+		}{
+			{`{"id": "al"}`, []string{"Al"}},
+			{`{"age": 21}`, []string{"Al"}},
+			{`{"age": 20}`, []string{}},
+			{`{"name": {"$gte": ""}}`, []string{"Al", "Bo", "Cy", "Jo"}},
+			{`{"brother.bike": "VTT"}`, []string{"Jo"}},
+			{`{"tags": "b"}`, []string{"Bo"}},
+		}
+		for _, c := range cases {
+			page, err := db.Find(collection.Db, c.query, db.ReadOptions{Explain: true})
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", c.query, err)
+				continue
+			}
+			if got := names(page.Objects); !equalStrings(got, c.expected) {
+				t.Errorf("%s: expected %v, got %v", c.query, c.expected, got)
+			}
+			if page.Explain.Plan.Stage == "collectionScan" {
+				t.Errorf("%s: expected the attribute chain to be used, got %+v", c.query, page.Explain.Plan)
+			}
+		}
+
+		report, err := collection.Db.(*db.Access).Verify(false)
+		if err != nil || len(report.Problems) != 0 || report.Documents != 4 {
+			t.Errorf("Expected 4 documents and no problems, got %+v (%v)", report, err)
+		}
+		if err := database.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	index, _ := os.ReadFile(filepath.Join(dir, "legacy", "legacy"+datatypes.IndexFileExtension))
+	if _, err := datatypes.ParseFileHeader(index, datatypes.IndexFileMagic); err != nil {
+		t.Errorf("Expected the index file to be in the versioned format, got %v", err)
+	}
+}
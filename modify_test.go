@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"nosql-db/pkg/db"
+	"sync"
+	"testing"
+)
+
+//TestFindAndModify has workers claim jobs from a queue concurrently, on every storage engine:
+//every job must be claimed exactly once, highest priority first
+func TestFindAndModify(t *testing.T) {
+	for _, engine := range []string{db.EngineFile, db.EngineMemory, db.EngineLSM} {
+		t.Run(engine, func(t *testing.T) {
+			options := testOptions(t)
+			db.InitCollections(options)
+			collection, err := db.CreateCollectionWithEngine("jobs", engine, options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			store := collection.Db
+			defer store.Close()
+			const jobs = 20
+			for i := 0; i < jobs; i++ {
+				store.Write(fmt.Sprintf(`{"id": "job%02d", "status": "new", "priority": %d}`, i, i))
+			}
+
+			first, err := store.FindAndModify(`{"status": "new"}`, `{"status": "claimed", "worker": -1}`,
+				db.ModifyOptions{Sort: []db.SortKey{{Path: "priority", Descending: true}}})
+			if err != nil || first.ID != "job19" || first.Object["status"] != "new" {
+				t.Fatalf("Expected the highest priority job as it was before, got %+v (%v)", first, err)
+			}
+
+			claimed := make(map[string]int)
+			var lock sync.Mutex
+			var wg sync.WaitGroup
+			for w := 0; w < 4; w++ {
+				wg.Add(1)
+				go func(w int) {
+					defer wg.Done()
+					for {
+						result, err := store.FindAndModify(`{"status": "new"}`, fmt.Sprintf(`{"status": "claimed", "worker": %d}`, w),
+							db.ModifyOptions{ReturnNew: true})
+						if errors.Is(err, db.ErrNotFound) {
+							return
+						}
+						if err != nil || result.Object["worker"] != float64(w) {
+							t.Errorf("Expected a job claimed by worker %d, got %+v (%v)", w, result, err)
+							return
+						}
+						lock.Lock()
+						claimed[result.ID]++
+						lock.Unlock()
+					}
+				}(w)
+			}
+			wg.Wait()
+			for id, times := range claimed {
+				if times != 1 {
+					t.Errorf("Expected %s to be claimed once, got %d", id, times)
+				}
+			}
+			if len(claimed) != jobs-1 {
+				t.Errorf("Expected %d jobs claimed by the workers, got %d", jobs-1, len(claimed))
+			}
+
+			result, err := db.Upsert(store, `{"id": "counter", "kind": "stats", "n": {"$gt": 0}}`, `{"n": 1}`)
+			if err != nil || !result.Upserted || result.Object["kind"] != "stats" || result.Object["n"] != 1.0 {
+				t.Errorf("Expected the counter to be inserted, got %+v (%v)", result, err)
+			}
+			result, err = db.Upsert(store, `{"id": "counter"}`, `{"n": 2}`)
+			if err != nil || result.Upserted || result.Object["kind"] != "stats" || result.Object["n"] != 2.0 {
+				t.Errorf("Expected the counter to be updated, got %+v (%v)", result, err)
+			}
+			if _, err := db.Upsert(store, `{"id": "job00", "status": "new"}`, `{"n": 1}`); !errors.Is(err, db.ErrConflict) {
+				t.Errorf("Expected an upsert clashing with an object which does not match to fail, got %v", err)
+			}
+			//Inserted objects get their id from their own document: the same update under other filters inserts other objects
+			for i := 0; i < 50; i++ {
+				if _, err := db.Upsert(store, fmt.Sprintf(`{"user": "u%02d"}`, i), `{"$set": {"visits": 1}}`); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if objects, _ := store.Read(`{"visits": 1}`); len(objects) != 50 {
+				t.Errorf("Expected 50 upserted objects, got %d", len(objects))
+			}
+		})
+	}
+}
@@ -1,16 +1,83 @@
 package main
 
 import (
+	"encoding/json"
+	"flag"
+	"fmt"
 	"log"
 	"nosql-db/pkg/api"
+	"nosql-db/pkg/config"
 	"nosql-db/pkg/db"
+	"nosql-db/pkg/logging"
+	"os"
 )
 
+//Usage: nosqldb [-config file] [-data-dir dir] [-listen address] [-log-level level] [-fsync policy]
+//[-compaction-interval duration] [verify ...]
 func main() {
 	log.SetFlags(log.Lshortfile | log.Ltime)
 
-	db.InitCollections()
-	s := api.NewServer()
+	cfg, args, err := config.Load(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+	logging.SetLevel(cfg.LogLevel)
+
+	if len(args) > 0 && args[0] == "verify" {
+		os.Exit(verify(cfg, args[1:]))
+	}
+
+	s, err := api.NewServer(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
 	s.Start()
 
 }
+
+//verify runs the consistency checker over the collections named in `args` (all of them if none are named),
+//printing a JSON report for each. Returns the exit code: non-zero if problems were left unrepaired.
+//Usage: nosqldb [flags] verify [-repair] [collection...]
+func verify(cfg config.Config, args []string) int {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	repair := flags.Bool("repair", false, "repair the problems found")
+	flags.Parse(args)
+
+	database, err := db.Open(cfg.DataDir, cfg.DBOptions())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer database.Close()
+	names := flags.Args()
+	if len(names) == 0 {
+		names = database.CollectionNames()
+	}
+
+	status := 0
+	for _, name := range names {
+		collection, err := database.Collection(name)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 1
+			continue
+		}
+		maintainer, ok := collection.Db.(db.Maintainer)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "collection '%s' cannot be verified\n", name)
+			continue
+		}
+		report, err := maintainer.Verify(*repair)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "verifying '%s' failed: %v\n", name, err)
+			status = 1
+			continue
+		}
+		out, _ := json.MarshalIndent(report, "", "\t")
+		fmt.Println(string(out))
+		if len(report.Problems) > 0 && !report.Repaired {
+			status = 1
+		}
+	}
+	return status
+}
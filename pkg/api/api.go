@@ -1,100 +1,133 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"nosql-db/pkg/config"
 	"nosql-db/pkg/datatypes"
 	"nosql-db/pkg/db"
+	"nosql-db/pkg/logging"
 	"nosql-db/pkg/util"
-	"strings"
+	"strconv"
 )
 
-//Server is capable of handling API requests
+//nextCursorHeader is the response header carrying the cursor to the next page of a read
+const nextCursorHeader = "X-Next-Cursor"
+
+//Server is capable of handling API requests, on top of a db.DB.
+//Requests are served concurrently; each collection's storage engine takes care of its own locking.
 type Server struct {
-	collectionsMapping map[string]db.Collection
-	requests           chan RequestData
-	requestHandler     SyncServer
+	config           config.Config
+	database         *db.DB
+	router           *router
+	httpServer       *http.Server
+	compactionWorker *util.Worker
 }
 
-//NewServer constructs a Server instance
-func NewServer() *Server {
-	requests := make(chan RequestData)
-	return &Server{
-		collectionsMapping: db.LoadCollections(),
-		requests:           requests,
-		requestHandler: SyncServer{
-			requests: requests,
-		},
+//NewServer constructs a Server instance, serving the collections of the data directory of `config`
+func NewServer(config config.Config) (*Server, error) {
+	database, err := db.Open(config.DataDir, config.DBOptions())
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		config:   config,
+		database: database,
 	}
+	s.router = s.routes()
+	return s, nil
 }
 
 //Start the server
 func (s *Server) Start() {
-	http.Handle("/", &s.requestHandler)
-	go s.ProcessRequestQueue()
-	log.Fatal(http.ListenAndServe(":9999", nil))
+	s.httpServer = &http.Server{Addr: s.config.ListenAddress, Handler: s}
+	s.compactionWorker = util.NewWorker(s.compactCollections, s.config.CompactionInterval)
+	s.compactionWorker.Start()
+	logging.Infof("Now listening on %s", s.config.ListenAddress)
+	if err := s.httpServer.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
 }
 
-//Stop the server
+//Stop the server, then close the database once in-flight requests are done
 func (s *Server) Stop() {
-	log.Print("Closing requests channel and shutting down server...")
-	close(s.requests)
-	log.Print("Done")
+	logging.Infof("Shutting down server...")
+	s.compactionWorker.Stop()
+	//Shutdown waits for in-flight requests, which includes the one asking us to stop, hence the goroutine
+	go func() {
+		if err := s.httpServer.Shutdown(context.Background()); err != nil {
+			log.Print(err)
+		}
+		if err := s.database.Close(); err != nil {
+			log.Print(err)
+		}
+		logging.Infof("Done")
+	}()
 }
 
-func getBodyStr(resp http.ResponseWriter, r *http.Request) string {
-	body, err := ioutil.ReadAll(r.Body)
-
-	if err != nil {
-		resp.Write([]byte("could not ready body"))
-		return ""
+func (s *Server) ServeHTTP(resp http.ResponseWriter, r *http.Request) {
+	requestID := r.Header.Get(requestIDHeader)
+	if requestID == "" || len(requestID) > maxRequestIDLength {
+		requestID = newRequestID()
 	}
+	resp.Header().Set(requestIDHeader, requestID)
+	logging.Debugf("%s request %s", r.Method, requestID)
+	s.ServeRequests(resp, r)
+}
 
-	return string(body)
+//getCollection looks up a collection by name, safe for concurrent use
+func (s *Server) getCollection(collectionName string) (db.Collection, error) {
+	return s.database.Collection(collectionName)
 }
 
-//CollectionsListReq replies with list of collections
-func (s *Server) CollectionsListReq(resp http.ResponseWriter, r *http.Request) {
-	collectionEntries := db.ListCollections()
-	entryNames := make([]string, len(collectionEntries))
-	for i, entry := range collectionEntries {
-		entryNames[i] = entry.GetName()
-	}
-	errMsg := ""
-	if jsonBody, jsonErr := json.Marshal(entryNames); jsonErr == nil {
-		resp.Write(jsonBody)
-	} else {
-		errMsg = jsonErr.Error()
+func getBodyStr(r *http.Request) (string, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return "", badRequest("could not read body: " + err.Error())
 	}
+	return string(body), nil
+}
 
-	if errMsg != "" {
-		resp.Write([]byte("{\"error\":\"" + errMsg + "\"}"))
-	}
+//CollectionsListReq replies with list of collections, memory collections included
+func (s *Server) CollectionsListReq(resp http.ResponseWriter, r *http.Request) {
+	writeJSON(resp, s.database.CollectionNames())
 }
 
-//CreateCollectionReq serves collection creation requests
+//CreateCollectionReq serves collection creation requests, as in
+//    {"name": "people"}
+//    {"name": "sessions", "engine": "memory"}
+//    {"name": "events", "engine": "lsm"}
+//The storage engine defaults to files, see db.CreateCollectionWithEngine. Creating an existing collection does nothing.
 func (s *Server) CreateCollectionReq(resp http.ResponseWriter, r *http.Request) {
-	bodyStr := getBodyStr(resp, r)
+	bodyStr, err := getBodyStr(r)
+	var js datatypes.JS
+	if err == nil {
+		if js, err = util.ParseJSON(bodyStr); err != nil {
+			err = invalidDocument(err)
+		}
+	}
+	if err != nil {
+		writeError(resp, err)
+		return
+	}
 
-	js := util.GetJSON(bodyStr)
 	collectionName, ok := js["name"].(string)
-
-	errMsg := ""
+	engine, engineOk := js["engine"].(string)
 	//double check received name is indeed a string
 	if !ok {
-		errMsg = "'name' is not of type string"
-	} else {
-		createdCollection := db.CreateCollection(collectionName)
-		if createdCollection != nil {
-			s.collectionsMapping[collectionName] = *createdCollection
-		}
+		err = badRequest("'name' is not of type string")
+	} else if _, found := js["engine"]; found && !engineOk {
+		err = badRequest("'engine' is not of type string")
+	} else if _, err = s.database.CreateCollection(collectionName, engine); errors.Is(err, db.ErrCollectionExists) {
+		err = nil
 	}
 
-	if errMsg != "" {
-		resp.Write([]byte("{\"error\":\"" + errMsg + "\"}"))
+	if err != nil {
+		writeError(resp, err)
 	} else {
 		resp.WriteHeader(http.StatusNoContent)
 	}
@@ -102,220 +135,406 @@ func (s *Server) CreateCollectionReq(resp http.ResponseWriter, r *http.Request)
 
 //WriteReq serves database write requests in a specified collection
 func (s *Server) WriteReq(collectionName string, resp http.ResponseWriter, r *http.Request) {
-	bodyStr := getBodyStr(resp, r)
-	var err error
+	bodyStr, err := getBodyStr(r)
+	var collection db.Collection
 	var id string
-	if collection, ok := s.collectionsMapping[collectionName]; ok {
+	if err == nil {
+		collection, err = s.getCollection(collectionName)
+	}
+	if err == nil {
 		id, err = collection.Db.Write(bodyStr)
-	} else {
-		err = errors.New("no collection named '" + collectionName + "'")
 	}
+	respond(resp, datatypes.JS{"id": id}, err)
+}
 
-	//var errMsg string
-	errMsg := ""
-	responseBody := make(map[string]string)
+//ReadReq serves database write requests in a specified collection
+func (s *Server) ReadReq(collectionName string, resp http.ResponseWriter, r *http.Request) {
+	bodyStr, err := getBodyStr(r)
+	var collection db.Collection
+	var options db.ReadOptions
+	var page db.ReadPage
 	if err == nil {
-		responseBody["id"] = id
-		if jsonBody, jsonErr := json.Marshal(responseBody); jsonErr == nil {
-			resp.Write(jsonBody)
-		} else {
-			errMsg = err.Error()
-		}
-	} else {
-		errMsg = err.Error()
+		options, err = readOptions(r)
 	}
-
-	if errMsg != "" {
-		resp.Write([]byte("{\"error\":\"" + errMsg + "\"}"))
+	if err == nil {
+		collection, err = s.getCollection(collectionName)
+	}
+	if err == nil {
+		page, err = db.Find(collection.Db, bodyStr, options)
+	}
+	if err != nil {
+		writeError(resp, err)
+		return
 	}
 
+	//The cursor goes in a header so the body stays a plain array of objects
+	if page.Cursor != "" {
+		resp.Header().Set(nextCursorHeader, page.Cursor)
+	}
+	//With explain, the body describes how the query was run rather than holding the objects
+	var body interface{} = page.Objects
+	if page.Explain != nil {
+		body = page.Explain
+	}
+	writeJSON(resp, body)
 }
 
-//ReadReq serves database write requests in a specified collection
-func (s *Server) ReadReq(collectionName string, resp http.ResponseWriter, r *http.Request) {
-	bodyStr := getBodyStr(resp, r)
-
+//readOptions parses the sort, skip, limit, cursor, fields (projection) and explain query parameters of a read request, as in
+//    /collections/people/read?sort=-age,name&limit=20&fields=name,brother.name&cursor=...
+//    /collections/people/read?explain=true
+func readOptions(r *http.Request) (db.ReadOptions, error) {
+	params := r.URL.Query()
+	var options db.ReadOptions
 	var err error
-	var objects []datatypes.JS
-	if collection, ok := s.collectionsMapping[collectionName]; ok {
-		objects, err = collection.Db.Read(bodyStr)
-	} else {
-		err = errors.New("no collection named '" + collectionName + "'")
+	if options.Sort, err = db.ParseSort(params.Get("sort")); err != nil {
+		return options, err
+	}
+	for name, value := range map[string]*int{"skip": &options.Skip, "limit": &options.Limit} {
+		if params.Get(name) == "" {
+			continue
+		}
+		if *value, err = strconv.Atoi(params.Get(name)); err != nil || *value < 0 {
+			return options, badRequest(name + " must be a non-negative integer")
+		}
+	}
+	options.Cursor = params.Get("cursor")
+	if params.Get("explain") != "" {
+		if options.Explain, err = strconv.ParseBool(params.Get("explain")); err != nil {
+			return options, badRequest("explain must be true or false")
+		}
 	}
+	options.Projection, err = db.ParseProjection(params.Get("fields"))
+	return options, err
+}
 
-	errMsg := ""
+//DeleteReq serves requests on the delete endpoint/resource
+func (s *Server) DeleteReq(collectionName string, resp http.ResponseWriter, r *http.Request) {
+	bodyStr, err := getBodyStr(r)
+	var collection db.Collection
+	var result datatypes.JS
+	if err == nil {
+		collection, err = s.getCollection(collectionName)
+	}
+	if err == nil {
+		result, err = collection.Db.Delete(bodyStr)
+		logging.Debugf("%v", result)
+	}
+	respond(resp, result, err)
+}
 
+//UpdateReq serves PATCH requests on a document, applying the patch or update operators in the body to it
+func (s *Server) UpdateReq(collectionName, id string, resp http.ResponseWriter, r *http.Request) {
+	bodyStr, err := getBodyStr(r)
+	var collection db.Collection
+	var result datatypes.JS
 	if err == nil {
-		/*rawBody, err := json.RawMessage(objects).MarshalJSON()
-		if err != nil {
-			errMsg = err.Error()
-		} else {
-			responseBody["objects"] = string(rawBody)
-			log.Println("Raw Body followed by the string() version")
-			log.Println(rawBody)
-			log.Println(string(rawBody))
-		}*/
-		if len(objects) == 0 {
-			resp.Write([]byte("{}"))
-		} else if jsonBody, jsonErr := json.Marshal(objects); jsonErr == nil {
-			resp.Write(jsonBody)
-		} else {
-			errMsg = err.Error()
-		}
+		collection, err = s.getCollection(collectionName)
+	}
+	if err == nil {
+		result, err = collection.Db.Update(id, bodyStr)
+		logging.Debugf("%v", result)
+	}
+	respond(resp, result, err)
+}
 
-	} else {
-		errMsg = err.Error()
+//maintainer returns the collection named `collectionName` for one of its maintenance endpoints
+func (s *Server) maintainer(collectionName, action string) (db.Maintainer, error) {
+	collection, err := s.getCollection(collectionName)
+	if err != nil {
+		return nil, err
 	}
+	maintainer, ok := collection.Db.(db.Maintainer)
+	if !ok {
+		return nil, badRequest("collection '" + collectionName + "' cannot be " + action)
+	}
+	return maintainer, nil
+}
 
-	if errMsg != "" {
-		resp.Write([]byte("{\"error\":\"" + errMsg + "\"}"))
+//CompactReq serves requests on the compact endpoint/resource, compacting the collection straight away
+func (s *Server) CompactReq(collectionName string, resp http.ResponseWriter, r *http.Request) {
+	var stats db.CompactionStats
+	maintainer, err := s.maintainer(collectionName, "compacted")
+	if err == nil {
+		stats, err = maintainer.Compact()
 	}
+	respond(resp, stats, err)
 }
 
-//DeleteReq serves requests on the delete endpoint/resource
-func (s *Server) DeleteReq(collectionName string, resp http.ResponseWriter, r *http.Request) {
-	bodyStr := getBodyStr(resp, r)
+//VerifyReq serves requests on the verify endpoint/resource, checking the collection's files for consistency.
+//Problems found are repaired if the `repair` query parameter is set to true.
+func (s *Server) VerifyReq(collectionName string, resp http.ResponseWriter, r *http.Request) {
+	var report db.VerifyReport
+	maintainer, err := s.maintainer(collectionName, "verified")
+	if err == nil {
+		report, err = maintainer.Verify(r.URL.Query().Get("repair") == "true")
+	}
+	respond(resp, report, err)
+}
 
-	result, err := s.collectionsMapping[collectionName].Db.Delete(bodyStr)
+//DropCollectionReq serves DELETE requests on a collection, dropping it and its files
+func (s *Server) DropCollectionReq(collectionName string, resp http.ResponseWriter, r *http.Request) {
+	respond(resp, datatypes.JS{"dropped": collectionName}, s.database.DropCollection(collectionName))
+}
 
-	errMsg := ""
+//GetDocReq serves GET requests on a document, replying with it
+func (s *Server) GetDocReq(collectionName, id string, resp http.ResponseWriter, r *http.Request) {
+	var obj datatypes.JS
+	collection, err := s.getCollection(collectionName)
+	if err == nil {
+		obj, err = collection.Db.Get(id)
+	}
+	respond(resp, obj, err)
+}
 
+//PutDocReq serves PUT requests on a document, replacing it with the body and replying with the stored document
+func (s *Server) PutDocReq(collectionName, id string, resp http.ResponseWriter, r *http.Request) {
+	bodyStr, err := getBodyStr(r)
+	var collection db.Collection
+	var obj datatypes.JS
 	if err == nil {
-		/*rawBody, err := json.RawMessage(objects).MarshalJSON()
-		if err != nil {
-			errMsg = err.Error()
-		} else {
-			responseBody["objects"] = string(rawBody)
-			log.Println("Raw Body followed by the string() version")
-			log.Println(rawBody)
-			log.Println(string(rawBody))
-		}*/
-		if jsonBody, jsonErr := json.Marshal(result); jsonErr == nil {
-			log.Println(result)
-			resp.Write(jsonBody)
-		} else {
-			errMsg = err.Error()
-		}
+		collection, err = s.getCollection(collectionName)
+	}
+	if err == nil {
+		obj, err = collection.Db.Replace(id, bodyStr)
+	}
+	respond(resp, obj, err)
+}
 
-	} else {
-		errMsg = err.Error()
+//DeleteDocReq serves DELETE requests on a document, replying with the deleted document
+func (s *Server) DeleteDocReq(collectionName, id string, resp http.ResponseWriter, r *http.Request) {
+	var obj datatypes.JS
+	collection, err := s.getCollection(collectionName)
+	if err == nil {
+		obj, err = collection.Db.DeleteByID(id)
 	}
+	respond(resp, obj, err)
+}
 
-	if errMsg != "" {
-		resp.Write([]byte("{\"error\":\"" + errMsg + "\"}"))
+//modifyRequest is the body of requests on the findAndModify, upsert and updateMany endpoints, as in
+//    {"filter": {"status": "new"}, "update": {"status": "claimed"}, "sort": "-priority", "returnNew": true}
+//Sort, upsert and returnNew are only read by findAndModify, see db.ModifyOptions.
+type modifyRequest struct {
+	Filter    json.RawMessage `json:"filter"`
+	Update    json.RawMessage `json:"update"`
+	Sort      string          `json:"sort"`
+	Upsert    bool            `json:"upsert"`
+	ReturnNew bool            `json:"returnNew"`
+}
+
+//parseModifyRequest reads the body of a findAndModify, upsert or updateMany request
+func parseModifyRequest(r *http.Request) (modifyRequest, db.ModifyOptions, error) {
+	var req modifyRequest
+	bodyStr, err := getBodyStr(r)
+	if err != nil {
+		return req, db.ModifyOptions{}, err
+	}
+	if err := json.Unmarshal([]byte(bodyStr), &req); err != nil {
+		return req, db.ModifyOptions{}, invalidDocument(err)
+	}
+	if req.Filter == nil || req.Update == nil {
+		return req, db.ModifyOptions{}, badRequest("'filter' and 'update' are required")
 	}
+	options := db.ModifyOptions{Upsert: req.Upsert, ReturnNew: req.ReturnNew}
+	options.Sort, err = db.ParseSort(req.Sort)
+	return req, options, err
 }
 
-//UpdateReq serves requests on the delete endpoint/resource
-func (s *Server) UpdateReq(collectionName, id string, resp http.ResponseWriter, r *http.Request) {
-	errMsg := ""
+//FindAndModifyReq serves requests on the findAndModify endpoint of a collection, atomically updating
+//one of the documents matching a filter and replying with it, as it was before unless returnNew is set
+func (s *Server) FindAndModifyReq(collectionName string, resp http.ResponseWriter, r *http.Request) {
+	var result db.ModifyResult
+	req, options, err := parseModifyRequest(r)
+	var collection db.Collection
+	if err == nil {
+		collection, err = s.getCollection(collectionName)
+	}
+	if err == nil {
+		result, err = collection.Db.FindAndModify(string(req.Filter), string(req.Update), options)
+	}
+	respond(resp, result, err)
+}
 
-	if r.Method != http.MethodPatch {
-		errMsg = "Only PATCH is supported at this endpoint"
-	} else {
-		bodyStr := getBodyStr(resp, r)
-
-		var err error
-		var result datatypes.JS
-		if collection, ok := s.collectionsMapping[collectionName]; ok {
-			result, err = collection.Db.Update(id, bodyStr)
-		} else {
-			err = errors.New("no collection named '" + collectionName + "'")
-		}
+//UpsertReq serves requests on the upsert endpoint of a collection, updating a document matching a filter
+//or inserting one if none does, and replying with the stored document
+func (s *Server) UpsertReq(collectionName string, resp http.ResponseWriter, r *http.Request) {
+	var result db.ModifyResult
+	req, _, err := parseModifyRequest(r)
+	var collection db.Collection
+	if err == nil {
+		collection, err = s.getCollection(collectionName)
+	}
+	if err == nil {
+		result, err = db.Upsert(collection.Db, string(req.Filter), string(req.Update))
+	}
+	respond(resp, result, err)
+}
 
-		if err == nil {
-			/*rawBody, err := json.RawMessage(objects).MarshalJSON()
-			if err != nil {
-				errMsg = err.Error()
-			} else {
-				responseBody["objects"] = string(rawBody)
-				log.Println("Raw Body followed by the string() version")
-				log.Println(rawBody)
-				log.Println(string(rawBody))
-			}*/
-			if jsonBody, jsonErr := json.Marshal(result); jsonErr == nil {
-				log.Println(result)
-				resp.Write(jsonBody)
-			} else {
-				errMsg = err.Error()
-			}
+//UpdateManyReq serves requests on the updateMany endpoint of a collection, applying an update to every document
+//matching a filter, and replying with how many matched and were modified as in {"matched": 3, "modified": 2}
+func (s *Server) UpdateManyReq(collectionName string, resp http.ResponseWriter, r *http.Request) {
+	var result db.UpdateResult
+	req, _, err := parseModifyRequest(r)
+	var collection db.Collection
+	if err == nil {
+		collection, err = s.getCollection(collectionName)
+	}
+	if err == nil {
+		result, err = collection.Db.UpdateMany(string(req.Filter), string(req.Update))
+	}
+	respond(resp, result, err)
+}
 
-		} else {
-			errMsg = err.Error()
-		}
+//IndexesReq serves requests on the indexes endpoint/resource of a collection:
+//GET lists the value indexes, POST creates one (IndexSpec in the body) and DELETE on /indexes/{name} drops one
+func (s *Server) IndexesReq(collectionName, indexName string, resp http.ResponseWriter, r *http.Request) {
+	collection, err := s.getCollection(collectionName)
+	if err != nil {
+		writeError(resp, err)
+		return
+	}
+	indexes, canIndex := collection.Db.(db.IndexManager)
+	if !canIndex {
+		writeError(resp, badRequest("collection '"+collectionName+"' does not support indexes"))
+		return
 	}
 
-	if errMsg != "" {
-		resp.Write([]byte("{\"error\":\"" + errMsg + "\"}"))
+	var result interface{}
+	if indexName == "" && r.Method == http.MethodGet {
+		result = indexes.Indexes()
+	} else if indexName == "" && r.Method == http.MethodPost {
+		var spec db.IndexSpec
+		var bodyStr string
+		if bodyStr, err = getBodyStr(r); err == nil {
+			if jsonErr := json.Unmarshal([]byte(bodyStr), &spec); jsonErr != nil {
+				err = invalidDocument(errors.New("invalid index spec: " + jsonErr.Error()))
+			} else {
+				result, err = indexes.CreateIndex(spec)
+			}
+		}
+	} else {
+		if err = indexes.DropIndex(indexName); err == nil {
+			result = datatypes.JS{"dropped": indexName}
+		}
 	}
+	respond(resp, result, err)
 }
 
-//ProcessRequestQueue goes through the request queue, passing the requests to ServeRequests, one by one
-func (s *Server) ProcessRequestQueue() {
-	log.Print("Now listening")
-	for rd := range s.requests {
-		s.ServeRequests(rd.resp, rd.r)
-		rd.done <- 1
+//compactCollections is run periodically by the compaction worker,
+//compacting every collection with enough dead records
+func (s *Server) compactCollections() {
+	for _, name := range s.database.CollectionNames() {
+		collection, err := s.database.Collection(name)
+		if err != nil {
+			//Closed meanwhile
+			return
+		}
+		if maintainer, ok := collection.Db.(db.Maintainer); ok {
+			if _, err := maintainer.CompactIfNeeded(); err != nil {
+				log.Printf("Compacting %s failed: %v", name, err)
+			}
+		}
 	}
 }
 
+//ServeRequests dispatches a request through the route table, see routes
 func (s *Server) ServeRequests(resp http.ResponseWriter, r *http.Request) {
-	// Immediate solution, not the prettiest:
-	// 1. Split incoming path by /
-	// 2. branch by if-branches, where each nested if is a step further in the array generated by the split
-	//in the future, have a map (with nested structure) containing a mapping from path to method reference
-
-	log.Println(r.Method + " at " + r.URL.EscapedPath())
+	logging.Debugf("%s at %s", r.Method, r.URL.EscapedPath())
 	resp.Header().Set("Content-Type", "application/json")
+	s.router.ServeHTTP(resp, r)
+}
 
-	escaped := r.URL.EscapedPath()
-	split := strings.Split(escaped, "/")
-	switch split[1] {
-	case "status":
+//routes builds the route table of the server:
+//    GET    /status, /version
+//    POST   /shutdown
+//    GET    /collections                             list the collections
+//    POST   /collections                             create a collection, see CreateCollectionReq
+//    DELETE /collections/{collection}                drop a collection and its files
+//    POST   /collections/{collection}/docs           write a document
+//    POST   /collections/{collection}/query          read the documents matching a query, see readOptions
+//    POST   /collections/{collection}/findAndModify  update a document matching a filter, see FindAndModifyReq
+//    POST   /collections/{collection}/upsert         update a document matching a filter, or insert one
+//    POST   /collections/{collection}/updateMany     update every document matching a filter, see UpdateManyReq
+//    GET    /collections/{collection}/docs/{id}      read a document
+//    PUT    /collections/{collection}/docs/{id}      replace a document
+//    PATCH  /collections/{collection}/docs/{id}      apply a patch or update operators to a document
+//    DELETE /collections/{collection}/docs/{id}      delete a document
+//    POST   /collections/{collection}/compact, /verify
+//    GET    /collections/{collection}/indexes        list the value indexes, POST creates one
+//    DELETE /collections/{collection}/indexes/{index}
+//POST on /collections/{collection}/create, /read and /delete is still served, as before the route table.
+func (s *Server) routes() *router {
+	rt := &router{}
+	rt.handle(http.MethodGet, "/status", func(resp http.ResponseWriter, r *http.Request, p params) {
 		resp.Write([]byte("running"))
-		break
-	case "version":
+	})
+	rt.handle(http.MethodGet, "/version", func(resp http.ResponseWriter, r *http.Request, p params) {
 		resp.Write([]byte("1.0"))
-		break
-	case "shutdown":
+	})
+	rt.handle(http.MethodPost, "/shutdown", func(resp http.ResponseWriter, r *http.Request, p params) {
 		s.Stop()
-		break
-	case "collections":
-		if len(split) > 2 {
-			collectionName := split[2]
-			switch split[3] {
-			case "create":
-				s.WriteReq(collectionName, resp, r)
-				break
-			case "read":
-				s.ReadReq(collectionName, resp, r)
-				break
-			case "delete":
-				s.DeleteReq(collectionName, resp, r)
-				break
-			default:
-				log.Printf("Assuming %s is an ID", split[3])
-				s.UpdateReq(collectionName, split[3], resp, r)
-			}
-		} else {
-			switch r.Method {
-			case http.MethodGet:
-				s.CollectionsListReq(resp, r)
-				break
-			case http.MethodPost:
-				s.CreateCollectionReq(resp, r)
-				break
-			}
-
-			break
-		}
+	})
+
+	rt.handle(http.MethodGet, "/collections", func(resp http.ResponseWriter, r *http.Request, p params) {
+		s.CollectionsListReq(resp, r)
+	})
+	rt.handle(http.MethodPost, "/collections", func(resp http.ResponseWriter, r *http.Request, p params) {
+		s.CreateCollectionReq(resp, r)
+	})
+	rt.handle(http.MethodDelete, "/collections/{collection}", func(resp http.ResponseWriter, r *http.Request, p params) {
+		s.DropCollectionReq(p["collection"], resp, r)
+	})
+
+	//Handlers taking the collection name, and the ones also taking the document ID
+	collectionRoutes := []struct {
+		method, pattern string
+		serve           func(collectionName string, resp http.ResponseWriter, r *http.Request)
+	}{
+		{http.MethodPost, "/docs", s.WriteReq},
+		{http.MethodPost, "/query", s.ReadReq},
+		{http.MethodPost, "/findAndModify", s.FindAndModifyReq},
+		{http.MethodPost, "/upsert", s.UpsertReq},
+		{http.MethodPost, "/updateMany", s.UpdateManyReq},
+		{http.MethodPost, "/compact", s.CompactReq},
+		{http.MethodPost, "/verify", s.VerifyReq},
+		{http.MethodPost, "/create", s.WriteReq},
+		{http.MethodPost, "/read", s.ReadReq},
+		{http.MethodPost, "/delete", s.DeleteReq},
+	}
+	for _, cr := range collectionRoutes {
+		serve := cr.serve
+		rt.handle(cr.method, "/collections/{collection}"+cr.pattern, func(resp http.ResponseWriter, r *http.Request, p params) {
+			serve(p["collection"], resp, r)
+		})
+	}
+	docRoutes := []struct {
+		method string
+		serve  func(collectionName, id string, resp http.ResponseWriter, r *http.Request)
+	}{
+		{http.MethodGet, s.GetDocReq},
+		{http.MethodPut, s.PutDocReq},
+		{http.MethodPatch, s.UpdateReq},
+		{http.MethodDelete, s.DeleteDocReq},
+	}
+	for _, dr := range docRoutes {
+		serve := dr.serve
+		rt.handle(dr.method, "/collections/{collection}/docs/{id}", func(resp http.ResponseWriter, r *http.Request, p params) {
+			serve(p["collection"], p["id"], resp, r)
+		})
+	}
 
-	default:
-		log.Printf("'%s' did not match any path", split[0])
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		rt.handle(method, "/collections/{collection}/indexes", func(resp http.ResponseWriter, r *http.Request, p params) {
+			s.IndexesReq(p["collection"], "", resp, r)
+		})
 	}
+	rt.handle(http.MethodDelete, "/collections/{collection}/indexes/{index}", func(resp http.ResponseWriter, r *http.Request, p params) {
+		s.IndexesReq(p["collection"], p["index"], resp, r)
+	})
+	return rt
 }
 
 //MapCollection maps a collectionName to a collection object
 func (s *Server) MapCollection(collectionName string) db.Collection {
-	return s.collectionsMapping[collectionName]
+	collection, _ := s.getCollection(collectionName)
+	return collection
 }
@@ -0,0 +1,118 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"nosql-db/pkg/datatypes"
+	"nosql-db/pkg/db"
+)
+
+//requestIDHeader carries the ID of a request. Clients may set it, otherwise one is generated.
+//It is sent back on every response, and in the body of errors.
+const requestIDHeader = "X-Request-Id"
+
+//maxRequestIDLength is the length above which request IDs set by clients are replaced
+const maxRequestIDLength = 64
+
+//Error codes, found in the body of error responses alongside the message and the request ID, as in
+//    {"error": "Object does not exist", "code": "notFound", "requestId": "5f1c0a3e9b2d4c71"}
+const (
+	codeInvalidRequest    = "invalidRequest"
+	codeMethodNotAllowed  = "methodNotAllowed"
+	codeUnknownRoute      = "unknownRoute"
+	codeInvalidDocument   = "invalidDocument"
+	codeNotFound          = "notFound"
+	codeCollectionMissing = "collectionMissing"
+	codeConflict          = "conflict"
+	codeInternal          = "internal"
+)
+
+//requestError is an error in a request itself rather than in what it asks of the database,
+//as in a malformed query parameter
+type requestError struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *requestError) Error() string {
+	return e.message
+}
+
+func badRequest(message string) error {
+	return &requestError{http.StatusBadRequest, codeInvalidRequest, message}
+}
+
+func methodNotAllowed(message string) error {
+	return &requestError{http.StatusMethodNotAllowed, codeMethodNotAllowed, message}
+}
+
+//invalidDocument turns an error parsing a request body into a db.ErrInvalidDocument
+func invalidDocument(err error) error {
+	return &db.Error{Kind: db.ErrInvalidDocument, Message: err.Error()}
+}
+
+//errorStatus returns the HTTP status and error code `err` is reported with
+func errorStatus(err error) (int, string) {
+	if reqErr := (*requestError)(nil); errors.As(err, &reqErr) {
+		return reqErr.status, reqErr.code
+	}
+	switch {
+	case errors.Is(err, db.ErrInvalidDocument):
+		return http.StatusBadRequest, codeInvalidDocument
+	case errors.Is(err, db.ErrNotFound):
+		return http.StatusNotFound, codeNotFound
+	case errors.Is(err, db.ErrCollectionMissing):
+		return http.StatusNotFound, codeCollectionMissing
+	case errors.Is(err, db.ErrConflict):
+		return http.StatusConflict, codeConflict
+	}
+	return http.StatusInternalServerError, codeInternal
+}
+
+//writeError responds with the status of `err`, and a JSON body describing it.
+//Duplicate keys also name the unique index, the key and the object already holding it.
+func writeError(resp http.ResponseWriter, err error) {
+	status, code := errorStatus(err)
+	requestID := resp.Header().Get(requestIDHeader)
+	if status == http.StatusInternalServerError {
+		log.Printf("Request %s failed: %v", requestID, err)
+	}
+	body := datatypes.JS{"error": err.Error(), "code": code, "requestId": requestID}
+	if dupErr := (*db.DuplicateKeyError)(nil); errors.As(err, &dupErr) {
+		body["index"], body["key"], body["id"] = dupErr.Index, dupErr.Key, dupErr.ID
+	}
+	data, _ := json.Marshal(body)
+	resp.WriteHeader(status)
+	resp.Write(data)
+}
+
+//writeJSON responds with `body` as JSON
+func writeJSON(resp http.ResponseWriter, body interface{}) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		writeError(resp, err)
+		return
+	}
+	resp.Write(data)
+}
+
+//respond writes `body`, or `err` if it is not nil
+func respond(resp http.ResponseWriter, body interface{}, err error) {
+	if err != nil {
+		writeError(resp, err)
+	} else {
+		writeJSON(resp, body)
+	}
+}
+
+//newRequestID returns a random ID for a request
+func newRequestID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,108 @@
+package api
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+//params holds the values of the {name} segments of a route's pattern
+type params map[string]string
+
+//handler serves the requests matching a route
+type handler func(resp http.ResponseWriter, r *http.Request, p params)
+
+//route maps a path pattern, as in /collections/{collection}/docs/{id}, to the handler of each of its methods
+type route struct {
+	segments []string
+	handlers map[string]handler
+}
+
+//router dispatches requests to the route matching their path, and the handler of their method.
+//Unknown paths get a 404, known paths with no handler for the method a 405.
+type router struct {
+	routes []route
+}
+
+//handle adds the handler of `method` for paths matching `pattern`
+func (rt *router) handle(method, pattern string, h handler) {
+	segments := splitPath(pattern)
+	for i := range rt.routes {
+		if equalSegments(rt.routes[i].segments, segments) {
+			rt.routes[i].handlers[method] = h
+			return
+		}
+	}
+	rt.routes = append(rt.routes, route{segments: segments, handlers: map[string]handler{method: h}})
+}
+
+func (rt *router) ServeHTTP(resp http.ResponseWriter, r *http.Request) {
+	segments := splitPath(r.URL.EscapedPath())
+	for _, route := range rt.routes {
+		p, ok := route.match(segments)
+		if !ok {
+			continue
+		}
+		if h, found := route.handlers[r.Method]; found {
+			h(resp, r, p)
+			return
+		}
+		resp.Header().Set("Allow", route.allowed())
+		writeError(resp, methodNotAllowed(r.Method+" is not supported on "+r.URL.Path+", only "+route.allowed()))
+		return
+	}
+	writeError(resp, &requestError{http.StatusNotFound, codeUnknownRoute, "no route for " + r.URL.Path})
+}
+
+//match returns the values of the {name} segments of the route if `segments` match it
+func (rt route) match(segments []string) (params, bool) {
+	if len(segments) != len(rt.segments) {
+		return nil, false
+	}
+	p := params{}
+	for i, segment := range rt.segments {
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+			//IDs may hold escaped slashes, which only get unescaped once the path is split
+			value, err := url.PathUnescape(segments[i])
+			if err != nil || value == "" {
+				return nil, false
+			}
+			p[segment[1:len(segment)-1]] = value
+		} else if segment != segments[i] {
+			return nil, false
+		}
+	}
+	return p, true
+}
+
+//allowed returns the methods the route has a handler for, as in the Allow header
+func (rt route) allowed() string {
+	methods := make([]string, 0, len(rt.handlers))
+	for method := range rt.handlers {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	return strings.Join(methods, ", ")
+}
+
+//splitPath splits a path into its segments, ignoring leading and trailing slashes
+func splitPath(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
+
+func equalSegments(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
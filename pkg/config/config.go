@@ -0,0 +1,166 @@
+package config
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"nosql-db/pkg/db"
+	"nosql-db/pkg/logging"
+	"os"
+	"time"
+)
+
+//configFileEnv is the environment variable naming the configuration file, when not given with -config
+const configFileEnv = "NOSQLDB_CONFIG"
+
+//Config of a database server. It is read from, in increasing order of precedence:
+//its defaults, a JSON configuration file, NOSQLDB_* environment variables and command line flags.
+//See settings for the name of every setting in each of them.
+type Config struct {
+	//DataDir is the folder holding the collections
+	DataDir string
+	//ListenAddress is the address the HTTP server listens on
+	ListenAddress string
+	//LogLevel is the minimum level of messages to log, see the logging package
+	LogLevel string
+	//Fsync is when writes are synced to disk, db.FsyncAlways or db.FsyncNever
+	Fsync string
+	//CompactionInterval is how often collections are checked for compaction in the background
+	CompactionInterval time.Duration
+}
+
+//Default returns the configuration used for every setting left unset
+func Default() Config {
+	options := db.DefaultOptions()
+	return Config{
+		DataDir:            options.DataDir,
+		ListenAddress:      ":9999",
+		LogLevel:           logging.LevelInfo,
+		Fsync:              options.Fsync,
+		CompactionInterval: 10 * time.Minute,
+	}
+}
+
+//setting is a single configuration setting, with its name in each source
+type setting struct {
+	//key in the configuration file
+	key   string
+	env   string
+	flag  string
+	usage string
+	set   func(c *Config, value string) error
+}
+
+var settings = []setting{
+	{"dataDir", "NOSQLDB_DATA_DIR", "data-dir", "folder holding the collections",
+		func(c *Config, value string) error { c.DataDir = value; return nil }},
+	{"listenAddress", "NOSQLDB_LISTEN_ADDRESS", "listen", "address the HTTP server listens on",
+		func(c *Config, value string) error { c.ListenAddress = value; return nil }},
+	{"logLevel", "NOSQLDB_LOG_LEVEL", "log-level", "debug, info or error",
+		func(c *Config, value string) error { c.LogLevel = value; return nil }},
+	{"fsync", "NOSQLDB_FSYNC", "fsync", "when writes are synced to disk: always or never",
+		func(c *Config, value string) error { c.Fsync = value; return nil }},
+	{"compactionInterval", "NOSQLDB_COMPACTION_INTERVAL", "compaction-interval", "how often collections are checked for compaction, as in 10m",
+		func(c *Config, value string) error { return c.setCompactionInterval(value) }},
+}
+
+//setCompactionInterval sets the compaction interval from a duration such as 10m
+func (c *Config) setCompactionInterval(value string) (err error) {
+	c.CompactionInterval, err = time.ParseDuration(value)
+	return err
+}
+
+//Load reads the configuration from the file, environment and flags in `args`, which are parsed up to the
+//first non-flag argument. Returns the configuration, and the arguments left after the flags.
+//
+//Configuration files are JSON objects, as in
+//    {"dataDir": "/var/lib/nosqldb", "listenAddress": ":8080", "fsync": "never", "compactionInterval": "1h"}
+func Load(args []string) (Config, []string, error) {
+	flags := flag.NewFlagSet("nosqldb", flag.ContinueOnError)
+	configFile := flags.String("config", os.Getenv(configFileEnv), "JSON configuration file (env "+configFileEnv+")")
+	flagValues := make(map[string]string)
+	for _, s := range settings {
+		s := s
+		flags.Func(s.flag, s.usage+" (env "+s.env+")", func(value string) error {
+			flagValues[s.flag] = value
+			return nil
+		})
+	}
+	if err := flags.Parse(args); err != nil {
+		return Config{}, nil, err
+	}
+
+	config := Default()
+	if *configFile != "" {
+		if err := config.loadFile(*configFile); err != nil {
+			return Config{}, nil, err
+		}
+	}
+	for _, s := range settings {
+		if value, found := os.LookupEnv(s.env); found {
+			if err := s.set(&config, value); err != nil {
+				return Config{}, nil, fmt.Errorf("%s: %v", s.env, err)
+			}
+		}
+	}
+	for _, s := range settings {
+		if value, found := flagValues[s.flag]; found {
+			if err := s.set(&config, value); err != nil {
+				return Config{}, nil, fmt.Errorf("-%s: %v", s.flag, err)
+			}
+		}
+	}
+	return config, flags.Args(), config.validate()
+}
+
+//loadFile sets the settings found in the configuration file at `path`
+func (c *Config) loadFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var values map[string]interface{}
+	if err := json.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	for _, s := range settings {
+		value, found := values[s.key]
+		if !found {
+			continue
+		}
+		delete(values, s.key)
+		if err := s.set(c, fmt.Sprint(value)); err != nil {
+			return fmt.Errorf("%s: %s: %v", path, s.key, err)
+		}
+	}
+	for key := range values {
+		return fmt.Errorf("%s: unknown setting '%s'", path, key)
+	}
+	return nil
+}
+
+func (c *Config) validate() error {
+	if c.DataDir == "" {
+		return fmt.Errorf("the data directory cannot be empty")
+	}
+	if c.Fsync != db.FsyncAlways && c.Fsync != db.FsyncNever {
+		return fmt.Errorf("unknown fsync policy '%s'", c.Fsync)
+	}
+	if c.CompactionInterval <= 0 {
+		return fmt.Errorf("the compaction interval must be positive")
+	}
+	switch c.LogLevel {
+	case logging.LevelDebug, logging.LevelInfo, logging.LevelError:
+		return nil
+	}
+	return fmt.Errorf("unknown log level '%s'", c.LogLevel)
+}
+
+//DBOptions returns the options collections are stored with
+func (c Config) DBOptions() db.Options {
+	return db.Options{
+		DataDir: c.DataDir,
+		Fsync:   c.Fsync,
+	}
+}
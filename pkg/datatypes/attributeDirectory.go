@@ -0,0 +1,92 @@
+package datatypes
+
+import (
+	"bufio"
+	"io"
+	"log"
+)
+
+//AttributeChain locates an attribute chain in the attribute file
+type AttributeChain struct {
+	//Head is the offset of the first item of the chain
+	Head int64
+	//TailNext is the offset of the `next` pointer of the last item, where the next item gets linked
+	TailNext int64
+	//Length is the number of items in the chain, stale IDs included
+	Length int
+}
+
+//AttributeDirectory maps attribute names (as in the attribute file, e.g. "/brother.name") to their chain,
+//so chains are found without going through the attribute file.
+//It is not persisted on its own: heads of chains carry their name in the attribute file,
+//which is read once when the collection is loaded (see LoadAttributeDirectory) then kept up to date by Append.
+type AttributeDirectory struct {
+	chains map[string]*AttributeChain
+}
+
+//NewAttributeDirectory returns an empty directory, for an empty attribute file
+func NewAttributeDirectory() *AttributeDirectory {
+	return &AttributeDirectory{chains: make(map[string]*AttributeChain)}
+}
+
+//LoadAttributeDirectory from the attribute file, read through `r` starting right after the header.
+//Items are always appended after the item pointing at them, so a single pass through the file
+//finds out which chain every item belongs to. Items never linked to a chain (left behind by a crash) are ignored.
+func LoadAttributeDirectory(r io.Reader) *AttributeDirectory {
+	directory := NewAttributeDirectory()
+	reader := bufio.NewReader(r)
+	//chainAt maps the offset of the next item of each chain to the name of the chain
+	chainAt := make(map[int64]string)
+	offset := int64(FileHeaderSize)
+	for {
+		record, err := ReadAttributeRecord(reader)
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("Stopped reading attribute file at offset %d: %v", offset, err)
+			}
+			return directory
+		}
+		key := record.Key
+		if !record.IsHead() {
+			key = chainAt[offset]
+			delete(chainAt, offset)
+		}
+		if key != "" {
+			directory.Append(key, offset, record)
+			//Pointers going backwards can only be corruption, and are not followed
+			if record.Next > offset {
+				chainAt[record.Next] = key
+			}
+		}
+		offset += int64(record.Size())
+	}
+}
+
+//Get returns the chain of attribute `name`
+func (ad *AttributeDirectory) Get(name string) (AttributeChain, bool) {
+	chain, found := ad.chains[name]
+	if !found {
+		return AttributeChain{}, false
+	}
+	return *chain, true
+}
+
+//Len returns the number of items in the chain of attribute `name`, 0 if there is none
+func (ad *AttributeDirectory) Len(name string) int {
+	if chain, found := ad.chains[name]; found {
+		return chain.Length
+	}
+	return 0
+}
+
+//Append records `record`, written at `offset`, as the new last item of the chain of attribute `name`.
+//The first item appended to a chain is its head.
+func (ad *AttributeDirectory) Append(name string, offset int64, record *AttributeRecord) {
+	chain, found := ad.chains[name]
+	if !found {
+		chain = &AttributeChain{Head: offset}
+		ad.chains[name] = chain
+	}
+	chain.TailNext = offset + int64(record.NextPointerOffset())
+	chain.Length++
+}
@@ -0,0 +1,82 @@
+package datatypes
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+)
+
+//bloomBitsPerKey and bloomHashes give a false positive rate of about 1%
+const (
+	bloomBitsPerKey = 10
+	bloomHashes     = 7
+)
+
+//ErrCorruptedBloomFilter is returned when loading a bloom filter from bytes which cannot hold one
+var ErrCorruptedBloomFilter = errors.New("Corrupted bloom filter")
+
+//BloomFilter tells whether a key may be in a set, or is definitely not in it
+type BloomFilter struct {
+	bits   []byte
+	hashes uint32
+}
+
+//NewBloomFilter returns an empty filter sized for `keys` keys
+func NewBloomFilter(keys int) *BloomFilter {
+	size := (keys*bloomBitsPerKey + 7) / 8
+	if size < 8 {
+		size = 8
+	}
+	return &BloomFilter{bits: make([]byte, size), hashes: bloomHashes}
+}
+
+//Add `key` to the set
+func (bf *BloomFilter) Add(key string) {
+	bf.each(key, func(bit uint32) bool {
+		bf.bits[bit/8] |= 1 << (bit % 8)
+		return true
+	})
+}
+
+//MayContain returns false if `key` is definitely not in the set
+func (bf *BloomFilter) MayContain(key string) bool {
+	found := true
+	bf.each(key, func(bit uint32) bool {
+		found = bf.bits[bit/8]&(1<<(bit%8)) != 0
+		return found
+	})
+	return found
+}
+
+//each calls `fn` with every bit of `key`, until it returns false.
+//Bits are derived from the two halves of a single 64-bit hash (double hashing).
+func (bf *BloomFilter) each(key string, fn func(bit uint32) bool) {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	h1, h2 := uint32(sum), uint32(sum>>32)
+	size := uint32(len(bf.bits) * 8)
+	for i := uint32(0); i < bf.hashes; i++ {
+		if !fn((h1 + i*h2) % size) {
+			return
+		}
+	}
+}
+
+//WriteableRepr is the representation of the filter as found in files: number of hashes (uint32), then the bits
+func (bf *BloomFilter) WriteableRepr() []byte {
+	data := make([]byte, 4+len(bf.bits))
+	binary.BigEndian.PutUint32(data, bf.hashes)
+	copy(data[4:], bf.bits)
+	return data
+}
+
+//LoadBloomFilter is the inverse of WriteableRepr
+func LoadBloomFilter(data []byte) (*BloomFilter, error) {
+	if len(data) <= 4 {
+		return nil, ErrCorruptedBloomFilter
+	}
+	bits := make([]byte, len(data)-4)
+	copy(bits, data[4:])
+	return &BloomFilter{bits: bits, hashes: binary.BigEndian.Uint32(data)}, nil
+}
@@ -0,0 +1,272 @@
+package datatypes
+
+import "sort"
+
+//btreeDegree is the minimum degree of BTree nodes: every node but the root holds between
+//btreeDegree-1 and 2*btreeDegree-1 items
+const btreeDegree = 32
+
+//BTree is an in-memory B-tree mapping ordered keys to sets of IDs.
+//Used by value indexes answering range queries; keys are compared as raw bytes, see EncodeIndexKey.
+type BTree struct {
+	root *btreeNode
+	len  int
+}
+
+type btreeItem struct {
+	key string
+	ids map[string]struct{}
+}
+
+type btreeNode struct {
+	items []*btreeItem
+	//children is empty for leaves, and has len(items)+1 nodes otherwise
+	children []*btreeNode
+}
+
+//NewBTree constructs an empty BTree
+func NewBTree() *BTree {
+	return &BTree{root: &btreeNode{}}
+}
+
+//Len returns the number of distinct keys in the tree
+func (t *BTree) Len() int {
+	return t.len
+}
+
+//Get returns the IDs stored under `key`
+func (t *BTree) Get(key string) []string {
+	node := t.root
+	for {
+		i, found := node.search(key)
+		if found {
+			return node.items[i].idList()
+		}
+		if node.isLeaf() {
+			return nil
+		}
+		node = node.children[i]
+	}
+}
+
+//Add stores `id` under `key`
+func (t *BTree) Add(key, id string) {
+	if len(t.root.items) == 2*btreeDegree-1 {
+		oldRoot := t.root
+		t.root = &btreeNode{children: []*btreeNode{oldRoot}}
+		t.root.splitChild(0)
+	}
+	if t.root.insert(key, id) {
+		t.len++
+	}
+}
+
+//Remove removes `id` from the IDs stored under `key`, and the key itself if no ID is left under it
+func (t *BTree) Remove(key, id string) {
+	item := t.find(key)
+	if item == nil {
+		return
+	}
+	delete(item.ids, id)
+	if len(item.ids) > 0 {
+		return
+	}
+	t.root.remove(key)
+	t.len--
+	//The root is the only node allowed to run out of items, in which case the tree shrinks by a level
+	if len(t.root.items) == 0 && !t.root.isLeaf() {
+		t.root = t.root.children[0]
+	}
+}
+
+//Ascend calls `fn` for every key greater than or equal to `from`, in order, along with its IDs.
+//Stops as soon as `fn` returns false.
+func (t *BTree) Ascend(from string, fn func(key string, ids []string) bool) {
+	t.root.ascend(from, fn)
+}
+
+func (t *BTree) find(key string) *btreeItem {
+	node := t.root
+	for {
+		i, found := node.search(key)
+		if found {
+			return node.items[i]
+		}
+		if node.isLeaf() {
+			return nil
+		}
+		node = node.children[i]
+	}
+}
+
+func (item *btreeItem) idList() []string {
+	ids := make([]string, 0, len(item.ids))
+	for id := range item.ids {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func (n *btreeNode) isLeaf() bool {
+	return len(n.children) == 0
+}
+
+//search returns the position of `key` among the node's items, or of the child it would be found under
+func (n *btreeNode) search(key string) (int, bool) {
+	i := sort.Search(len(n.items), func(i int) bool { return n.items[i].key >= key })
+	return i, i < len(n.items) && n.items[i].key == key
+}
+
+//splitChild splits the full child at `i` in two around its median item, which moves up into `n`
+func (n *btreeNode) splitChild(i int) {
+	child := n.children[i]
+	median := child.items[btreeDegree-1]
+	right := &btreeNode{items: append([]*btreeItem{}, child.items[btreeDegree:]...)}
+	if !child.isLeaf() {
+		right.children = append([]*btreeNode{}, child.children[btreeDegree:]...)
+		child.children = child.children[:btreeDegree]
+	}
+	child.items = child.items[:btreeDegree-1]
+
+	n.items = append(n.items, nil)
+	copy(n.items[i+1:], n.items[i:])
+	n.items[i] = median
+	n.children = append(n.children, nil)
+	copy(n.children[i+2:], n.children[i+1:])
+	n.children[i+1] = right
+}
+
+//insert adds `id` under `key` in the subtree of `n`, which must not be full.
+//Returns true if the key was not in the tree yet.
+func (n *btreeNode) insert(key, id string) bool {
+	i, found := n.search(key)
+	if found {
+		n.items[i].ids[id] = struct{}{}
+		return false
+	}
+	if n.isLeaf() {
+		item := &btreeItem{key: key, ids: map[string]struct{}{id: {}}}
+		n.items = append(n.items, nil)
+		copy(n.items[i+1:], n.items[i:])
+		n.items[i] = item
+		return true
+	}
+	if len(n.children[i].items) == 2*btreeDegree-1 {
+		n.splitChild(i)
+		//The median moved up, the key now belongs on either side of it (or is the median itself)
+		if n.items[i].key == key {
+			n.items[i].ids[id] = struct{}{}
+			return false
+		}
+		if key > n.items[i].key {
+			i++
+		}
+	}
+	return n.children[i].insert(key, id)
+}
+
+//remove deletes `key` from the subtree of `n`. Every node descended into is first given at least
+//btreeDegree items, so removing from it can never leave it with too few.
+func (n *btreeNode) remove(key string) {
+	i, found := n.search(key)
+	if n.isLeaf() {
+		if found {
+			n.items = append(n.items[:i], n.items[i+1:]...)
+		}
+		return
+	}
+
+	if found {
+		left, right := n.children[i], n.children[i+1]
+		switch {
+		case len(left.items) >= btreeDegree:
+			//Replace the key by its predecessor, then remove the predecessor further down
+			predecessor := left.max()
+			n.items[i] = predecessor
+			left.remove(predecessor.key)
+		case len(right.items) >= btreeDegree:
+			successor := right.min()
+			n.items[i] = successor
+			right.remove(successor.key)
+		default:
+			n.mergeChildren(i)
+			n.children[i].remove(key)
+		}
+		return
+	}
+
+	if len(n.children[i].items) < btreeDegree {
+		n.growChild(i)
+		//Items moved around, look for the key again
+		n.remove(key)
+		return
+	}
+	n.children[i].remove(key)
+}
+
+//growChild gives the child at `i` an extra item, borrowed from a sibling or by merging with one
+func (n *btreeNode) growChild(i int) {
+	child := n.children[i]
+	if i > 0 && len(n.children[i-1].items) >= btreeDegree {
+		left := n.children[i-1]
+		child.items = append([]*btreeItem{n.items[i-1]}, child.items...)
+		n.items[i-1] = left.items[len(left.items)-1]
+		left.items = left.items[:len(left.items)-1]
+		if !left.isLeaf() {
+			child.children = append([]*btreeNode{left.children[len(left.children)-1]}, child.children...)
+			left.children = left.children[:len(left.children)-1]
+		}
+		return
+	}
+	if i < len(n.items) && len(n.children[i+1].items) >= btreeDegree {
+		right := n.children[i+1]
+		child.items = append(child.items, n.items[i])
+		n.items[i] = right.items[0]
+		right.items = right.items[1:]
+		if !right.isLeaf() {
+			child.children = append(child.children, right.children[0])
+			right.children = right.children[1:]
+		}
+		return
+	}
+	if i == len(n.items) {
+		i--
+	}
+	n.mergeChildren(i)
+}
+
+//mergeChildren merges the children at `i` and `i+1`, along with the item separating them, into a single node
+func (n *btreeNode) mergeChildren(i int) {
+	left, right := n.children[i], n.children[i+1]
+	left.items = append(append(left.items, n.items[i]), right.items...)
+	left.children = append(left.children, right.children...)
+	n.items = append(n.items[:i], n.items[i+1:]...)
+	n.children = append(n.children[:i+1], n.children[i+2:]...)
+}
+
+func (n *btreeNode) min() *btreeItem {
+	for !n.isLeaf() {
+		n = n.children[0]
+	}
+	return n.items[0]
+}
+
+func (n *btreeNode) max() *btreeItem {
+	for !n.isLeaf() {
+		n = n.children[len(n.children)-1]
+	}
+	return n.items[len(n.items)-1]
+}
+
+func (n *btreeNode) ascend(from string, fn func(key string, ids []string) bool) bool {
+	i, _ := n.search(from)
+	for ; i <= len(n.items); i++ {
+		if !n.isLeaf() && !n.children[i].ascend(from, fn) {
+			return false
+		}
+		if i < len(n.items) && !fn(n.items[i].key, n.items[i].idList()) {
+			return false
+		}
+	}
+	return true
+}
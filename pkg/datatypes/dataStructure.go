@@ -1,10 +1,11 @@
 package datatypes
 
 import (
+	"encoding/binary"
 	"errors"
+	"hash/crc32"
 	"log"
-	"strconv"
-	"strings"
+	"nosql-db/pkg/logging"
 )
 
 //DBFileExtension is the file extension of the index file
@@ -16,17 +17,36 @@ const IndexFileExtension = ".index"
 //AttributeFileExtension is the file extension of the attribute file
 const AttributeFileExtension = ".attr"
 
+//ValueIndexFileExtension is the file extension of the file holding the contents of value indexes
+const ValueIndexFileExtension = ".vidx"
+
+//IndexDefinitionsFileExtension is the file extension of the file listing the value indexes of a collection
+const IndexDefinitionsFileExtension = ".indexes"
+
+//WALFileExtension is the file extension of the write-ahead log
+const WALFileExtension = ".wal"
+
 //IDLength is the size in bytes of a single ID in index/attr files
 const IDLength = 32
 
-//IndexEntrySize is the size in bytes of a single entry in the index file
-const IndexEntrySize = IDLength + 20
+//OffsetSize is the size in bytes of a single offset or size field in index/attr files (big-endian uint64)
+const OffsetSize = 8
+
+//ChecksumSize is the size in bytes of a CRC32 checksum in the index file
+const ChecksumSize = 4
+
+//IndexEntrySize is the size in bytes of a single entry in the index file:
+//ID, db file offset, record size, CRC of the record, CRC of the entry itself
+const IndexEntrySize = IDLength + 2*OffsetSize + 2*ChecksumSize
 
-//LinkedListPointerSize is the size in bytes of a single pointer (offset) in the attr file
-const LinkedListPointerSize = 5
+//indexEntrySizeV1 is the size in bytes of a single entry in format version 1 index files, which had no checksums
+const indexEntrySizeV1 = IDLength + 2*OffsetSize
 
-//LinkedListPointerOffset is the offset from beginning of entry to pointer location
-const LinkedListPointerOffset = IDLength + LinkedListPointerSize
+//ErrEmptyIndexEntry is returned when parsing a deleted (zeroed) index entry
+var ErrEmptyIndexEntry = errors.New("Empty index entry")
+
+//ErrCorruptedIndexEntry is returned when parsing an index entry whose checksum does not match its contents
+var ErrCorruptedIndexEntry = errors.New("Corrupted index entry")
 
 //IndexEntry represents an entry in the index file
 type IndexEntry struct {
@@ -35,6 +55,8 @@ type IndexEntry struct {
 	indexFileOffset int64
 	size            int
 	_id             string
+	//checksum is the CRC32 of the object in the db file
+	checksum uint32
 }
 
 //IndexTable is an in-memory copy of the index file
@@ -46,6 +68,7 @@ type IndexTable struct {
 type IndexData struct {
 	Offset, IndexFileOffset int64
 	Size                    int
+	Checksum                uint32
 }
 
 //AttributesEntry represents an entry in the attributes file
@@ -57,79 +80,87 @@ type AttributesEntry struct {
 //JS represents a json object in go's primitives
 type JS map[string]interface{}
 
-//WriteableRepr is a representation of an index entry as found in the index file
+//WriteableRepr is a representation of an index entry as found in the index file:
+//the ID followed by the offset and size of the object in the db file, both as 64-bit big-endian integers,
+//then the CRC32 of the object and finally the CRC32 of all the preceding bytes of the entry
 func (ie *IndexEntry) WriteableRepr() []byte {
-	var builder strings.Builder
-
-	log.Printf("Writeable repr with id: %s", ie._id)
-
-	builder.WriteString(ie._id)
-	builder.WriteString(":")
-	builder.WriteString(strconv.Itoa(int(ie.offset)))
-	builder.WriteString(":")
-	builder.WriteString(strconv.Itoa(ie.size))
-
-	//Pad the final section with zeroes so each entry is the same length
-	desiredLen := IndexEntrySize - builder.Len()
-	for i := 0; i < desiredLen-1; i++ {
-		builder.WriteByte(0)
-	}
-
-	builder.WriteString(";")
-
-	return []byte(builder.String())
+	logging.Debugf("Writeable repr with id: %s", ie._id)
+
+	data := make([]byte, IndexEntrySize)
+	copy(data, ie._id)
+	binary.BigEndian.PutUint64(data[IDLength:], uint64(ie.offset))
+	binary.BigEndian.PutUint64(data[IDLength+OffsetSize:], uint64(ie.size))
+	binary.BigEndian.PutUint32(data[IDLength+2*OffsetSize:], ie.checksum)
+	entryChecksumOffset := IndexEntrySize - ChecksumSize
+	binary.BigEndian.PutUint32(data[entryChecksumOffset:], crc32.ChecksumIEEE(data[:entryChecksumOffset]))
+	return data
 }
 
+//GetIndexData returns the in-memory representation of the entry
 func (ie *IndexEntry) GetIndexData() IndexData {
 	return IndexData{
 		Offset:          ie.offset,
 		IndexFileOffset: ie.indexFileOffset,
 		Size:            ie.size,
+		Checksum:        ie.checksum,
 	}
 }
 
+//GetID returns the internal ID of the object the entry points to
+func (ie *IndexEntry) GetID() string {
+	return ie._id
+}
+
 //FromWriteableRepr constructs an IndexEntry instance from a segment of the index file.
-//returns an error if non-nil error if segment is empty (null bytes)
+//returns ErrEmptyIndexEntry if segment is empty (null bytes), and ErrCorruptedIndexEntry if its checksum is wrong
 func FromWriteableRepr(data string, indexFileOffset int64) (*IndexEntry, error) {
-	parts := strings.Split(data, ":")
-	//If the current segment is empty (previously deleted index entry)
-	if len(parts) == 1 {
-		return nil, errors.New("Empty index entry")
+	return fromWriteableRepr(data, indexFileOffset, FormatVersion)
+}
+
+func fromWriteableRepr(data string, indexFileOffset int64, version int) (*IndexEntry, error) {
+	//Deleted index entries are overwritten with null bytes
+	if data[0] == 0 {
+		return nil, ErrEmptyIndexEntry
+	}
+	raw := []byte(data)
+	ie := &IndexEntry{
+		offset:          int64(binary.BigEndian.Uint64(raw[IDLength:])),
+		indexFileOffset: indexFileOffset,
+		size:            int(binary.BigEndian.Uint64(raw[IDLength+OffsetSize:])),
+		_id:             data[:IDLength],
 	}
-	offset, offsetErr := strconv.Atoi(parts[1])
-	//Trailing zeroes (used for padding) need to be removed
-	size, sizeErr := strconv.Atoi(strings.Trim(parts[2][:len(parts[2])-1], "\x00"))
-	if offsetErr != nil || sizeErr != nil {
-		var errorMsg string
-		if offsetErr != nil {
-			errorMsg = offsetErr.Error()
-		} else {
-			errorMsg = sizeErr.Error()
+	//Version 1 entries carry no checksums
+	if version >= 2 {
+		entryChecksumOffset := IndexEntrySize - ChecksumSize
+		if crc32.ChecksumIEEE(raw[:entryChecksumOffset]) != binary.BigEndian.Uint32(raw[entryChecksumOffset:]) {
+			return nil, ErrCorruptedIndexEntry
 		}
-		log.Fatal("Invalid Data:" + errorMsg)
+		ie.checksum = binary.BigEndian.Uint32(raw[IDLength+2*OffsetSize:])
 	}
-	return &IndexEntry{
-		offset:          int64(offset),
-		indexFileOffset: indexFileOffset,
-		size:            size,
-		_id:             parts[0],
-	}, nil
+	return ie, nil
 }
 
 //NewIndexEntry constructs an IndexEntry object from required parameters.
-func NewIndexEntry(offset int64, indexFileOffset int64, size int, _id string) *IndexEntry {
+//`checksum` is the CRC32 of the object, see Checksum
+func NewIndexEntry(offset int64, indexFileOffset int64, size int, _id string, checksum uint32) *IndexEntry {
 	return &IndexEntry{
 		offset:          offset,
 		indexFileOffset: indexFileOffset,
 		size:            size,
 		_id:             _id,
+		checksum:        checksum,
 	}
 }
 
+//Checksum computes the CRC32 stored alongside an object in the index file
+func Checksum(data []byte) uint32 {
+	return crc32.ChecksumIEEE(data)
+}
+
 //SetIndexFileOffset used by function writing to index file, as IndexEntry object is
 //created before the file offset is known
 func (ie *IndexEntry) SetIndexFileOffset(indexFileOffset int64) {
-	log.Printf("Setting indexFileOffset of object with id %s to %d", ie._id, indexFileOffset)
+	logging.Debugf("Setting indexFileOffset of object with id %s to %d", ie._id, indexFileOffset)
 	ie.indexFileOffset = indexFileOffset
 }
 
@@ -143,16 +174,28 @@ func (ie *IndexEntry) GetSize() int {
 	return ie.size
 }
 
-//LoadTable from index file contents
+//NewIndexTable constructs an empty IndexTable
+func NewIndexTable() *IndexTable {
+	return &IndexTable{
+		table: make(map[string]IndexData),
+	}
+}
+
+//LoadTable from index file contents, header included.
+//Files written in format version 1 are also accepted, so they can be migrated.
 func LoadTable(data string) *IndexTable {
 	table := make(map[string]IndexData)
-	for i := 0; i < len(data); i += IndexEntrySize {
-		//Get raw data in the form: 3b0d2e8c691600:2064:48;
-		rawData := data[i : i+IndexEntrySize]
+	version, _ := ParseFileHeader([]byte(data), IndexFileMagic)
+	entrySize := IndexEntrySizeForVersion(version)
+	for i := FileHeaderSize; i+entrySize <= len(data); i += entrySize {
+		rawData := data[i : i+entrySize]
 		//Pass to parser and obtain IndexEntry object
-		ie, err := FromWriteableRepr(rawData, int64(i))
+		ie, err := fromWriteableRepr(rawData, int64(i), version)
 
-		if err != nil {
+		if err == ErrCorruptedIndexEntry {
+			log.Printf("Skipping corrupted index entry at offset %d", i)
+			continue
+		} else if err != nil {
 			//this segment is empty, skip
 			continue
 		}
@@ -164,6 +207,14 @@ func LoadTable(data string) *IndexTable {
 	}
 }
 
+//IndexEntrySizeForVersion returns the size of index entries in files written in format `version`
+func IndexEntrySizeForVersion(version int) int {
+	if version == 1 {
+		return indexEntrySizeV1
+	}
+	return IndexEntrySize
+}
+
 //Insert entry into index table
 func (it *IndexTable) Insert(ie *IndexEntry) {
 	it.table[ie._id] = ie.GetIndexData()
@@ -185,6 +236,20 @@ func (it *IndexTable) Get(_id string) (IndexData, error) {
 	}
 }
 
+//Snapshot returns a copy of the table, which can be iterated while the original keeps changing
+func (it *IndexTable) Snapshot() map[string]IndexData {
+	snapshot := make(map[string]IndexData, len(it.table))
+	for k, v := range it.table {
+		snapshot[k] = v
+	}
+	return snapshot
+}
+
+//Len returns the number of objects in the table
+func (it *IndexTable) Len() int {
+	return len(it.table)
+}
+
 //GetAllIds returns a list containing every single ID present in the DB
 func (it *IndexTable) GetAllIds() []string {
 	keys := make([]string, len(it.table))
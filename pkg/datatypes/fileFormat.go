@@ -0,0 +1,229 @@
+package datatypes
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+//FormatVersion is the version of the on-disk format of index and attribute files written by this build.
+//Version 2 added checksums to index entries.
+//Version 3 added chains for attributes of objects inside arrays (same layout, but chains need rebuilding).
+const FormatVersion = 3
+
+//FileHeaderSize is the size in bytes of the header at the start of index and attribute files:
+//4 bytes of magic number, 2 bytes of format version, the rest is reserved
+const FileHeaderSize = 16
+
+//IndexFileMagic identifies an index file
+var IndexFileMagic = [4]byte{'N', 'S', 'I', 'X'}
+
+//AttributeFileMagic identifies an attribute file
+var AttributeFileMagic = [4]byte{'N', 'S', 'A', 'T'}
+
+//ValueIndexFileMagic identifies a value index file
+var ValueIndexFileMagic = [4]byte{'N', 'S', 'V', 'I'}
+
+//ErrNoHeader is returned when parsing a file which does not start with the expected magic number,
+//meaning it predates the versioned format
+var ErrNoHeader = errors.New("missing file header")
+
+//Kinds of records in the attribute file
+const (
+	attrHeadRecord = 'H'
+	attrNodeRecord = 'N'
+)
+
+//FileHeader returns the header to write at the start of a file identified by `magic`
+func FileHeader(magic [4]byte) []byte {
+	header := make([]byte, FileHeaderSize)
+	copy(header, magic[:])
+	binary.BigEndian.PutUint16(header[4:], FormatVersion)
+	return header
+}
+
+//ParseFileHeader checks `data` starts with the header of a file identified by `magic`,
+//and returns the format version it was written with
+func ParseFileHeader(data []byte, magic [4]byte) (int, error) {
+	if len(data) < FileHeaderSize || string(data[:4]) != string(magic[:]) {
+		return 0, ErrNoHeader
+	}
+	return int(binary.BigEndian.Uint16(data[4:])), nil
+}
+
+//AttributeRecord is a single item of an attribute chain (singly linked list) in the attribute file.
+//The head of a chain carries the attribute name; every following item only carries an ID.
+//
+//On disk, a head is laid out as 'H' | name length (uint16) | name | ID | next
+//and any other item as 'N' | ID | next, where next is the 64-bit offset of the following item (0 if none).
+type AttributeRecord struct {
+	Key  string
+	ID   string
+	Next int64
+}
+
+//IsHead returns true if the record is the head of its chain
+func (ar *AttributeRecord) IsHead() bool {
+	return ar.Key != ""
+}
+
+//Size returns the number of bytes the record occupies in the attribute file
+func (ar *AttributeRecord) Size() int {
+	return ar.NextPointerOffset() + OffsetSize
+}
+
+//NextPointerOffset returns the position of the `next` pointer, relative to the start of the record
+func (ar *AttributeRecord) NextPointerOffset() int {
+	if ar.IsHead() {
+		return 1 + 2 + len(ar.Key) + IDLength
+	}
+	return 1 + IDLength
+}
+
+//WriteableRepr is the representation of the record as found in the attribute file
+func (ar *AttributeRecord) WriteableRepr() []byte {
+	data := make([]byte, ar.Size())
+	if ar.IsHead() {
+		data[0] = attrHeadRecord
+		binary.BigEndian.PutUint16(data[1:], uint16(len(ar.Key)))
+		copy(data[3:], ar.Key)
+	} else {
+		data[0] = attrNodeRecord
+	}
+	pointerOffset := ar.NextPointerOffset()
+	copy(data[pointerOffset-IDLength:pointerOffset], ar.ID)
+	binary.BigEndian.PutUint64(data[pointerOffset:], uint64(ar.Next))
+	return data
+}
+
+//ReadAttributeRecord reads a single record from `r`, consuming exactly its bytes
+func ReadAttributeRecord(r io.Reader) (*AttributeRecord, error) {
+	kind := make([]byte, 1)
+	if _, err := io.ReadFull(r, kind); err != nil {
+		return nil, err
+	}
+
+	record := &AttributeRecord{}
+	switch kind[0] {
+	case attrHeadRecord:
+		keyLen := make([]byte, 2)
+		if _, err := io.ReadFull(r, keyLen); err != nil {
+			return nil, err
+		}
+		key := make([]byte, binary.BigEndian.Uint16(keyLen))
+		if _, err := io.ReadFull(r, key); err != nil {
+			return nil, err
+		}
+		record.Key = string(key)
+	case attrNodeRecord:
+	default:
+		return nil, fmt.Errorf("invalid attribute record kind %q", kind[0])
+	}
+
+	rest := make([]byte, IDLength+OffsetSize)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, err
+	}
+	record.ID = string(rest[:IDLength])
+	record.Next = int64(binary.BigEndian.Uint64(rest[IDLength:]))
+	return record, nil
+}
+
+//Kinds of records in the value index file
+const (
+	valueIndexSetRecord    = 'S'
+	valueIndexDeleteRecord = 'D'
+)
+
+//ErrCorruptedValueIndexRecord is returned when reading a value index record whose checksum does not match its contents
+var ErrCorruptedValueIndexRecord = errors.New("Corrupted value index record")
+
+//ValueIndexRecord sets the keys of an object in a value index, or removes the object from it (Deleted).
+//The value index file is a log of these records; the last one for an object is the one in effect.
+//
+//On disk, a record is laid out as 'S' | index number (uint32) | ID | key count (uint16) | (key length (uint16) | key)...
+//or 'D' | index number | ID for deletions, followed by the CRC32 of the preceding bytes.
+type ValueIndexRecord struct {
+	Index   uint32
+	ID      string
+	Keys    []string
+	Deleted bool
+}
+
+//WriteableRepr is the representation of the record as found in the value index file
+func (vr *ValueIndexRecord) WriteableRepr() []byte {
+	var buf bytes.Buffer
+	if vr.Deleted {
+		buf.WriteByte(valueIndexDeleteRecord)
+	} else {
+		buf.WriteByte(valueIndexSetRecord)
+	}
+	binary.Write(&buf, binary.BigEndian, vr.Index)
+	buf.WriteString(vr.ID)
+	if !vr.Deleted {
+		binary.Write(&buf, binary.BigEndian, uint16(len(vr.Keys)))
+		for _, key := range vr.Keys {
+			binary.Write(&buf, binary.BigEndian, uint16(len(key)))
+			buf.WriteString(key)
+		}
+	}
+	binary.Write(&buf, binary.BigEndian, crc32.ChecksumIEEE(buf.Bytes()))
+	return buf.Bytes()
+}
+
+//ReadValueIndexRecord reads a single record from `r`, consuming exactly its bytes
+func ReadValueIndexRecord(r io.Reader) (*ValueIndexRecord, error) {
+	//Every byte read is kept to check the checksum at the end
+	var data []byte
+	read := func(n int) ([]byte, error) {
+		chunk := make([]byte, n)
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return nil, err
+		}
+		data = append(data, chunk...)
+		return chunk, nil
+	}
+
+	head, err := read(1 + 4 + IDLength)
+	if err != nil {
+		return nil, err
+	}
+	record := &ValueIndexRecord{
+		Index: binary.BigEndian.Uint32(head[1:]),
+		ID:    string(head[5:]),
+	}
+	switch head[0] {
+	case valueIndexSetRecord:
+		count, err := read(2)
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i < int(binary.BigEndian.Uint16(count)); i++ {
+			keyLen, err := read(2)
+			if err != nil {
+				return nil, err
+			}
+			key, err := read(int(binary.BigEndian.Uint16(keyLen)))
+			if err != nil {
+				return nil, err
+			}
+			record.Keys = append(record.Keys, string(key))
+		}
+	case valueIndexDeleteRecord:
+		record.Deleted = true
+	default:
+		return nil, fmt.Errorf("invalid value index record kind %q", head[0])
+	}
+
+	checksum := make([]byte, ChecksumSize)
+	if _, err := io.ReadFull(r, checksum); err != nil {
+		return nil, err
+	}
+	if binary.BigEndian.Uint32(checksum) != crc32.ChecksumIEEE(data) {
+		return nil, ErrCorruptedValueIndexRecord
+	}
+	return record, nil
+}
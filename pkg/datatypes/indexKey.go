@@ -0,0 +1,124 @@
+package datatypes
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"strings"
+)
+
+//Type tags starting every encoded index key, so values of different types never compare equal
+//and all values of a type are stored next to each other
+const (
+	keyTypeNull   = 0x10
+	keyTypeNumber = 0x20
+	keyTypeString = 0x30
+	keyTypeObject = 0x40
+	keyTypeArray  = 0x50
+	keyTypeBool   = 0x60
+)
+
+//EncodeIndexKey encodes a decoded JSON value into a value index key.
+//Keys of numbers, strings and booleans sort (as raw bytes) in the same order as the values themselves,
+//and keys can be concatenated into compound keys which still sort field by field.
+//Objects and arrays are encoded through their JSON representation, which only makes sense for equality.
+func EncodeIndexKey(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return string([]byte{keyTypeNull})
+	case float64:
+		bits := math.Float64bits(v)
+		if v == 0 {
+			//-0 and 0 are equal
+			bits = 0
+		}
+		//Flip the sign bit of positive numbers and every bit of negative ones, so larger numbers have larger bytes
+		if bits>>63 == 1 {
+			bits = ^bits
+		} else {
+			bits |= 1 << 63
+		}
+		key := make([]byte, 9)
+		key[0] = keyTypeNumber
+		binary.BigEndian.PutUint64(key[1:], bits)
+		return string(key)
+	case string:
+		return string([]byte{keyTypeString}) + escapeKeyString(v)
+	case bool:
+		if v {
+			return string([]byte{keyTypeBool, 1})
+		}
+		return string([]byte{keyTypeBool, 0})
+	case []interface{}:
+		data, _ := json.Marshal(v)
+		return string([]byte{keyTypeArray}) + escapeKeyString(string(data))
+	}
+	data, _ := json.Marshal(value)
+	return string([]byte{keyTypeObject}) + escapeKeyString(string(data))
+}
+
+//IndexKeyTypeBounds returns the range of keys holding values of the same type as `value`:
+//every such key is at least `from` and less than `to`
+func IndexKeyTypeBounds(value interface{}) (string, string) {
+	tag := EncodeIndexKey(value)[0]
+	return string([]byte{tag}), string([]byte{tag + 1})
+}
+
+//DecodeIndexKey decodes a (possibly compound) key built by EncodeIndexKey back into the values it is made of
+func DecodeIndexKey(key string) []interface{} {
+	var values []interface{}
+	for len(key) > 0 {
+		tag := key[0]
+		key = key[1:]
+		switch tag {
+		case keyTypeNull:
+			values = append(values, nil)
+		case keyTypeNumber:
+			bits := binary.BigEndian.Uint64([]byte(key[:8]))
+			if bits>>63 == 1 {
+				bits &^= 1 << 63
+			} else {
+				bits = ^bits
+			}
+			values = append(values, math.Float64frombits(bits))
+			key = key[8:]
+		case keyTypeBool:
+			values = append(values, key[0] == 1)
+			key = key[1:]
+		default:
+			var s string
+			s, key = unescapeKeyString(key)
+			if tag == keyTypeString {
+				values = append(values, s)
+				continue
+			}
+			var value interface{}
+			json.Unmarshal([]byte(s), &value)
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+//escapeKeyString makes a string safe to concatenate with other keys: null bytes are escaped as 0x00 0xFF,
+//and the string is terminated by 0x00 0x01, which sorts before any escaped or regular byte
+func escapeKeyString(s string) string {
+	return strings.ReplaceAll(s, "\x00", "\x00\xff") + "\x00\x01"
+}
+
+//unescapeKeyString reverses escapeKeyString on the start of `key`, returning the rest of the key along with it
+func unescapeKeyString(key string) (string, string) {
+	var b strings.Builder
+	for i := 0; i < len(key); i++ {
+		if key[i] != 0 {
+			b.WriteByte(key[i])
+			continue
+		}
+		if i+1 < len(key) && key[i+1] == 0x01 {
+			return b.String(), key[i+2:]
+		}
+		b.WriteByte(0)
+		i++
+	}
+	return b.String(), ""
+}
@@ -0,0 +1,39 @@
+package datatypes
+
+import (
+	"log"
+	"strconv"
+	"strings"
+)
+
+//LegacyIndexEntrySize is the size in bytes of a single entry in an index file predating the versioned format.
+//Entries were laid out as text, `{id}:{offset}:{size}` padded with null bytes and terminated by ';'.
+const LegacyIndexEntrySize = IDLength + 20
+
+//LoadLegacyTable builds an IndexTable from the contents of an index file predating the versioned format.
+//Only used to migrate existing collections; index file offsets are meaningless in the new format.
+func LoadLegacyTable(data string) *IndexTable {
+	table := make(map[string]IndexData)
+	for i := 0; i+LegacyIndexEntrySize <= len(data); i += LegacyIndexEntrySize {
+		//Get raw data in the form: 3b0d2e8c691600:2064:48;
+		parts := strings.Split(data[i:i+LegacyIndexEntrySize], ":")
+		//If the current segment is empty (previously deleted index entry)
+		if len(parts) != 3 {
+			continue
+		}
+		offset, offsetErr := strconv.Atoi(parts[1])
+		//Trailing zeroes (used for padding) need to be removed
+		size, sizeErr := strconv.Atoi(strings.Trim(strings.TrimSuffix(parts[2], ";"), "\x00"))
+		if offsetErr != nil || sizeErr != nil {
+			log.Printf("Skipping unreadable legacy index entry at offset %d", i)
+			continue
+		}
+		table[parts[0]] = IndexData{
+			Offset: int64(offset),
+			Size:   size,
+		}
+	}
+	return &IndexTable{
+		table: table,
+	}
+}
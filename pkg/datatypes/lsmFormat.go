@@ -0,0 +1,153 @@
+package datatypes
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+//LSMManifestExtension is the file extension of the manifest of an LSM collection, listing its segment files
+const LSMManifestExtension = ".lsm"
+
+//LSMLogExtension is the file extension of the log holding the memtable of an LSM collection
+const LSMLogExtension = ".memlog"
+
+//LSMSegmentExtension is the file extension of the sorted segment files of an LSM collection
+const LSMSegmentExtension = ".seg"
+
+//LSMSegmentMagic identifies a segment file
+var LSMSegmentMagic = [4]byte{'N', 'S', 'L', 'S'}
+
+//LSMLogMagic identifies a memtable log
+var LSMLogMagic = [4]byte{'N', 'S', 'L', 'L'}
+
+//Kinds of LSM records
+const (
+	lsmPutRecord       = 'P'
+	lsmTombstoneRecord = 'T'
+)
+
+//ErrCorruptedLSMRecord is returned when reading an LSM record whose checksum does not match its contents
+var ErrCorruptedLSMRecord = errors.New("Corrupted LSM record")
+
+//LSMRecord sets the value of a key (an object's id), or deletes it (Deleted), in an LSM collection.
+//Both the memtable log and segment files are made of these records.
+//
+//On disk, a record is laid out as 'P' | key length (uint16) | key | value length (uint32) | value
+//or 'T' | key length | key for deletions, followed by the CRC32 of the preceding bytes.
+type LSMRecord struct {
+	Key     string
+	Value   []byte
+	Deleted bool
+}
+
+//WriteableRepr is the representation of the record as found in LSM files
+func (lr *LSMRecord) WriteableRepr() []byte {
+	var buf bytes.Buffer
+	if lr.Deleted {
+		buf.WriteByte(lsmTombstoneRecord)
+	} else {
+		buf.WriteByte(lsmPutRecord)
+	}
+	binary.Write(&buf, binary.BigEndian, uint16(len(lr.Key)))
+	buf.WriteString(lr.Key)
+	if !lr.Deleted {
+		binary.Write(&buf, binary.BigEndian, uint32(len(lr.Value)))
+		buf.Write(lr.Value)
+	}
+	binary.Write(&buf, binary.BigEndian, crc32.ChecksumIEEE(buf.Bytes()))
+	return buf.Bytes()
+}
+
+//ReadLSMRecord reads a single record from `r`, consuming exactly its bytes
+func ReadLSMRecord(r io.Reader) (*LSMRecord, error) {
+	//Every byte read is kept to check the checksum at the end
+	var data []byte
+	read := func(n int) ([]byte, error) {
+		chunk := make([]byte, n)
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return nil, err
+		}
+		data = append(data, chunk...)
+		return chunk, nil
+	}
+
+	head, err := read(1 + 2)
+	if err != nil {
+		return nil, err
+	}
+	key, err := read(int(binary.BigEndian.Uint16(head[1:])))
+	if err != nil {
+		return nil, err
+	}
+	record := &LSMRecord{Key: string(key)}
+	switch head[0] {
+	case lsmPutRecord:
+		valueLen, err := read(4)
+		if err != nil {
+			return nil, err
+		}
+		if record.Value, err = read(int(binary.BigEndian.Uint32(valueLen))); err != nil {
+			return nil, err
+		}
+	case lsmTombstoneRecord:
+		record.Deleted = true
+	default:
+		return nil, fmt.Errorf("invalid LSM record kind %q", head[0])
+	}
+
+	checksum := make([]byte, ChecksumSize)
+	if _, err := io.ReadFull(r, checksum); err != nil {
+		return nil, err
+	}
+	if binary.BigEndian.Uint32(checksum) != crc32.ChecksumIEEE(data) {
+		return nil, ErrCorruptedLSMRecord
+	}
+	return record, nil
+}
+
+//LSMFooterSize is the size in bytes of the footer ending every segment file
+const LSMFooterSize = 32
+
+//ErrCorruptedLSMFooter is returned when the footer of a segment file, or the blocks it points to, are damaged
+var ErrCorruptedLSMFooter = errors.New("Corrupted segment footer")
+
+//LSMFooter ends a segment file. A segment file is laid out as
+//header | records, sorted by key | sparse index | bloom filter | footer
+//where the sparse index holds the key and offset of every few records: count (uint32), then
+//(key length (uint16) | key | offset (uint64))..., and the bloom filter holds every key of the segment.
+//
+//On disk, the footer is laid out as index offset (uint64) | bloom filter offset (uint64) | record count (uint64)
+//| CRC32 of the index and bloom filter | 4 reserved bytes.
+type LSMFooter struct {
+	IndexOffset int64
+	BloomOffset int64
+	Records     int64
+	Checksum    uint32
+}
+
+//WriteableRepr is the representation of the footer as found in segment files
+func (lf *LSMFooter) WriteableRepr() []byte {
+	data := make([]byte, LSMFooterSize)
+	binary.BigEndian.PutUint64(data[0:], uint64(lf.IndexOffset))
+	binary.BigEndian.PutUint64(data[8:], uint64(lf.BloomOffset))
+	binary.BigEndian.PutUint64(data[16:], uint64(lf.Records))
+	binary.BigEndian.PutUint32(data[24:], lf.Checksum)
+	return data
+}
+
+//ParseLSMFooter is the inverse of WriteableRepr
+func ParseLSMFooter(data []byte) (*LSMFooter, error) {
+	if len(data) != LSMFooterSize {
+		return nil, ErrCorruptedLSMFooter
+	}
+	return &LSMFooter{
+		IndexOffset: int64(binary.BigEndian.Uint64(data[0:])),
+		BloomOffset: int64(binary.BigEndian.Uint64(data[8:])),
+		Records:     int64(binary.BigEndian.Uint64(data[16:])),
+		Checksum:    binary.BigEndian.Uint32(data[24:]),
+	}, nil
+}
@@ -1,104 +1,188 @@
 package db
 
 import (
+	"fmt"
+	"io/ioutil"
 	"log"
+	"nosql-db/pkg/datatypes"
+	"nosql-db/pkg/logging"
 	"nosql-db/pkg/util"
 	"os"
 	"strings"
 )
 
+//Fsync policies, see Options
+const (
+	//FsyncAlways syncs every write to disk before acknowledging it
+	FsyncAlways = "always"
+	//FsyncNever leaves flushing writes to the operating system: faster, but a crash may lose the latest writes
+	FsyncNever = "never"
+)
+
+//Options sets where and how collections are stored
+type Options struct {
+	//DataDir is the folder holding the collections, one sub-folder each
+	DataDir string
+	//Fsync is when writes are synced to disk, FsyncAlways or FsyncNever
+	Fsync string
+}
+
+//DefaultOptions stores collections in the nosqldbData folder of the user's home, syncing every write
+func DefaultOptions() Options {
+	path, err := os.UserHomeDir()
+	if err != nil {
+		log.Fatal(err)
+	}
+	return Options{
+		DataDir: path + string(os.PathSeparator) + "nosqldbData",
+		Fsync:   FsyncAlways,
+	}
+}
+
 //CollectionEntry represents the textual info surrounding a collection
 type CollectionEntry struct {
-	name string
-	path string
+	name    string
+	path    string
+	options Options
 }
 
 //Collection represents a single database. This software can support multiple databases,
-//or `Collections`
+//or `Collections`. Each is stored by its own engine, files (*Access) unless created otherwise.
 type Collection struct {
 	entry CollectionEntry
-	Db    *Access
+	Db    StorageEngine
 }
 
-//InitCollections creates the collections folder if it does not exist yet
-func InitCollections() {
-	homePath := GetCollectionsHomePath()
-	log.Printf("Checking at %s...", homePath)
+//InitCollections creates the data directory of `options` if it does not exist yet
+func InitCollections(options Options) {
+	homePath := options.DataDir
+	logging.Debugf("Checking at %s...", homePath)
 	if !util.FolderExists(homePath) {
-		os.Mkdir(homePath, 0755)
-		log.Printf("Created new directory at %s", homePath)
+		os.MkdirAll(homePath, 0755)
+		logging.Infof("Created new directory at %s", homePath)
 	} else {
-		log.Println("Already exists.")
+		logging.Debugf("Already exists.")
 	}
 }
 
-//ListCollections returns a slice of collection entries
-func ListCollections() []CollectionEntry {
-	collectionsHomePath := GetCollectionsHomePath()
-	f, err := os.Open(collectionsHomePath)
+//ListCollections returns a slice of the entries of the collections in the data directory of `options`
+func ListCollections(options Options) []CollectionEntry {
+	entries, err := listCollections(options)
 	if err != nil {
 		log.Fatal(err)
 	}
-	dirnames, err := f.Readdirnames(0)
-	entries := make([]CollectionEntry, len(dirnames))
+	return entries
+}
+
+func listCollections(options Options) ([]CollectionEntry, error) {
+	collectionsHomePath := options.DataDir
+	files, err := ioutil.ReadDir(collectionsHomePath)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	for i, dirname := range dirnames {
-		parts := strings.Split(dirname, string(os.PathSeparator))
-		collectionName := parts[len(parts)-1]
-		entries[i] = CollectionEntry{
-			name: collectionName,
-			path: collectionsHomePath + string(os.PathSeparator) + dirname,
+	var entries []CollectionEntry
+	for _, file := range files {
+		//Only folders hold collections
+		if !file.IsDir() {
+			continue
 		}
-		log.Printf("Found collection %s at %s", entries[i].name, entries[i].path)
+		entry := CollectionEntry{
+			name:    file.Name(),
+			path:    collectionsHomePath + string(os.PathSeparator) + file.Name(),
+			options: options,
+		}
+		logging.Infof("Found collection %s at %s", entry.name, entry.path)
+		entries = append(entries, entry)
 	}
-	return entries
+	return entries, nil
 }
 
-//GetCollectionsHomePath returns the absolute path to the root directory of
-//collections.
-func GetCollectionsHomePath() string {
-	path, err := os.UserHomeDir()
+//CreateCollection if it doesn't already exist, in the data directory of `options`.
+//Returns the collecion if it was created, nil otherwise. Exits if its files cannot be created,
+//see CreateCollectionWithEngine for a version returning errors.
+func CreateCollection(name string, options Options) *Collection {
+	collection, err := CreateCollectionWithEngine(name, EngineFile, options)
 	if err != nil {
 		log.Fatal(err)
 	}
-	return path + string(os.PathSeparator) + "nosqldbData"
+	return collection
 }
 
-//CreateCollection if it doesn't already exist.
-//Returns the collecion if it was created, nil otherwise
-func CreateCollection(name string) *Collection {
-	homePath := GetCollectionsHomePath()
-	collectionPath := homePath + string(os.PathSeparator) + name
-	if !util.FolderExists(collectionPath) {
-		os.Mkdir(collectionPath, 0755)
-		log.Printf("Created collection at %s", collectionPath)
-		collectionEntry := CollectionEntry{
-			name: name,
-			path: collectionPath,
+//CreateCollectionWithEngine creates a collection stored by `engine` (EngineFile, EngineMemory or EngineLSM).
+//Memory collections have no files: they are not listed by ListCollections, nor loaded back by LoadCollections.
+//Returns nil if a collection with files by that name already exists.
+func CreateCollectionWithEngine(name, engine string, options Options) (*Collection, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return nil, newError(ErrInvalidDocument, "invalid collection name '%s'", name)
+	}
+	switch engine {
+	case EngineFile, "", EngineLSM:
+	case EngineMemory:
+		return &Collection{
+			entry: CollectionEntry{name: name},
+			Db:    NewMemoryEngine(),
+		}, nil
+	default:
+		return nil, newError(ErrInvalidDocument, "unknown storage engine '%s'", engine)
+	}
+
+	collectionPath := options.DataDir + string(os.PathSeparator) + name
+	if util.FolderExists(collectionPath) {
+		logging.Infof("Collection %s already exists", name)
+		return nil, nil
+	}
+	if err := os.Mkdir(collectionPath, 0755); err != nil {
+		return nil, err
+	}
+	logging.Infof("Created collection at %s", collectionPath)
+	entry := CollectionEntry{name: name, path: collectionPath, options: options}
+	var collection *Collection
+	var err error
+	if engine == EngineLSM {
+		var lsm *LSMEngine
+		if lsm, err = OpenLSMEngine(entry.filesPath(), entry.lsmOptions()); err == nil {
+			collection = &Collection{entry: entry, Db: lsm}
 		}
-		return NewCollection(collectionEntry)
+	} else {
+		collection, err = NewCollection(entry)
 	}
-	log.Printf("Collection %s already exists", name)
-	return nil
+	if err != nil {
+		os.RemoveAll(collectionPath)
+		return nil, err
+	}
+	return collection, nil
 }
 
-//NewCollection creates a collection instance from a collection entry instance
-func NewCollection(collectionEntry CollectionEntry) *Collection {
-	access := NewAccess(collectionEntry)
+//NewCollection creates a collection instance from a collection entry instance.
+//Collections with an LSM manifest are opened with an LSMEngine, any other with files (Access).
+func NewCollection(collectionEntry CollectionEntry) (*Collection, error) {
+	var engine StorageEngine
+	var err error
+	if util.FileExists(collectionEntry.filesPath() + datatypes.LSMManifestExtension) {
+		engine, err = OpenLSMEngine(collectionEntry.filesPath(), collectionEntry.lsmOptions())
+	} else {
+		engine, err = NewAccess(collectionEntry)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot open collection %s: %v", collectionEntry.name, err)
+	}
 	return &Collection{
 		entry: collectionEntry,
-		Db:    access,
-	}
+		Db:    engine,
+	}, nil
 }
 
 //LoadCollections returns a mapping from
-//collection name to Collection object
-func LoadCollections() map[string]Collection {
+//collection name to Collection object, for the collections in the data directory of `options`
+//Exits if a collection cannot be opened, see Open for a version returning errors.
+func LoadCollections(options Options) map[string]Collection {
 	collectionMap := make(map[string]Collection)
-	for _, collectionEntry := range ListCollections() {
-		collectionMap[collectionEntry.name] = *NewCollection(collectionEntry)
+	for _, collectionEntry := range ListCollections(options) {
+		collection, err := NewCollection(collectionEntry)
+		if err != nil {
+			log.Fatal(err)
+		}
+		collectionMap[collectionEntry.name] = *collection
 	}
 	return collectionMap
 }
@@ -107,3 +191,18 @@ func LoadCollections() map[string]Collection {
 func (e CollectionEntry) GetName() string {
 	return e.name
 }
+
+//GetName returns the name of the collection
+func (c Collection) GetName() string {
+	return c.entry.name
+}
+
+//filesPath returns the path shared by the collection's files, minus their extension
+func (e CollectionEntry) filesPath() string {
+	return e.path + string(os.PathSeparator) + e.name
+}
+
+//lsmOptions returns the options of the LSMEngine of the collection
+func (e CollectionEntry) lsmOptions() LSMOptions {
+	return LSMOptions{NoSync: e.options.Fsync == FsyncNever}
+}
@@ -0,0 +1,254 @@
+package db
+
+import (
+	"log"
+	"nosql-db/pkg/datatypes"
+	"nosql-db/pkg/logging"
+	"nosql-db/pkg/util"
+	"os"
+)
+
+//compactSuffix is appended to the files being built by a compaction, until they are swapped in
+const compactSuffix = ".compact"
+
+//compactMarkerExtension is the extension of the marker file written once the compacted files are complete.
+//Its presence on startup means the swap was interrupted and must be finished.
+const compactMarkerExtension = ".compacted"
+
+//compactionThreshold is the fraction of dead bytes in the db file above which CompactIfNeeded compacts
+const compactionThreshold = 0.5
+
+//compactedExtensions lists the files rewritten by a compaction. The WAL is left untouched.
+var compactedExtensions = []string{
+	datatypes.DBFileExtension,
+	datatypes.IndexFileExtension,
+	datatypes.AttributeFileExtension,
+	datatypes.ValueIndexFileExtension,
+}
+
+//CompactionStats describes the outcome of a compaction
+type CompactionStats struct {
+	Documents  int   `json:"documents"`
+	SizeBefore int64 `json:"sizeBefore"`
+	SizeAfter  int64 `json:"sizeAfter"`
+}
+
+//Compact rewrites the live documents of the collection into fresh files, rebuilding the index,
+//attribute chains and value indexes along the way, then swaps the fresh files in. Deleted records, stale copies left behind
+//by updates, and stale IDs in attribute chains are all dropped.
+//
+//Documents are copied one at a time under the read lock, so reads and writes carry on during the copy.
+//The write lock is only held at the end, to catch up with writes made during the copy and swap the files.
+func (db *Access) Compact() (stats CompactionStats, err error) {
+	if err := db.failed(); err != nil {
+		return CompactionStats{}, err
+	}
+	defer db.recoverFailure(&err)
+	db.compactionLock.Lock()
+	defer db.compactionLock.Unlock()
+	//Closed while waiting for the compaction lock
+	if err := db.failed(); err != nil {
+		return CompactionStats{}, err
+	}
+
+	base := db.entry.filesPath()
+	fresh := newCompactionTarget(base)
+
+	var snapshot map[string]datatypes.IndexData
+	var sizeBefore int64
+	db.readLocked(func() {
+		snapshot = db.indexTable.Snapshot()
+		sizeBefore = db.filesSize()
+	})
+
+	logging.Infof("Compacting %s (%d documents)", db.entry.name, len(snapshot))
+
+	//copied maps each _id to the version of the object which was copied over
+	copied := make(map[string]datatypes.IndexData, len(snapshot))
+	for _id := range snapshot {
+		var indexData datatypes.IndexData
+		var data string
+		var err error
+		db.readLocked(func() {
+			if indexData, err = db.indexTable.Get(_id); err == nil {
+				data, err = db.readDbData(&indexData)
+			}
+		})
+		if err != nil {
+			//Deleted since the snapshot was taken, or unreadable, in which case there is nothing to salvage
+			continue
+		}
+		fresh.applyWrite(_id, []byte(data))
+		copied[_id] = indexData
+	}
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	//Catch up with writes made while copying: anything new or updated is copied again, anything gone is deleted
+	for _, _id := range db.indexTable.GetAllIds() {
+		indexData, _ := db.indexTable.Get(_id)
+		if copiedData, ok := copied[_id]; !ok || copiedData != indexData {
+			if data, err := db.readDbData(&indexData); err == nil {
+				fresh.applyWrite(_id, []byte(data))
+			} else {
+				log.Printf("Dropping unreadable object %s: %v", _id, err)
+				fresh.applyDelete([]string{_id})
+			}
+		}
+		delete(copied, _id)
+	}
+	for _id := range copied {
+		fresh.applyDelete([]string{_id})
+	}
+
+	stats = CompactionStats{
+		Documents:  fresh.indexTable.Len(),
+		SizeBefore: sizeBefore,
+		SizeAfter:  fresh.filesSize(),
+	}
+
+	fresh.fileHandles.close()
+	db.fileHandles.close()
+	swapCompactedFiles(base)
+
+	db.fileHandles = NewFileHandles(db.entry)
+	db.wal = NewWAL(db.fileHandles.walFile, db.syncWrites)
+	db.indexTable = fresh.indexTable
+	db.valueIndexes = fresh.valueIndexes
+	db.attributes = fresh.attributes
+
+	logging.Infof("Compacted %s: %d bytes -> %d bytes", db.entry.name, stats.SizeBefore, stats.SizeAfter)
+	return stats, nil
+}
+
+//CompactIfNeeded compacts the collection if enough of its db file is taken up by dead records.
+//Returns whether a compaction was run.
+func (db *Access) CompactIfNeeded() (compacted bool, err error) {
+	if err := db.failed(); err != nil {
+		return false, err
+	}
+	defer db.recoverFailure(&err)
+	liveSize, totalSize := 0, 0
+	db.readLocked(func() {
+		for _, indexData := range db.indexTable.Snapshot() {
+			liveSize += indexData.Size
+		}
+		totalSize = getFileSize(db.fileHandles.dbFile)
+	})
+
+	if totalSize == 0 || float64(totalSize-liveSize)/float64(totalSize) < compactionThreshold {
+		return false, nil
+	}
+	_, err = db.Compact()
+	return err == nil, err
+}
+
+//filesSize returns the combined size of the db, index and attribute files
+func (db *Access) filesSize() int64 {
+	return int64(getFileSize(db.fileHandles.dbFile) +
+		getFileSize(db.fileHandles.indexFile) +
+		getFileSize(db.fileHandles.attributesFile))
+}
+
+//newCompactionTarget returns an Access over fresh, empty compaction files, with the collection's value indexes (empty).
+//Files are synced once, when swapping them in, rather than after every write.
+func newCompactionTarget(base string) *Access {
+	handles := make([]*os.File, len(compactedExtensions))
+	for i, extension := range compactedExtensions {
+		file, err := os.OpenFile(base+extension+compactSuffix, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0755)
+		if err != nil {
+			fail(err)
+		}
+		if magic, ok := formattedFiles[extension]; ok {
+			writeFileHeader(file, magic)
+		}
+		handles[i] = file
+	}
+	return &Access{
+		state: "compacting",
+		fileHandles: &FileHandles{
+			dbFile:         handles[0],
+			indexFile:      handles[1],
+			attributesFile: handles[2],
+			valueIndexFile: handles[3],
+		},
+		indexTable:   datatypes.NewIndexTable(),
+		idGen:        NewIDGen(),
+		valueIndexes: loadIndexDefinitions(base),
+		attributes:   datatypes.NewAttributeDirectory(),
+		syncWrites:   false,
+	}
+}
+
+//swapCompactedFiles moves fully written compaction files over the live ones.
+//The marker file makes the set of renames all-or-nothing across crashes, see finishCompaction.
+func swapCompactedFiles(base string) {
+	for _, extension := range compactedExtensions {
+		syncPath(base + extension + compactSuffix)
+	}
+	marker, err := os.Create(base + compactMarkerExtension)
+	if err != nil {
+		fail(err)
+	}
+	marker.Sync()
+	marker.Close()
+
+	finishCompaction(base)
+}
+
+//finishCompaction completes an interrupted compaction if its files were fully written (marker present),
+//and otherwise discards whatever it left behind
+func finishCompaction(base string) {
+	markerPath := base + compactMarkerExtension
+	complete := util.FileExists(markerPath)
+	for _, extension := range compactedExtensions {
+		compacted := base + extension + compactSuffix
+		if !util.FileExists(compacted) {
+			continue
+		}
+		if complete {
+			if err := os.Rename(compacted, base+extension); err != nil {
+				fail(err)
+			}
+		} else {
+			log.Printf("Discarding incomplete compaction file %s", compacted)
+			os.Remove(compacted)
+		}
+	}
+	if complete {
+		os.Remove(markerPath)
+	}
+}
+
+func syncPath(path string) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0755)
+	if err != nil {
+		fail(err)
+	}
+	file.Sync()
+	file.Close()
+}
+
+//sync every file handle, returning the first error
+func (fh *FileHandles) sync() error {
+	var err error
+	for _, file := range []*os.File{fh.dbFile, fh.indexFile, fh.attributesFile, fh.valueIndexFile, fh.walFile} {
+		if file == nil {
+			continue
+		}
+		if syncErr := file.Sync(); err == nil {
+			err = syncErr
+		}
+	}
+	return err
+}
+
+//close every file handle
+func (fh *FileHandles) close() {
+	for _, file := range []*os.File{fh.dbFile, fh.indexFile, fh.attributesFile, fh.valueIndexFile, fh.walFile} {
+		if file != nil {
+			file.Close()
+		}
+	}
+}
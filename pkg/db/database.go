@@ -0,0 +1,152 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"nosql-db/pkg/logging"
+	"os"
+	"sort"
+	"sync"
+)
+
+//ErrDatabaseClosed is returned by a DB used after being closed
+var ErrDatabaseClosed = errors.New("database is closed")
+
+//ErrCollectionExists is returned when creating a collection under a name already taken, it is an ErrConflict
+var ErrCollectionExists error = &Error{Kind: ErrConflict, Message: "collection already exists"}
+
+//DB is a set of collections stored in a data directory, for embedding the database in a Go program.
+//Open it, go through its collections with Collection, and Close it when done.
+//Every method returns errors rather than exiting, and is safe for concurrent use.
+type DB struct {
+	options     Options
+	lock        sync.RWMutex
+	collections map[string]Collection
+	closed      bool
+}
+
+//Open the collections stored in `dir`, creating it if it does not exist yet.
+//The data directory of `options` is ignored.
+func Open(dir string, options Options) (*DB, error) {
+	options.DataDir = dir
+	if options.Fsync == "" {
+		options.Fsync = FsyncAlways
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	entries, err := listCollections(options)
+	if err != nil {
+		return nil, err
+	}
+
+	database := &DB{
+		options:     options,
+		collections: make(map[string]Collection),
+	}
+	for _, entry := range entries {
+		collection, err := NewCollection(entry)
+		if err != nil {
+			database.Close()
+			return nil, err
+		}
+		database.collections[entry.name] = *collection
+	}
+	return database, nil
+}
+
+//Options returns the options the collections are stored with
+func (d *DB) Options() Options {
+	return d.options
+}
+
+//CollectionNames returns the names of the collections, sorted
+func (d *DB) CollectionNames() []string {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	names := make([]string, 0, len(d.collections))
+	for name := range d.collections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+//Collection returns the collection named `name`
+func (d *DB) Collection(name string) (Collection, error) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	if d.closed {
+		return Collection{}, ErrDatabaseClosed
+	}
+	collection, found := d.collections[name]
+	if !found {
+		return Collection{}, newError(ErrCollectionMissing, "no collection named '%s'", name)
+	}
+	return collection, nil
+}
+
+//CreateCollection creates a collection named `name` stored with `engine` (see EngineFile), failing if it already exists
+func (d *DB) CreateCollection(name, engine string) (Collection, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.closed {
+		return Collection{}, ErrDatabaseClosed
+	}
+	if _, found := d.collections[name]; found {
+		return Collection{}, fmt.Errorf("%w: %s", ErrCollectionExists, name)
+	}
+	collection, err := CreateCollectionWithEngine(name, engine, d.options)
+	if err != nil {
+		return Collection{}, err
+	}
+	if collection == nil {
+		//Its folder was created behind the database's back
+		return Collection{}, fmt.Errorf("%w: %s", ErrCollectionExists, name)
+	}
+	d.collections[name] = *collection
+	return *collection, nil
+}
+
+//DropCollection closes the collection named `name`, then deletes its files.
+//Operations still running on it meanwhile fail with ErrClosed.
+func (d *DB) DropCollection(name string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.closed {
+		return ErrDatabaseClosed
+	}
+	collection, found := d.collections[name]
+	if !found {
+		return newError(ErrCollectionMissing, "no collection named '%s'", name)
+	}
+	delete(d.collections, name)
+	if err := collection.Db.Close(); err != nil {
+		log.Printf("Closing collection %s before dropping it failed: %v", name, err)
+	}
+	//Memory collections have no files
+	if collection.entry.path == "" {
+		return nil
+	}
+	logging.Infof("Dropping collection %s at %s", name, collection.entry.path)
+	return os.RemoveAll(collection.entry.path)
+}
+
+//Close every collection, flushing their files to disk. Returns the first error met.
+//Closing a closed DB does nothing.
+func (d *DB) Close() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.closed {
+		return nil
+	}
+	d.closed = true
+	var err error
+	for _, collection := range d.collections {
+		if closeErr := collection.Db.Close(); closeErr != nil && err == nil {
+			err = fmt.Errorf("closing collection %s: %v", collection.GetName(), closeErr)
+		}
+	}
+	return err
+}
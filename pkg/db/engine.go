@@ -0,0 +1,108 @@
+package db
+
+import (
+	"encoding/json"
+	"nosql-db/pkg/datatypes"
+)
+
+//Storage engines a collection can be created with, see CreateCollectionWithEngine
+const (
+	//EngineFile stores objects in the collection's files (see Access)
+	EngineFile = "file"
+	//EngineMemory keeps objects in memory only (see MemoryEngine), they are gone once the process exits
+	EngineMemory = "memory"
+	//EngineLSM stores objects in a log-structured merge tree (see LSMEngine), for write-heavy collections
+	EngineLSM = "lsm"
+)
+
+//StorageEngine stores the objects of a collection. Queries and updates are raw JSON strings,
+//as found in the body of requests: see Filter for queries, and update for patches and update operators.
+type StorageEngine interface {
+	//Write an object, returning its id. Objects without an id are given one, objects with the id of
+	//an existing object replace it.
+	Write(data string) (string, error)
+	//Read returns the objects matching a query
+	Read(data string) ([]datatypes.JS, error)
+	//Update applies a patch or update operators to the object with id `id`, returning the update
+	Update(id, data string) (datatypes.JS, error)
+	//Delete removes every object matching a query, returning how many were deleted
+	Delete(data string) (datatypes.JS, error)
+	//Get returns the object with id `id`
+	Get(id string) (datatypes.JS, error)
+	//Replace the object with id `id` by the one in `data`, returning the object as stored
+	Replace(id, data string) (datatypes.JS, error)
+	//DeleteByID removes the object with id `id`, returning it.
+	//Get, Replace and DeleteByID return an ErrNotFound error if there is no such object.
+	DeleteByID(id string) (datatypes.JS, error)
+	//FindAndModify atomically applies the patch or update operators in `update` to one of the objects matching the query in `filter`,
+	//see ModifyOptions. Returns an ErrNotFound error if none matches and there is no upsert.
+	FindAndModify(filter, update string, options ModifyOptions) (ModifyResult, error)
+	//UpdateMany atomically applies the patch or update operators in `update` to every object matching the query
+	//in `filter`: either all of them are updated, or none is if the update fails on any of them.
+	UpdateMany(filter, update string) (UpdateResult, error)
+	//Scan calls `fn` with every object of the collection, in no particular order, until it returns false
+	Scan(fn func(obj datatypes.JS) bool) error
+	//Close releases what the engine holds on to. The engine cannot be used afterwards.
+	Close() error
+}
+
+//Every engine must implement StorageEngine
+var (
+	_ StorageEngine = (*Access)(nil)
+	_ StorageEngine = (*MemoryEngine)(nil)
+	_ StorageEngine = (*LSMEngine)(nil)
+	_ Maintainer    = (*Access)(nil)
+	_ IndexManager  = (*Access)(nil)
+)
+
+//Finder is implemented by engines reading pages of objects themselves, which lets them fill in the Explain of the page
+type Finder interface {
+	Find(data string, options ReadOptions) (ReadPage, error)
+}
+
+//IndexManager is implemented by engines supporting value indexes
+type IndexManager interface {
+	CreateIndex(spec IndexSpec) (IndexInfo, error)
+	DropIndex(name string) error
+	Indexes() []IndexInfo
+}
+
+//Maintainer is implemented by engines whose storage can be compacted and checked for consistency
+type Maintainer interface {
+	Compact() (CompactionStats, error)
+	CompactIfNeeded() (bool, error)
+	Verify(repair bool) (VerifyReport, error)
+}
+
+//Find returns a page of the objects of `engine` matching the query in `data`, as shaped by `options`.
+//Engines which are not Finders are read in full, then sorted and paged, and their pages have no plan to explain.
+func Find(engine StorageEngine, data string, options ReadOptions) (ReadPage, error) {
+	if finder, ok := engine.(Finder); ok {
+		return finder.Find(data, options)
+	}
+	return findPage(data, options, func(query datatypes.JS, explain *Explain) ([]datatypes.JS, error) {
+		objects, err := engine.Read(data)
+		explain.Matched = len(objects)
+		return objects, err
+	})
+}
+
+//objectNotFound is the error of engines asked for an object which does not exist
+func objectNotFound(id string) error {
+	return newError(ErrNotFound, "Object with id %s not found", id)
+}
+
+//replacement parses the object replacing the one with id `id`, returning it and its JSON.
+//It is given the id if it has none, and may not hold another one.
+func replacement(id, data string) (datatypes.JS, []byte, error) {
+	obj, err := parseDocument(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	if objID, found := obj["id"]; found && objID != id {
+		return nil, nil, newError(ErrInvalidDocument, "the id of the object does not match '%s'", id)
+	}
+	obj["id"] = id
+	jsonData, err := json.Marshal(obj)
+	return obj, jsonData, err
+}
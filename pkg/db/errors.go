@@ -0,0 +1,57 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"nosql-db/pkg/datatypes"
+	"nosql-db/pkg/util"
+)
+
+//Kinds of errors returned by collections and databases, to be checked with errors.Is as in
+//    if errors.Is(err, db.ErrNotFound) {...}
+//Errors of none of these kinds are failures of the database itself, such as storage failures and ErrClosed.
+var (
+	//ErrNotFound is the kind of errors about objects or indexes which do not exist
+	ErrNotFound = errors.New("not found")
+	//ErrConflict is the kind of errors about operations clashing with what is stored, as in DuplicateKeyError
+	ErrConflict = errors.New("conflict")
+	//ErrInvalidDocument is the kind of errors about malformed input: objects, queries, sort orders, index specs...
+	ErrInvalidDocument = errors.New("invalid document")
+	//ErrCollectionMissing is the kind of errors about collections which do not exist
+	ErrCollectionMissing = errors.New("collection missing")
+)
+
+//Error is an error of one of the kinds above
+type Error struct {
+	//Kind is ErrNotFound, ErrConflict, ErrInvalidDocument or ErrCollectionMissing
+	Kind    error
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+//Unwrap returns the kind of the error, for errors.Is
+func (e *Error) Unwrap() error {
+	return e.Kind
+}
+
+//newError returns an error of kind `kind` with a formatted message
+func newError(kind error, format string, v ...interface{}) error {
+	return &Error{Kind: kind, Message: fmt.Sprintf(format, v...)}
+}
+
+//invalid turns `err` into an ErrInvalidDocument with the same message, nil staying nil
+func invalid(err error) error {
+	if err == nil || errors.Is(err, ErrInvalidDocument) {
+		return err
+	}
+	return &Error{Kind: ErrInvalidDocument, Message: err.Error()}
+}
+
+//parseDocument parses the JSON object in `data`, as given by users
+func parseDocument(data string) (datatypes.JS, error) {
+	js, err := util.ParseJSON(data)
+	return js, invalid(err)
+}
@@ -0,0 +1,74 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"log"
+)
+
+//ErrClosed is returned by collections used after being closed
+var ErrClosed = errors.New("collection is closed")
+
+//storageFailure is raised, as a panic, by file operations which cannot go on, such as a failed write.
+//It never leaves the package: public methods recover it with recoverFailure and return it as an error.
+//Operations are logged to the WAL before being applied, so a collection which failed midway through one
+//is only left consistent by opening it again, which replays the WAL. Until then, an Access refuses every operation.
+type storageFailure struct {
+	err error
+}
+
+func (f storageFailure) Error() string {
+	return "storage failure: " + f.err.Error()
+}
+
+func (f storageFailure) Unwrap() error {
+	return f.err
+}
+
+//fail raises a storage failure caused by `err`
+func fail(err error) {
+	panic(storageFailure{err})
+}
+
+//failf raises a storage failure with a formatted message
+func failf(format string, v ...interface{}) {
+	fail(fmt.Errorf(format, v...))
+}
+
+//recoverFailure sets `err` to the storage failure raised in the function it is deferred from, if any.
+//Any other panic is passed on.
+func recoverFailure(err *error) {
+	if r := recover(); r != nil {
+		failure, ok := r.(storageFailure)
+		if !ok {
+			panic(r)
+		}
+		*err = failure
+	}
+}
+
+//failureState is what Access.failure holds once the collection cannot be used anymore
+type failureState struct {
+	err error
+}
+
+//failed returns why the collection cannot be used anymore, nil if it can
+func (db *Access) failed() error {
+	if state, ok := db.failure.Load().(failureState); ok {
+		return state.err
+	}
+	return nil
+}
+
+//recoverFailure is the package-level recoverFailure, which also marks the collection as failed
+func (db *Access) recoverFailure(err *error) {
+	if r := recover(); r != nil {
+		failure, ok := r.(storageFailure)
+		if !ok {
+			panic(r)
+		}
+		log.Printf("Collection %s failed, it must be opened again: %v", db.entry.name, failure.err)
+		db.failure.Store(failureState{failure})
+		*err = failure
+	}
+}
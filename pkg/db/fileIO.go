@@ -1,26 +1,45 @@
 package db
 
 import (
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"nosql-db/pkg/datatypes"
+	"nosql-db/pkg/logging"
 	"nosql-db/pkg/util"
 	"os"
-	"strconv"
-	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 const dbFile = "mydb.db"
 
-//Access the underlying db with common CRUD operations
+//Access the underlying db with common CRUD operations.
+//Reads may run in parallel; writes (Write, Update, Delete) are serialized by `lock`.
 type Access struct {
+	lock        sync.RWMutex
 	state       string
+	entry       CollectionEntry
 	fileHandles *FileHandles
 	indexTable  *datatypes.IndexTable
 	idGen       *IdGen
+	wal         *WAL
+	//valueIndexes maps index names to the value indexes of the collection, see indexes.go
+	valueIndexes    map[string]*valueIndex
+	nextIndexNumber uint32
+	//attributes locates the chain of every attribute in the attribute file
+	attributes *datatypes.AttributeDirectory
+	//syncWrites is turned off for files synced in bulk afterwards, such as those built by a compaction,
+	//and with FsyncNever
+	syncWrites bool
+	//compactionLock prevents two compactions of the same collection running at once
+	compactionLock sync.Mutex
+	//failure holds a failureState once the collection cannot be used anymore, see failure.go
+	failure atomic.Value
 }
 
 //FileHandles to underlying database files
@@ -28,12 +47,14 @@ type FileHandles struct {
 	dbFile         *os.File
 	indexFile      *os.File
 	attributesFile *os.File
+	valueIndexFile *os.File
+	walFile        *os.File
 }
 
 func openFile(fileName string) *os.File {
 	file, err := os.OpenFile(fileName, os.O_RDWR, 0777)
 	if err != nil {
-		log.Fatal(err)
+		fail(err)
 		return nil
 	}
 	return file
@@ -41,31 +62,56 @@ func openFile(fileName string) *os.File {
 
 func getFileContents(f *os.File) string {
 	fileContents := make([]byte, getFileSize(f))
-	f.Read(fileContents)
+	f.ReadAt(fileContents, 0)
 	return string(fileContents)
 }
 
 //NewAccess constructs an Access instance from a db name
-func NewAccess(collectionEntry CollectionEntry) *Access {
+func NewAccess(collectionEntry CollectionEntry) (access *Access, err error) {
+	defer recoverFailure(&err)
 	fileHandles := NewFileHandles(collectionEntry)
-	return &Access{
+	//Don't leak the files if the collection cannot be loaded
+	defer func() {
+		if r := recover(); r != nil {
+			fileHandles.close()
+			panic(r)
+		}
+	}()
+	access = &Access{
 		state:       "ready",
+		entry:       collectionEntry,
+		syncWrites:  collectionEntry.options.Fsync != FsyncNever,
 		fileHandles: fileHandles,
 		indexTable:  datatypes.LoadTable(getFileContents(fileHandles.indexFile)),
 		idGen:       NewIDGen(),
+		wal:         NewWAL(fileHandles.walFile, collectionEntry.options.Fsync != FsyncNever),
 	}
+	access.loadValueIndexes()
+	access.loadAttributeDirectory()
+	//Bring the files back in line if the previous run stopped midway through an operation
+	access.replayWAL()
+	access.resumeIndexBuilds()
+	return access, nil
 }
 
 //NewFileHandles constructs a FileHandles instance from a db name
 func NewFileHandles(collectionEntry CollectionEntry) *FileHandles {
-	path := collectionEntry.path + string(os.PathSeparator) + collectionEntry.name
+	path := collectionEntry.filesPath()
+	//A compaction may have been interrupted while swapping files in
+	finishCompaction(path)
+	//Existing collections may still be in an older on-disk format
+	migrateFiles(path)
 	dbFile := getFile(path + datatypes.DBFileExtension)
-	indexFile := getFile(path + datatypes.IndexFileExtension)
-	attributesFile := getFile(path + datatypes.AttributeFileExtension)
+	indexFile := getFormattedFile(path+datatypes.IndexFileExtension, datatypes.IndexFileMagic)
+	attributesFile := getFormattedFile(path+datatypes.AttributeFileExtension, datatypes.AttributeFileMagic)
+	valueIndexFile := getFormattedFile(path+datatypes.ValueIndexFileExtension, datatypes.ValueIndexFileMagic)
+	walFile := getFile(path + datatypes.WALFileExtension)
 	return &FileHandles{
 		dbFile:         dbFile,
 		indexFile:      indexFile,
 		attributesFile: attributesFile,
+		valueIndexFile: valueIndexFile,
+		walFile:        walFile,
 	}
 }
 
@@ -76,50 +122,58 @@ func getFile(filename string) *os.File {
 	}
 	file, err := os.Create(filename)
 	if err != nil {
-		log.Fatal(err)
+		fail(err)
 	}
 	file.Close()
 	return openFile(filename)
 }
 
-func getFilePos(f *os.File) int64 {
-	offset, err := f.Seek(0, io.SeekCurrent)
-	if err != nil {
-		log.Fatal(err)
-	}
-	return offset
-}
-
-func (db *Access) getDbFilePos() int {
-	offset, err := db.fileHandles.dbFile.Seek(0, io.SeekCurrent)
-	if err != nil {
-		log.Fatal(err)
+//syncFile commits `f` to disk, unless writes are synced in bulk by the caller
+func (db *Access) syncFile(f *os.File) {
+	if db.syncWrites {
+		if err := f.Sync(); err != nil {
+			fail(err)
+		}
 	}
-	return int(offset)
 }
 
 func getFileSize(f *os.File) int {
 	info, err := f.Stat()
 	if err != nil {
-		log.Fatal(err)
+		fail(err)
 	}
 	return int(info.Size())
 }
 
-//WriteToFile writes data to the end of the database file
-func (db *Access) WriteToFile(data []byte) int {
-	db.fileHandles.dbFile.Seek(0, 2)
-	n, err := db.fileHandles.dbFile.Write(data)
+//WriteToFile writes data to the end of the database file.
+//Returns the offset the data was written at and the number of bytes written.
+//Positional writes are used so concurrent readers never see a moved file cursor.
+func (db *Access) WriteToFile(data []byte) (int64, int) {
+	offset := int64(getFileSize(db.fileHandles.dbFile))
+	n, err := db.fileHandles.dbFile.WriteAt(data, offset)
 	if err != nil {
-		log.Fatal(err)
+		fail(err)
 	}
-	db.fileHandles.dbFile.Sync()
-	return n
+	db.syncFile(db.fileHandles.dbFile)
+	return offset, n
 }
 
 //Write data to the database. `data` is a raw JSON string
-func (db *Access) Write(data string) (string, error) {
-	dat := util.GetJSON(data)
+func (db *Access) Write(data string) (id string, err error) {
+	if err := db.failed(); err != nil {
+		return "", err
+	}
+	defer db.recoverFailure(&err)
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	return db.write(data)
+}
+
+func (db *Access) write(data string) (string, error) {
+	dat, err := parseDocument(data)
+	if err != nil {
+		return "", err
+	}
 	entryID := db.idGen.GetID(data)
 	//if this is a fresh object, give it an ID and write the new entry to the index file.
 	//if not, use the old ID and write the index file entry using the Update of IndexFile
@@ -131,57 +185,69 @@ func (db *Access) Write(data string) (string, error) {
 	}
 	if freshObject {
 		dat["id"] = entryID
+	} else if userID, ok := dat["id"].(string); ok {
+		entryID = userID
 	} else {
-		entryID = dat["id"].(string)
+		return "", newError(ErrInvalidDocument, "id must be a string")
 	}
 	_id := db.idGen.GetHash(entryID)
-	dat["_id"] = _id
-
-	log.Printf("_id = %s", dat["_id"])
-
-	flattened := util.FlattenJSON(dat)
-	log.Printf("%#v", flattened)
 
-	delete(dat, "_id")
+	logging.Debugf("_id = %s", _id)
 
 	jsonData, err := json.Marshal(dat)
 
 	if err != nil {
-		log.Fatal(err)
-		return "Invalid JSON object", err
+		return "", err
 	}
 
-	log.Println("Writing at offset " + strconv.Itoa(db.getDbFilePos()))
+	//Checked under the same lock as the write, so no other write can take the key meanwhile
+	if err := db.checkUniqueIndexes(_id, dat); err != nil {
+		return "", err
+	}
+
+	//Log the operation before touching any file, so a crash midway can be redone on startup
+	db.wal.begin(walRecord{Op: walOpWrite, IDs: []string{_id}, Data: jsonData})
+	db.applyWrite(_id, jsonData)
+	db.wal.commit()
+
+	return entryID, nil
+}
+
+//applyWrite appends the serialized document to the db file, then points its index entry at it
+//and adds it to the attribute chains and value indexes. If `_id` already has an index entry, that entry is overwritten in place
+//and the copy it pointed at is zeroed, as deletes do.
+func (db *Access) applyWrite(_id string, jsonData []byte) {
+	dat := util.GetJSON(string(jsonData))
 
-	n := db.WriteToFile(jsonData)
-	log.Println("Wrote " + strconv.Itoa(n) + " bytes")
+	dbFileOffset, n := db.WriteToFile(jsonData)
+	logging.Debugf("Wrote %d bytes at offset %d", n, dbFileOffset)
 
 	//If we are updating an object, then update the entry in the index file. For that, get its offset in the
-	//offset file.
+	//offset file. If the id is not there yet (fresh object or id defined by the user), write this document
+	//as if it were new i.e. at the end of the index file
 	indexFileOffset := int64(-1)
-	if !freshObject {
-		indexData, err := db.indexTable.Get(entryID)
-		if err != nil {
-			//this means it is an id defined by the user. Write this document as if it were new i.e. at the end of
-			//the db file
-		} else {
-			indexFileOffset = indexData.IndexFileOffset
-		}
+	previous, err := db.indexTable.Get(_id)
+	updating := err == nil
+	if updating {
+		indexFileOffset = previous.IndexFileOffset
 	}
 	//Store information about entry. Will write this to the index file
-	indexEntry := datatypes.NewIndexEntry(int64(db.getDbFilePos()-n), indexFileOffset, n, _id)
+	indexEntry := datatypes.NewIndexEntry(dbFileOffset, indexFileOffset, n, _id, datatypes.Checksum(jsonData))
 
-	log.Printf("Writing indexentry %v", indexEntry)
+	logging.Debugf("Writing indexentry %v", indexEntry)
 
 	//Write to index file
 	db.WriteIndex(indexEntry)
+	//Only zero the superseded copy once nothing points at it anymore, so it is not taken for an orphan record
+	if updating {
+		db.DeleteFromDBFile(&previous)
+	}
 
 	//We now need to write to attributes file
-	db.writeAttributes(flattened)
+	db.writeAttributes(_id, dat)
+	db.indexDocument(_id, dat)
 
-	log.Println("Wrote " + string(jsonData))
-
-	return entryID, nil
+	logging.Debugf("Wrote %s", jsonData)
 }
 
 //WriteIndex takes an IndexEntry and writes it to the index file
@@ -189,18 +255,20 @@ func (db *Access) Write(data string) (string, error) {
 func (db *Access) WriteIndex(ie *datatypes.IndexEntry) int64 {
 	//TODO fix this func with appropriate seeking based on ie.
 	//Also, need to update map and not insert when ID already there (update).
-	log.Printf("ie object: %v", ie)
+	logging.Debugf("ie object: %v", ie)
 	//Get write start (value to be returned)
 	var offset int64
 	if ie.GetIndexData().IndexFileOffset == -1 {
-		offset, _ = db.fileHandles.indexFile.Seek(0, 2)
+		offset = int64(getFileSize(db.fileHandles.indexFile))
 	} else {
-		offset, _ = db.fileHandles.indexFile.Seek(ie.GetIndexData().IndexFileOffset, 0)
+		offset = ie.GetIndexData().IndexFileOffset
 	}
 
 	//Write to disk but ALSO to in-memory table
-	db.fileHandles.indexFile.Write(ie.WriteableRepr())
-	db.fileHandles.indexFile.Sync()
+	if _, err := db.fileHandles.indexFile.WriteAt(ie.WriteableRepr(), offset); err != nil {
+		fail(err)
+	}
+	db.syncFile(db.fileHandles.indexFile)
 
 	//Update indexEntry object with obtained offset
 	ie.SetIndexFileOffset(offset)
@@ -216,13 +284,14 @@ func (db *Access) DeleteIndex(id string) {
 	//Delete from disk but ALSO from in-memory table
 	indexData, err := db.indexTable.Get(id)
 	if err != nil {
-		log.Fatal("Attempting to delete object with id " + id + " not in database")
+		failf("Attempting to delete object with id %s not in database", id)
 	}
 	tape := make([]byte, datatypes.IndexEntrySize)
-	log.Printf("Writing %d bytes at offset %d", len(tape), indexData.IndexFileOffset)
-	db.fileHandles.indexFile.Seek(indexData.IndexFileOffset, 0)
-	db.fileHandles.indexFile.Write(make([]byte, datatypes.IndexEntrySize))
-	db.fileHandles.indexFile.Sync()
+	logging.Debugf("Writing %d bytes at offset %d", len(tape), indexData.IndexFileOffset)
+	if _, err := db.fileHandles.indexFile.WriteAt(tape, indexData.IndexFileOffset); err != nil {
+		fail(err)
+	}
+	db.syncFile(db.fileHandles.indexFile)
 
 	//in-memory table
 	db.indexTable.Remove(id)
@@ -230,105 +299,168 @@ func (db *Access) DeleteIndex(id string) {
 
 //DeleteFromDBFile deletes an entry from the db file given an IndexEntry
 func (db *Access) DeleteFromDBFile(id *datatypes.IndexData) error {
-	db.fileHandles.dbFile.Seek(id.Offset, 0)
-	db.fileHandles.dbFile.Write(make([]byte, id.Size))
-	db.fileHandles.indexFile.Sync()
+	if _, err := db.fileHandles.dbFile.WriteAt(make([]byte, id.Size), id.Offset); err != nil {
+		fail(err)
+	}
+	db.syncFile(db.fileHandles.dbFile)
 
 	return nil
 }
 
-func (db *Access) writeAttributes(data datatypes.JS) {
-	log.Printf("%s, (%v)", "writeAttributes", data)
-	_id := data["_id"].(string)
-	delete(data, "id")
-	delete(data, "_id")
+//writeAttributes adds `_id` to the attribute chain of every attribute path of `data` (see util.AttributePaths)
+func (db *Access) writeAttributes(_id string, data datatypes.JS) {
+	logging.Debugf("%s, (%v)", "writeAttributes", data)
 	//get offset of start of attribute chain (if exists)
-	for k := range data {
-		log.Println("writing key " + k)
+	for _, k := range util.AttributePaths(data) {
+		//The id is looked up through the index file, it has no attribute chain
+		if k == "id" {
+			continue
+		}
+		logging.Debugf("writing key %s", k)
 		db.writeAttribute("/"+k, _id)
 	}
 }
 
 func (db *Access) writeAttribute(key string, id string) {
-	startOffset, _ := db.findAttributeOffset(key)
-
-	//zeroes needed for offset placeholder (linkedlist pointer)
-	zeroes := make([]byte, datatypes.LinkedListPointerSize)
-
-	//If startOffset is -1, this attribute has never been seen previously.
-	//As such, we need to write the HEAD of the linked list.
-	if startOffset < 0 {
-		log.Println(key + " not found. Writing HEAD...")
-		//Write key:ID:\0\0\0\0
-		offset, _ := db.fileHandles.attributesFile.Seek(0, 2)
-		db.fileHandles.attributesFile.WriteString(key + ":" + id + ":")
-		db.fileHandles.attributesFile.Write(zeroes)
-		endOffset, _ := db.fileHandles.attributesFile.Seek(0, 1)
-		log.Printf("Wrote from byte %d to byte %d", offset, endOffset)
-		log.Println("Wrote " + key)
-	} else {
-		//Tail offset points to the first null byte after the separator (':')
-		//For example, 3b0d2e8c691600:\0\0\0\0
-		//  offset would point here    ^
-		//We are going to have to write the offset to the item we're about to write.
-		//Let's write the item, get its offset, then write the offset at pos=tailOffset
-		tailOffset := db.getAttrListTailOffset(startOffset)
-		if tailOffset < 0 {
-			//BUG FIX here! the startOffset is right at the beginning of attr entry.
-			//As such, we need to shift by ID + and LLPointerSize (end of offset space)
-			tailOffset = startOffset + datatypes.LinkedListPointerOffset
-		} else {
-			tailOffset += datatypes.LinkedListPointerOffset
-		}
+	chain, found := db.attributes.Get(key)
 
-		//Write ID:\0\0\0\0
-		db.fileHandles.attributesFile.Seek(0, 2)
-		currentKeyOffset := getFilePos(db.fileHandles.attributesFile)
-		db.fileHandles.attributesFile.WriteString(id + ":")
-		db.fileHandles.attributesFile.Write(zeroes)
+	//If the attribute has never been seen previously, we need to write the HEAD of the linked list.
+	record := &datatypes.AttributeRecord{ID: id}
+	if !found {
+		logging.Debugf("%s not found. Writing HEAD...", key)
+		record.Key = key
+	}
 
-		//Write offset
-		offsetBytes := []byte(strconv.Itoa(int(currentKeyOffset)))
-		db.fileHandles.attributesFile.WriteAt(offsetBytes, tailOffset-int64(len(offsetBytes))+1)
-		//log.Printf("Wrote %d at %d (start = %d, len = %d)", currentKeyOffset, tailOffset, tailOffset-int64(len(offsetBytes))+1, len(offsetBytes))
+	//The new item always goes at the end of the file. It is written before being linked to the chain,
+	//so the chain never points at a partially written item
+	offset := int64(getFileSize(db.fileHandles.attributesFile))
+	if _, err := db.fileHandles.attributesFile.WriteAt(record.WriteableRepr(), offset); err != nil {
+		fail(err)
 	}
 
-	db.fileHandles.attributesFile.Sync()
+	if found {
+		//Point the current tail of the chain at the item we just wrote
+		pointer := make([]byte, datatypes.OffsetSize)
+		binary.BigEndian.PutUint64(pointer, uint64(offset))
+		if _, err := db.fileHandles.attributesFile.WriteAt(pointer, chain.TailNext); err != nil {
+			fail(err)
+		}
+	}
+	db.attributes.Append(key, offset, record)
 
+	db.syncFile(db.fileHandles.attributesFile)
 }
 
 //Read from the database, filtering the data based on `data`
-func (db *Access) Read(data string) ([]datatypes.JS, error) {
+func (db *Access) Read(data string) (objects []datatypes.JS, err error) {
+	if err := db.failed(); err != nil {
+		return nil, err
+	}
+	defer db.recoverFailure(&err)
 	if len(data) == 0 {
-		err := errors.New("Empty request")
+		err := newError(ErrInvalidDocument, "Empty request")
+		return nil, err
+	}
+	query, err := parseDocument(data)
+	if err != nil {
 		return nil, err
 	}
-	query := util.GetJSON(data)
 
+	db.lock.RLock()
+	defer db.lock.RUnlock()
 	return db.retrieveFromQuery(query)
 }
 
-//Update entry with id=`id` from the databas
-func (db *Access) Update(id, data string) (datatypes.JS, error) {
-	idQuery := fmt.Sprintf("{\"id\":\"%s\"}", id)
-	objects, e := db.Read(idQuery)
+//Scan calls `fn` with every object until it returns false. Objects are read one at a time,
+//so writes carry on during the scan, and objects written or deleted meanwhile may or may not be seen.
+func (db *Access) Scan(fn func(obj datatypes.JS) bool) (err error) {
+	if err := db.failed(); err != nil {
+		return err
+	}
+	defer db.recoverFailure(&err)
+	var ids []string
+	db.readLocked(func() {
+		ids = db.indexTable.GetAllIds()
+	})
+
+	for _, _id := range ids {
+		var obj datatypes.JS
+		var err error
+		db.readLocked(func() {
+			obj, err = db.getSingleObjectFromID(_id)
+		})
+		if err != nil {
+			//Deleted since the scan started
+			continue
+		}
+		if !fn(obj) {
+			return nil
+		}
+	}
+	return nil
+}
+
+//Close syncs and closes the collection's files. Waits for a running compaction; writes and reads must be over.
+//The collection cannot be used afterwards: its methods return ErrClosed.
+func (db *Access) Close() error {
+	db.compactionLock.Lock()
+	defer db.compactionLock.Unlock()
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if db.failed() == ErrClosed {
+		return nil
+	}
+	err := db.fileHandles.sync()
+	db.fileHandles.close()
+	db.state = "closed"
+	db.failure.Store(failureState{ErrClosed})
+	return err
+}
+
+//readLocked runs `fn` under the read lock, which is released even if `fn` raises a storage failure
+func (db *Access) readLocked(fn func()) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	fn()
+}
+
+//Update entry with id=`id` from the databas, applying the patch or update operators in `data` to it
+func (db *Access) Update(id, data string) (patch datatypes.JS, err error) {
+	if err := db.failed(); err != nil {
+		return nil, err
+	}
+	defer db.recoverFailure(&err)
+	upd, err := parseUpdate(data)
+	if err != nil {
+		return nil, err
+	}
+
+	//Hold the write lock across the read and the write so the merge is applied to the latest version
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	objects, e := db.retrieveFromQuery(datatypes.JS{"id": id})
 	if e != nil {
-		log.Printf("Object with id %s not found", id)
-		return nil, fmt.Errorf("Object with id %s not found", id)
+		logging.Debugf("Object with id %s not found", id)
+		return nil, newError(ErrNotFound, "Object with id %s not found", id)
 	}
 
 	if len(objects) > 1 {
-		log.Printf("Ambiguous query matches more than one record: %v", objects)
+		logging.Debugf("Ambiguous query matches more than one record: %v", objects)
 		return nil, fmt.Errorf("Ambiguous query matches more than one record: %v", objects)
 	}
 
 	object := objects[0]
 
-	patchObj := util.GetJSON(data)
-	updated := util.MergeRFC7396(object, patchObj)
+	updated, err := upd.apply(object)
+	if err != nil {
+		return nil, err
+	}
+	//The id is what the object is found by, it cannot be patched away
+	updated["id"] = id
 	updatedStr, _ := json.MarshalIndent(updated, "", "\t")
 	updatedRawBytes, _ := json.Marshal(updated)
-	log.Printf("After update we have\n%s", updatedStr)
+	logging.Debugf("After update we have\n%s", updatedStr)
 
 	//For now, we'll delete the original object and write the new one as a new entry.
 	//Later, we'll overwrite the new object over the original if the lengths match (probably a fairly uncommon case)
@@ -345,21 +477,31 @@ func (db *Access) Update(id, data string) (datatypes.JS, error) {
 	//For now, we simply remove duplicate IDs.
 
 	//Write
-	_, err := db.Write(string(updatedRawBytes))
+	_, err = db.write(string(updatedRawBytes))
 	if err != nil {
-		return patchObj, err
+		return upd.doc, err
 	}
 	//Return final object.
-	return patchObj, nil
+	return upd.doc, nil
 }
 
 //Delete all entries matching the filter in `data`
-func (db *Access) Delete(data string) (datatypes.JS, error) {
+func (db *Access) Delete(data string) (result datatypes.JS, err error) {
+	if err := db.failed(); err != nil {
+		return nil, err
+	}
+	defer db.recoverFailure(&err)
 	if len(data) == 0 {
-		err := errors.New("Empty request")
+		err := newError(ErrInvalidDocument, "Empty request")
+		return nil, err
+	}
+	query, err := parseDocument(data)
+	if err != nil {
 		return nil, err
 	}
-	query := util.GetJSON(data)
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
 
 	toDelete, err := db.retrieveFromQuery(query)
 
@@ -367,40 +509,213 @@ func (db *Access) Delete(data string) (datatypes.JS, error) {
 		return nil, err
 	}
 
-	for _, item := range toDelete {
-		objectID := item["id"].(string)
-		id, err := db.indexTable.Get(objectID)
-		if err != nil {
-			return nil, err
-		}
-		db.DeleteFromDBFile(&id)
-		db.DeleteIndex(item["id"].(string))
+	//The index is keyed on the internal _id, derived from the user-space id
+	ids := make([]string, len(toDelete))
+	for i, item := range toDelete {
+		ids[i] = db.idGen.GetHash(item["id"].(string))
 	}
 
-	result := make(datatypes.JS)
+	if len(ids) > 0 {
+		db.wal.begin(walRecord{Op: walOpDelete, IDs: ids})
+		db.applyDelete(ids)
+		db.wal.commit()
+	}
+
+	result = make(datatypes.JS)
 	result["deleteCount"] = len(toDelete)
 	return result, nil
 }
 
+//Get returns the object with id `id`
+func (db *Access) Get(id string) (obj datatypes.JS, err error) {
+	if err := db.failed(); err != nil {
+		return nil, err
+	}
+	defer db.recoverFailure(&err)
+	db.readLocked(func() {
+		obj, err = db.get(id)
+	})
+	return obj, err
+}
+
+//get returns the object with (user-space) id `id`, an ErrNotFound if there is none. Must be called with the lock held.
+func (db *Access) get(id string) (datatypes.JS, error) {
+	_id := db.idGen.GetHash(id)
+	if _, err := db.indexTable.Get(_id); err != nil {
+		return nil, objectNotFound(id)
+	}
+	return db.getSingleObjectFromID(_id)
+}
+
+//Replace the object with id `id` by the one in `data`, as a whole rather than merging it in as Update does
+func (db *Access) Replace(id, data string) (obj datatypes.JS, err error) {
+	if err := db.failed(); err != nil {
+		return nil, err
+	}
+	defer db.recoverFailure(&err)
+	obj, jsonData, err := replacement(id, data)
+	if err != nil {
+		return nil, err
+	}
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if _, err := db.indexTable.Get(db.idGen.GetHash(id)); err != nil {
+		return nil, objectNotFound(id)
+	}
+	if _, err := db.write(string(jsonData)); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+//DeleteByID removes the object with id `id`, returning it
+func (db *Access) DeleteByID(id string) (obj datatypes.JS, err error) {
+	if err := db.failed(); err != nil {
+		return nil, err
+	}
+	defer db.recoverFailure(&err)
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if obj, err = db.get(id); err != nil {
+		return nil, err
+	}
+	_id := db.idGen.GetHash(id)
+	db.wal.begin(walRecord{Op: walOpDelete, IDs: []string{_id}})
+	db.applyDelete([]string{_id})
+	db.wal.commit()
+	return obj, nil
+}
+
+//FindAndModify merges the patch in `update` into one of the objects matching `filter`, see StorageEngine.
+//The objects are found and the modified one written under the same write lock, so no other write can come in between.
+func (db *Access) FindAndModify(filter, update string, options ModifyOptions) (result ModifyResult, err error) {
+	if err := db.failed(); err != nil {
+		return ModifyResult{}, err
+	}
+	defer db.recoverFailure(&err)
+	mod, err := parseModification(filter, update, options)
+	if err != nil {
+		return ModifyResult{}, err
+	}
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	matches, err := mod.matches(db.retrieveFromQuery(mod.filter))
+	if err != nil {
+		return ModifyResult{}, err
+	}
+	before, after, err := mod.apply(matches, func(id string) bool {
+		_, err := db.indexTable.Get(db.idGen.GetHash(id))
+		return err == nil
+	})
+	if err != nil {
+		return ModifyResult{}, err
+	}
+	jsonData, err := json.Marshal(after)
+	if err != nil {
+		return ModifyResult{}, err
+	}
+	id, err := db.write(string(jsonData))
+	if err != nil {
+		return ModifyResult{}, err
+	}
+	return mod.result(before, after, id), nil
+}
+
+//UpdateMany applies the patch or update operators in `update` to every object matching `filter`, see StorageEngine.
+//The modified objects are logged to the WAL as a single record before any is written, so a crash midway
+//is redone as a whole on startup.
+func (db *Access) UpdateMany(filter, update string) (result UpdateResult, err error) {
+	if err := db.failed(); err != nil {
+		return UpdateResult{}, err
+	}
+	defer db.recoverFailure(&err)
+	many, err := parseManyUpdate(filter, update)
+	if err != nil {
+		return UpdateResult{}, err
+	}
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	modified, result, err := many.apply(db.retrieveFromQuery(many.filter))
+	if err != nil || len(modified) == 0 {
+		return result, err
+	}
+	ids := make([]string, len(modified))
+	docs := make([]json.RawMessage, len(modified))
+	for i, obj := range modified {
+		ids[i] = db.idGen.GetHash(obj["id"].(string))
+		if docs[i], err = json.Marshal(obj); err != nil {
+			return UpdateResult{}, err
+		}
+	}
+	if err := db.checkUniqueBatch(ids, modified); err != nil {
+		return UpdateResult{}, err
+	}
+	data, err := json.Marshal(docs)
+	if err != nil {
+		return UpdateResult{}, err
+	}
+	db.wal.begin(walRecord{Op: walOpWriteMany, IDs: ids, Data: data})
+	for i, _id := range ids {
+		db.applyWrite(_id, docs[i])
+	}
+	db.wal.commit()
+	return result, nil
+}
+
+//applyDelete removes every object in `ids` (internal _ids) from the db and index files, and the value indexes.
+//Objects no longer in the index are skipped.
+func (db *Access) applyDelete(ids []string) {
+	for _, _id := range ids {
+		indexData, err := db.indexTable.Get(_id)
+		if err != nil {
+			continue
+		}
+		db.DeleteFromDBFile(&indexData)
+		db.DeleteIndex(_id)
+		db.unindexDocument(_id)
+	}
+}
+
 func (db *Access) retrieveFromQuery(query datatypes.JS) ([]datatypes.JS, error) {
+	return db.findObjects(query, nil)
+}
+
+//findObjects returns the objects matching `query`. If `explain` is not nil, it is filled in with how the query was run.
+func (db *Access) findObjects(query datatypes.JS, explain *Explain) ([]datatypes.JS, error) {
+	filter, err := ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	if explain == nil {
+		explain = &Explain{}
+	}
+
 	if id, ok := query["id"]; ok {
 		if idStr, ok := id.(string); ok {
 			//Obtain internal _id from "user-space" id
 			_id := db.idGen.GetHash(idStr)
-			log.Printf("query for id %s (true id is %s)", _id, idStr)
+			logging.Debugf("query for id %s (true id is %s)", _id, idStr)
+			explain.Plan = ExplainStep{Stage: stageIDLookup, Estimated: 1, Candidates: 1}
+			explain.Candidates = 1
 			jsObj, err := db.getSingleObjectFromID(_id)
 			if err != nil {
 				//obj no longer exists
-				return nil, errors.New("Object does not exist")
+				return nil, newError(ErrNotFound, "Object does not exist")
 			}
-			object := jsObj
-			return []datatypes.JS{object}, nil
+			explain.DocsExamined = 1
+			//The rest of the query still applies
+			objects := db.applyFilter([]datatypes.JS{jsObj}, filter)
+			explain.Matched = len(objects)
+			return objects, nil
 		}
-	} else {
-		return db.getFilteredData(util.FlattenJSON(query)), nil
 	}
-
-	return []datatypes.JS{datatypes.JS{"Yeah": "hey"}}, nil
+	objects := db.getFilteredData(filter, explain)
+	explain.Matched = len(objects)
+	return objects, nil
 }
 
 /*
@@ -414,77 +729,48 @@ UPDATE: better method, involving less disk-reading = better performance.
 	-> Now fetch data based on remaining IDs
 	-> now we can filter on the data with all attributes directly,
 	   as we know each object contains all the requested attributes
+UPDATE 2: with query operators, not every attribute in the query has to be present ($exists: false, $ne...).
+Only the attributes the filter requires a value for are used to narrow down candidates.
+UPDATE 3: with $or, candidates are the union of the IDs of each branch
+UPDATE 4: intersecting every attribute chain is a waste when one of them is far smaller than the others:
+the planner picks which value indexes and attribute chains to go through, see planner.go
 */
-func (db *Access) getFilteredData(query datatypes.JS) []datatypes.JS {
-	//In the case of an empty query `{}`, return all objects stored in db
-	if len(query) == 0 {
-		return db.getAllObjects()
-	}
-	//var filteredLists [][]datatypes.JS
-
-	//Will hold a mapping from attribute name -> list of IDs of objects containing that attribute
-	//attributesIDs := make(map[string][]string)
-
-	//Array of all IDs which contain at least one of the attributes in query.
-	//Will be narrowed down to only IDs which contain ALL the attributes in query by subsequent inner-join
-	var attributesIDs [][]string
-
-	//fill above map
-	for k := range query {
-		attributesIDs = append(attributesIDs, db.getAllIdsFromAttributeName(k))
-	}
-
-	//Inner-join the map
-	objectIDsWithFilterAttr := util.InnerJoin(attributesIDs)
-	//After the above inner-join, every single object in objectIDsWithFilterAttr (well, the objects
-	//referred to by the IDs) has every single attribute contained in the query
-
+func (db *Access) getFilteredData(filter Filter, explain *Explain) []datatypes.JS {
+	plan := filter.candidates()
+	//In the case of an empty query `{}` (or one which cannot be narrowed down), go through all objects stored in db
+	if plan == nil {
+		ids := db.indexTable.GetAllIds()
+		explain.Plan = ExplainStep{Stage: stageCollectionScan, Estimated: len(ids), Candidates: len(ids)}
+		explain.Candidates = len(ids)
+		objects := db.getAllObjectsFromIds(ids)
+		explain.DocsExamined = len(objects)
+		return db.applyFilter(objects, filter)
+	}
+
+	step := db.planCandidates(plan)
 	//filter out duplicates (necassry, atm anyways, as we do not remove entries from the attributes file, meaning
 	//reading by attribute will return duplicates if objects have been deleted/updated)
-	uniqueObjectIDs := util.UniqueIDs(objectIDsWithFilterAttr)
+	uniqueObjectIDs := util.UniqueIDs(db.runStep(step))
+	explain.Plan = step.explain()
+	explain.Candidates = len(uniqueObjectIDs)
 
-	return db.applyFilter(uniqueObjectIDs, query)
+	objects := db.getAllObjectsFromIds(uniqueObjectIDs)
+	explain.DocsExamined = len(objects)
+	return db.applyFilter(objects, filter)
 }
 
-//applyFilter gets objects from db based on `ids`, and only keeps objects whose attributes/values match
-//those in `filter`
-func (db *Access) applyFilter(ids []string, filter datatypes.JS) []datatypes.JS {
-	//Every item in objects will have at least all the attributes in filter
-	objects := db.getAllObjectsFromIds(ids)
-
+//applyFilter only keeps objects matching `filter`
+func (db *Access) applyFilter(objects []datatypes.JS, filter Filter) []datatypes.JS {
 	//TODO may need to rethink this, based on performance cost.
 	//repeatedly appending is heavily inefficient in the worst-case scenario (filter selects all elements)
 	var filteredObjects []datatypes.JS
 
 	for _, obj := range objects {
-		//keeps track of wether current object matches filter
-		match := true
-
-		//TODO Using flattened is a neat hack which meant the Read aspect of nested-objects
-		//was super easy to implement, but it will make updating impossible.
-		//Updating will require traversal of the original object, so might as well use that here
-		//and write the function now.
-		flattened := util.FlattenJSON(obj)
-
-		for key, value := range filter {
-			//Check wether this is a nested query
-			if strings.Contains(key, ".") {
-				//TODO might be a bit hard, probably some notation or something we can use to do this
-				//but we're gonna have to go through object, where nesting level depends on len(parts).
-				//parts := strings.Split(key, ".")
-			}
-			if flattened[key] != value {
-				match = false
-				break
-			}
-		}
-		if match {
+		if filter.Match(obj) {
 			filteredObjects = append(filteredObjects, obj)
 		}
-
 	}
 	return filteredObjects
-
 }
 
 func (db *Access) getAllObjects() []datatypes.JS {
@@ -492,15 +778,15 @@ func (db *Access) getAllObjects() []datatypes.JS {
 }
 
 func (db *Access) getAllObjectsFromIds(ids []string) []datatypes.JS {
-	log.Printf("(len = %d)", len(ids)) //len = 2 here
-	objects := make([]datatypes.JS, len(ids))
-	for i, id := range ids {
+	logging.Debugf("(len = %d)", len(ids)) //len = 2 here
+	objects := make([]datatypes.JS, 0, len(ids))
+	for _, id := range ids {
 		jsObj, err := db.getSingleObjectFromID(id)
 		if err != nil {
 			//obj no longer exists
 			continue
 		}
-		objects[i] = jsObj
+		objects = append(objects, jsObj)
 	}
 	return objects
 }
@@ -514,150 +800,73 @@ func (db *Access) getSingleObjectFromID(id string) (datatypes.JS, error) {
 		//if a single item is missing. Not good.
 		//UPDATE: lol indeed I just got to that situation.
 		//UPDATE: okkk deletion implemented, time to fix this.
-		return nil, errors.New("Object deleted or non-existent")
+		return nil, newError(ErrNotFound, "Object deleted or non-existent")
+	}
+	dbData, err := db.readDbData(&indexData)
+	if err != nil {
+		log.Printf("Cannot read object %s: %v", id, err)
+		return nil, err
 	}
-	dbData := db.readDbData(&indexData)
 	return util.GetJSON(dbData), nil
 }
 
-//returns offset, id (of first item in attribute list)
-func (db *Access) findAttributeOffset(attribute string) (int64, string) {
-	// The attribute file will be organised in a linked list
-	// For example,
-	// name:{id}:29
-	// age:{id}:34
-	// {id}:46
-	// etc. Initially, attrbutes are set with n null bytes (where n will depend on how many items we're storing)
-	// To find all IDs, simply find first instance of attribute, then traverse the singly linked list
-	reachedEnd := false
-	attrRaw := []byte(attribute)
-	chunkSize := 256
-	db.fileHandles.attributesFile.Seek(int64(len(attribute)), 0)
-	for !reachedEnd {
-		//Seek backwards by attribute length. Simple trick to avoid the issue where search item is missed because split
-		//in half where next portion is fetched
-		filePos, _ := db.fileHandles.attributesFile.Seek(-int64(len(attribute)), 1)
-		data := make([]byte, chunkSize)
-		n, err := db.fileHandles.attributesFile.Read(data)
-		if err != nil {
-			log.Println(err)
-			reachedEnd = true
-		}
-		attrIndex := 0
-		for i := 0; i < n; i++ {
-			if data[i] == attrRaw[attrIndex] {
-				if attrIndex == len(attrRaw)-1 {
-					//We then extract the two pieces of information
-					//as per above, in the format `name:{id}:29`
-
-					/*
-						Two reads looks better, but slower. One read, then split in memory. Faster.
-							id := make([]byte, datatypes.IDLength)
-							pointer := make([]byte, datatypes.LinkedListPointerSize)
-					*/
-
-					//Skip first separator (we are on final character of attribute name, skip it, and skip first ':', hence +2)
-					offset, id := db.readSingleAttrItem(filePos + 2)
-
-					//TODO because of the following code segment, a positive offset will be returned.
-					//As a result, readSingleAttrItem will have to be called again to figure out that the
-					//current offset points to the tail of the attr.
-					//call chain can be reduced by a full cycle by avoiding this
-					if offset > 0 {
-						return offset, id
-					}
-					return filePos + 2, ""
-				}
-				attrIndex++
-			} else {
-				attrIndex = 0
-			}
-			filePos++
-		}
-		if n < chunkSize {
-			return -1, ""
-		}
-	}
-	return -1, ""
+//loadAttributeDirectory reads the chain of every attribute from the attribute file.
+//The attribute file is organised in singly linked lists, one per attribute, whose heads carry the attribute name.
+//Heads and items of all the lists are interleaved in the file, so it is gone through once, here, rather than
+//for every attribute of every write and query.
+func (db *Access) loadAttributeDirectory() {
+	size := int64(getFileSize(db.fileHandles.attributesFile))
+	db.attributes = datatypes.LoadAttributeDirectory(io.NewSectionReader(db.fileHandles.attributesFile, datatypes.FileHeaderSize, size))
 }
 
-//Takes an offset, and returns an id and offset to next item
-func (db *Access) readSingleAttrItem(offset int64) (int64, string) {
-	//The +1 comes from the middle separator (':')
-	data := make([]byte, datatypes.IDLength+datatypes.LinkedListPointerSize+1)
-
-	//skip first separator
-	db.fileHandles.attributesFile.ReadAt(data, offset)
-
-	//split along separator
-	parts := strings.Split(string(data), ":")
-
-	//empty file or non-existent data
-	if len(parts) < 2 {
-		return -1, ""
-	}
-
-	//extract data
-	id := parts[0]
-	pointer, err := strconv.Atoi(strings.Trim(parts[1], "\x00"))
-
-	if err != nil {
-		return -1, id
-	}
-
-	return int64(pointer), id
+//Takes an offset, and returns the item of the attribute chain found there
+func (db *Access) readSingleAttrItem(offset int64) (*datatypes.AttributeRecord, error) {
+	return datatypes.ReadAttributeRecord(io.NewSectionReader(db.fileHandles.attributesFile, offset, math.MaxInt64-offset))
 }
 
 //getAllIdsFromAttributeName returns all ids of objects containign attrName
 func (db *Access) getAllIdsFromAttributeName(attrName string) []string {
-	log.Printf("%s, (%s)", "getAllIdsFromAttributeName", attrName)
-	startOffset, id := db.findAttributeOffset(attrName)
-	ids := db.getAllIdsFromAttributeOffset(startOffset)
-	log.Printf("Got %d ids, but adding '%s'", len(ids), id)
-	//TODO implement a better fix, one that takes into account what's actually
-	//going on in the code
-	if id == "" {
-		return ids
+	logging.Debugf("%s, (%s)", "getAllIdsFromAttributeName", attrName)
+	//Attribute names are stored with a leading '/', see writeAttributes
+	chain, found := db.attributes.Get("/" + attrName)
+	if !found {
+		return nil
 	}
-	return append(ids, id)
+	ids := db.traverseAttributesLinkedList(chain.Head)
+	logging.Debugf("Got %d ids", len(ids))
+	return ids
 }
 
-//Inner function: exposed by two functions below.
-func (db *Access) traverseAttributesLinkedList(startOffset int64, includeIds bool) (int64, []string) {
-
+//traverseAttributesLinkedList follows the chain starting at `startOffset`, returning the ids of every item
+func (db *Access) traverseAttributesLinkedList(startOffset int64) []string {
 	var ids []string
-	offset, id := db.readSingleAttrItem(startOffset)
-	lastOffset := offset
-
-	for offset > 0 {
-		lastOffset = offset
-		if includeIds {
-			ids = append(ids, id)
+	offset := startOffset
+	for {
+		record, err := db.readSingleAttrItem(offset)
+		if err != nil {
+			log.Printf("Broken attribute chain at offset %d: %v", offset, err)
+			return ids
 		}
-		offset, id = db.readSingleAttrItem(offset)
+		ids = append(ids, record.ID)
+		//Items are always appended, so a pointer going backwards can only be corruption; stop rather than loop
+		if record.Next <= offset {
+			return ids
+		}
+		offset = record.Next
 	}
-	ids = append(ids, id)
-	//lastOffset corresponds to the beginning of the entry.
-	//As a result, needs to be shifted by ID_LEN + 1 (separator) + POINTER_SIZE
-	//UPDATE: that did not work...I feel like something in that style is required though
-	return lastOffset, ids
 }
 
-//Used for Querying data
-func (db *Access) getAllIdsFromAttributeOffset(startOffset int64) []string {
-	log.Printf("%s, (%d)", "getAllIdsFromAttributeOffset", startOffset)
-	_, ids := db.traverseAttributesLinkedList(startOffset, true)
-	return ids
-}
+//errChecksumMismatch is returned when an object read from the db file does not match the checksum in its index entry
+var errChecksumMismatch = errors.New("checksum mismatch, object is corrupted")
 
-//Used for Writing data
-func (db *Access) getAttrListTailOffset(startOffset int64) int64 {
-	offset, _ := db.traverseAttributesLinkedList(startOffset, false)
-	return offset
-}
-
-func (db *Access) readDbData(indexData *datatypes.IndexData) string {
+//readDbData reads the object described by `indexData` from the db file, checking it against its checksum
+func (db *Access) readDbData(indexData *datatypes.IndexData) (string, error) {
 	data := make([]byte, indexData.Size)
-	db.fileHandles.dbFile.ReadAt(data, int64(indexData.Offset))
-	return string(data)
+	if _, err := db.fileHandles.dbFile.ReadAt(data, int64(indexData.Offset)); err != nil {
+		return "", err
+	}
+	if datatypes.Checksum(data) != indexData.Checksum {
+		return "", errChecksumMismatch
+	}
+	return string(data), nil
 }
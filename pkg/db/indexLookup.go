@@ -0,0 +1,307 @@
+package db
+
+import (
+	"nosql-db/pkg/datatypes"
+	"nosql-db/pkg/logging"
+	"reflect"
+)
+
+//keyAfterPrefix sorts after every key starting with a given prefix: encoded values never start with 0xff
+const keyAfterPrefix = "\xff"
+
+//keyRange is a range of keys of a value index, from `from` (included unless fromExclusive) to `to`
+type keyRange struct {
+	from, to                   string
+	fromExclusive, toInclusive bool
+}
+
+func exactKeyRange(key string) keyRange {
+	return keyRange{from: key, to: key, toInclusive: true}
+}
+
+func (r keyRange) isExact() bool {
+	return r.from == r.to && !r.fromExclusive && r.toInclusive
+}
+
+//withinPrefix returns the range of compound keys starting with `prefix`, followed by a value in `r`.
+//If the index has fields after the one `r` is about (`trailing`), bounds are widened to take them in.
+func (r keyRange) withinPrefix(prefix string, trailing bool) keyRange {
+	result := keyRange{
+		from:          prefix + r.from,
+		to:            prefix + r.to,
+		fromExclusive: r.fromExclusive,
+		toInclusive:   r.toInclusive,
+	}
+	if trailing {
+		//Keys equal to a bound in this field are longer than the bound itself, whatever follows it
+		if r.fromExclusive {
+			result.from, result.fromExclusive = result.from+keyAfterPrefix, false
+		}
+		if r.toInclusive {
+			result.to, result.toInclusive = result.to+keyAfterPrefix, false
+		}
+	}
+	return result
+}
+
+//prefixKeyRange returns the range of keys starting with `prefix`
+func prefixKeyRange(prefix string) keyRange {
+	return keyRange{from: prefix, to: prefix + keyAfterPrefix}
+}
+
+//indexLookup is a lookup in a value index, answering the conditions on the first `fields` fields of the index
+type indexLookup struct {
+	index  *valueIndex
+	fields int
+	ranges []keyRange
+}
+
+//indexLookups returns the lookups of every value index able to answer some of a conjunction of conditions (attribute plans).
+//Each index answers the longest run of its leading fields it can, the planner picks among them (see planConjunction).
+func (db *Access) indexLookups(attributes []*candidatePlan) []*indexLookup {
+	var lookups []*indexLookup
+	for _, index := range db.valueIndexes {
+		if index.Building || !index.coveredBy(attributes) {
+			continue
+		}
+		if lookup := index.plan(attributes); lookup != nil {
+			lookups = append(lookups, lookup)
+		}
+	}
+	return lookups
+}
+
+//coveredBy returns true if every object satisfying `attributes` is in the index,
+//which for partial indexes means the query must include the conditions of the index's filter
+func (vi *valueIndex) coveredBy(attributes []*candidatePlan) bool {
+	for _, required := range vi.filterFields {
+		found := false
+		for _, attribute := range attributes {
+			if attribute.path == required.path && reflect.DeepEqual(attribute.condition, required.condition) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+//plan works out the lookup in the index answering the longest run of leading fields constrained by `attributes`:
+//any number of fields with exact values, possibly followed by one field with ranges of values
+func (vi *valueIndex) plan(attributes []*candidatePlan) *indexLookup {
+	prefixes := []string{""}
+	for i, field := range vi.Fields {
+		ranges, ok := fieldKeyRanges(attributes, field)
+		if !ok {
+			break
+		}
+		trailing := i < len(vi.Fields)-1
+		exact := true
+		for _, r := range ranges {
+			exact = exact && r.isExact()
+		}
+		if !exact {
+			if vi.tree == nil {
+				break
+			}
+			//Nothing can be answered past a field with a range of values
+			lookup := &indexLookup{index: vi, fields: i + 1}
+			for _, prefix := range prefixes {
+				for _, r := range ranges {
+					lookup.ranges = append(lookup.ranges, r.withinPrefix(prefix, trailing))
+				}
+			}
+			return lookup
+		}
+		var extended []string
+		for _, prefix := range prefixes {
+			for _, r := range ranges {
+				extended = append(extended, prefix+r.from)
+			}
+		}
+		prefixes = extended
+		if !trailing {
+			lookup := &indexLookup{index: vi, fields: i + 1}
+			for _, key := range prefixes {
+				lookup.ranges = append(lookup.ranges, exactKeyRange(key))
+			}
+			return lookup
+		}
+		if vi.tree == nil {
+			//Hash indexes only answer lookups of whole keys
+			continue
+		}
+		if _, ok := fieldKeyRanges(attributes, vi.Fields[i+1]); !ok {
+			lookup := &indexLookup{index: vi, fields: i + 1}
+			for _, prefix := range prefixes {
+				lookup.ranges = append(lookup.ranges, prefixKeyRange(prefix))
+			}
+			return lookup
+		}
+	}
+	return nil
+}
+
+//fieldKeyRanges returns the key ranges of the first condition on `path` among `attributes` a value index can answer
+func fieldKeyRanges(attributes []*candidatePlan, path string) ([]keyRange, bool) {
+	for _, attribute := range attributes {
+		if attribute.path != path {
+			continue
+		}
+		if ranges, ok := conditionKeyRanges(attribute.condition); ok {
+			return ranges, true
+		}
+	}
+	return nil, false
+}
+
+//each calls `fn` with the IDs of every key in the lookup's ranges
+func (l *indexLookup) each(fn func(ids []string)) {
+	for _, r := range l.ranges {
+		if l.index.tree == nil {
+			ids := make([]string, 0, len(l.index.hash[r.from]))
+			for _id := range l.index.hash[r.from] {
+				ids = append(ids, _id)
+			}
+			fn(ids)
+			continue
+		}
+		l.index.tree.Ascend(r.from, func(key string, keyIDs []string) bool {
+			if r.fromExclusive && key == r.from {
+				return true
+			}
+			if key > r.to || (key == r.to && !r.toInclusive) {
+				return false
+			}
+			fn(keyIDs)
+			return true
+		})
+	}
+}
+
+//count returns the number of IDs run would return, without collecting them
+func (l *indexLookup) count() int {
+	n := 0
+	l.each(func(ids []string) {
+		n += len(ids)
+	})
+	return n
+}
+
+//run returns the IDs of the objects with a key in any of the lookup's ranges, duplicates included
+func (l *indexLookup) run() []string {
+	logging.Debugf("Using index %s on %d field(s)", l.index.Name, l.fields)
+	var ids []string
+	l.each(func(keyIDs []string) {
+		ids = append(ids, keyIDs...)
+	})
+	return ids
+}
+
+//conditionKeyRanges returns the ranges of index keys holding every value `cond` can hold for.
+//Returns false if the condition can hold for objects not in the index (missing values, $ne...)
+//or the ranges cannot be worked out.
+func conditionKeyRanges(cond condition) ([]keyRange, bool) {
+	switch c := cond.(type) {
+	case *comparisonCondition:
+		return comparisonKeyRanges(c.op, c.value)
+	case *membershipCondition:
+		if c.negated {
+			return nil, false
+		}
+		var ranges []keyRange
+		for _, value := range c.values {
+			if value == nil {
+				return nil, false
+			}
+			ranges = append(ranges, exactKeyRange(datatypes.EncodeIndexKey(value)))
+		}
+		return ranges, true
+	case *allCondition:
+		//Objects holding every value hold the first one
+		if len(c.values) == 0 || c.values[0] == nil {
+			return nil, false
+		}
+		return []keyRange{exactKeyRange(datatypes.EncodeIndexKey(c.values[0]))}, true
+	case allConditions:
+		//Each condition may hold for a different element of an array, so their ranges cannot be intersected:
+		//any one of them narrows things down enough
+		for _, child := range c {
+			if ranges, ok := conditionKeyRanges(child); ok {
+				return ranges, true
+			}
+		}
+	case *elemMatchCondition:
+		//Unlike above, every condition holds for the same element
+		if c.condition != nil {
+			return intersectedKeyRanges(c.condition)
+		}
+	}
+	return nil, false
+}
+
+func comparisonKeyRanges(op string, value interface{}) ([]keyRange, bool) {
+	if op == "$eq" {
+		if value == nil {
+			//null also matches objects missing the attribute, which are not in the index
+			return nil, false
+		}
+		return []keyRange{exactKeyRange(datatypes.EncodeIndexKey(value))}, true
+	}
+	switch value.(type) {
+	case float64, string, bool:
+	default:
+		//Only numbers, strings and booleans are ordered
+		return nil, false
+	}
+	key := datatypes.EncodeIndexKey(value)
+	//Values are only ever compared with values of the same type
+	typeFrom, typeTo := datatypes.IndexKeyTypeBounds(value)
+	switch op {
+	case "$gt", "$gte":
+		return []keyRange{{from: key, to: typeTo, fromExclusive: op == "$gt"}}, true
+	case "$lt", "$lte":
+		return []keyRange{{from: typeFrom, to: key, toInclusive: op == "$lte"}}, true
+	}
+	return nil, false
+}
+
+//intersectedKeyRanges returns the key ranges of conditions all holding for the same value, as in $elemMatch
+func intersectedKeyRanges(cond condition) ([]keyRange, bool) {
+	conditions, ok := cond.(allConditions)
+	if !ok {
+		return conditionKeyRanges(cond)
+	}
+	var result *keyRange
+	for _, child := range conditions {
+		ranges, ok := conditionKeyRanges(child)
+		if !ok {
+			continue
+		}
+		if len(ranges) != 1 {
+			//Several ranges ($in) are not worth intersecting
+			if result == nil {
+				return ranges, true
+			}
+			continue
+		}
+		r := ranges[0]
+		if result == nil {
+			result = &r
+			continue
+		}
+		if r.from > result.from || (r.from == result.from && r.fromExclusive) {
+			result.from, result.fromExclusive = r.from, r.fromExclusive
+		}
+		if r.to < result.to || (r.to == result.to && !r.toInclusive) {
+			result.to, result.toInclusive = r.to, r.toInclusive
+		}
+	}
+	if result == nil {
+		return nil, false
+	}
+	return []keyRange{*result}, true
+}
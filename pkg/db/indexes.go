@@ -0,0 +1,625 @@
+package db
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"nosql-db/pkg/datatypes"
+	"nosql-db/pkg/logging"
+	"nosql-db/pkg/util"
+	"os"
+	"sort"
+)
+
+//Types of value indexes
+const (
+	//IndexTypeHash indexes answer equality (and $in) conditions
+	IndexTypeHash = "hash"
+	//IndexTypeBTree indexes keep their keys ordered, and also answer range conditions ($gt, $lte...)
+	IndexTypeBTree = "btree"
+)
+
+//indexBuildBatchSize is the number of objects indexed at a time by a background index build,
+//between which writes can go through
+const indexBuildBatchSize = 500
+
+//States of value indexes, as reported by Indexes
+const (
+	IndexStateBuilding = "building"
+	IndexStateReady    = "ready"
+)
+
+//IndexSpec declares a value index: objects are indexed on the values found at each of Fields (dotted paths).
+//Like queries, paths descend into arrays, and every element of an array is indexed.
+//Compound indexes (several fields) answer conditions on a leading run of their fields, as in
+//    {"tenant": "acme", "createdAt": {"$gt": 1600000000}}
+//for an index on ["tenant", "createdAt"].
+//
+//If Filter (a query) is set, the index is partial: only objects matching it are indexed,
+//and it is only used by queries including the same conditions.
+//
+//Unique indexes reject writes giving an object the same key as another one (see DuplicateKeyError).
+//Objects missing every field of the index, or left out by its filter, are not constrained.
+type IndexSpec struct {
+	Name   string       `json:"name"`
+	Fields []string     `json:"fields"`
+	Type   string       `json:"type"`
+	Filter datatypes.JS `json:"filter,omitempty"`
+	Unique bool         `json:"unique,omitempty"`
+}
+
+//DuplicateKeyError is returned by writes which would break a unique index
+type DuplicateKeyError struct {
+	Index string
+	//Key maps each field of the index to the value already taken
+	Key datatypes.JS
+	//ID is the (user-space) id of the object already holding the key
+	ID string
+}
+
+func (e *DuplicateKeyError) Error() string {
+	key, _ := json.Marshal(e.Key)
+	return fmt.Sprintf("duplicate key %s in unique index %s, already used by object %s", key, e.Index, e.ID)
+}
+
+//Unwrap makes duplicate keys ErrConflict errors
+func (e *DuplicateKeyError) Unwrap() error {
+	return ErrConflict
+}
+
+//IndexInfo describes a value index of a collection
+type IndexInfo struct {
+	IndexSpec
+	State string `json:"state"`
+}
+
+//indexDefinition is an IndexSpec as saved in the index definitions file.
+//Number identifies the index's records in the value index file; it is never reused for another index
+//while records of the previous one may still be around.
+type indexDefinition struct {
+	IndexSpec
+	Number uint32 `json:"number"`
+	//Building is true until every object already in the collection when the index was created is indexed.
+	//Building indexes are maintained, but not used by queries.
+	Building bool `json:"building,omitempty"`
+	//Path is the single field of indexes defined before compound indexes were supported
+	Path string `json:"path,omitempty"`
+}
+
+//valueIndex maps values found in objects to the IDs of those objects.
+//Unlike the attribute chains, which only know which objects have an attribute, value indexes know which objects
+//have a given value, so queries only load the objects which can match.
+type valueIndex struct {
+	indexDefinition
+	//filter and filterFields (its conditions) are only set for partial indexes
+	filter       Filter
+	filterFields []*fieldFilter
+	//Only one of hash or tree is used, depending on the type of index
+	hash map[string]map[string]struct{}
+	tree *datatypes.BTree
+	//keys maps each _id to its keys in the index, so they can be removed when the object changes
+	keys map[string][]string
+}
+
+func newValueIndex(definition indexDefinition) (*valueIndex, error) {
+	if len(definition.Fields) == 0 && definition.Path != "" {
+		definition.Fields = []string{definition.Path}
+		definition.Path = ""
+	}
+	index := &valueIndex{
+		indexDefinition: definition,
+		keys:            make(map[string][]string),
+	}
+	if definition.Filter != nil {
+		//Filters decoded from JSON hold plain maps, which queries do not expect
+		filter, err := ParseQuery(util.ConvertToJSON(definition.Filter))
+		if err != nil {
+			return nil, err
+		}
+		fields, ok := conjunctionFields(filter)
+		if !ok {
+			return nil, newError(ErrInvalidDocument, "the filter of a partial index can only hold conditions on attributes, "+
+				"implicitly ANDed")
+		}
+		index.filter, index.filterFields = filter, fields
+	}
+	if definition.Type == IndexTypeBTree {
+		index.tree = datatypes.NewBTree()
+	} else {
+		index.hash = make(map[string]map[string]struct{})
+	}
+	return index, nil
+}
+
+//conjunctionFields returns the conditions of a filter made of conditions on attributes (possibly nested in $and)
+func conjunctionFields(filter Filter) ([]*fieldFilter, bool) {
+	switch f := filter.(type) {
+	case *fieldFilter:
+		return []*fieldFilter{f}, true
+	case andFilter:
+		var fields []*fieldFilter
+		for _, child := range f {
+			childFields, ok := conjunctionFields(child)
+			if !ok {
+				return nil, false
+			}
+			fields = append(fields, childFields...)
+		}
+		return fields, true
+	}
+	return nil, false
+}
+
+//keysOf returns the keys of `data` in the index, none if it is left out by the filter of a partial index.
+//Each field is encoded in turn into compound keys. A field holding an array contributes each of its elements
+//(so there is a key for every combination), and a missing field contributes null, unless every field is missing.
+func (vi *valueIndex) keysOf(data datatypes.JS) []string {
+	if vi.filter != nil && !vi.filter.Match(data) {
+		return nil
+	}
+	keys := []string{""}
+	found := false
+	for _, field := range vi.Fields {
+		var fieldKeys []string
+		seen := make(map[string]struct{})
+		for _, value := range expandArrays(util.ResolvePath(data, field)) {
+			key := datatypes.EncodeIndexKey(value)
+			if _, ok := seen[key]; !ok {
+				seen[key] = struct{}{}
+				fieldKeys = append(fieldKeys, key)
+			}
+		}
+		if len(fieldKeys) == 0 {
+			fieldKeys = []string{datatypes.EncodeIndexKey(nil)}
+		} else {
+			found = true
+		}
+
+		var combined []string
+		for _, prefix := range keys {
+			for _, key := range fieldKeys {
+				combined = append(combined, prefix+key)
+			}
+		}
+		keys = combined
+	}
+	if !found {
+		return nil
+	}
+	return keys
+}
+
+//set replaces the keys of `_id` in the index by `keys`
+func (vi *valueIndex) set(_id string, keys []string) {
+	vi.unset(_id)
+	if len(keys) == 0 {
+		return
+	}
+	for _, key := range keys {
+		if vi.tree != nil {
+			vi.tree.Add(key, _id)
+			continue
+		}
+		if vi.hash[key] == nil {
+			vi.hash[key] = make(map[string]struct{})
+		}
+		vi.hash[key][_id] = struct{}{}
+	}
+	vi.keys[_id] = keys
+}
+
+//idsWithKey returns the IDs of the objects having `key` in the index
+func (vi *valueIndex) idsWithKey(key string) []string {
+	if vi.tree != nil {
+		return vi.tree.Get(key)
+	}
+	var ids []string
+	for _id := range vi.hash[key] {
+		ids = append(ids, _id)
+	}
+	return ids
+}
+
+//unset removes `_id` from the index
+func (vi *valueIndex) unset(_id string) {
+	for _, key := range vi.keys[_id] {
+		if vi.tree != nil {
+			vi.tree.Remove(key, _id)
+			continue
+		}
+		delete(vi.hash[key], _id)
+		if len(vi.hash[key]) == 0 {
+			delete(vi.hash, key)
+		}
+	}
+	delete(vi.keys, _id)
+}
+
+//indexDocument sets the keys of `_id` in every value index, as found in `data`
+func (db *Access) indexDocument(_id string, data datatypes.JS) {
+	for _, index := range db.valueIndexes {
+		db.indexDocumentIn(index, _id, data)
+	}
+	if len(db.valueIndexes) > 0 {
+		db.syncFile(db.fileHandles.valueIndexFile)
+	}
+}
+
+//unindexDocument removes `_id` from every value index
+func (db *Access) unindexDocument(_id string) {
+	for _, index := range db.valueIndexes {
+		index.unset(_id)
+		db.writeValueIndexRecord(&datatypes.ValueIndexRecord{Index: index.Number, ID: _id, Deleted: true})
+	}
+	if len(db.valueIndexes) > 0 {
+		db.syncFile(db.fileHandles.valueIndexFile)
+	}
+}
+
+//writeValueIndexRecord appends `record` to the value index file
+func (db *Access) writeValueIndexRecord(record *datatypes.ValueIndexRecord) {
+	offset := int64(getFileSize(db.fileHandles.valueIndexFile))
+	if _, err := db.fileHandles.valueIndexFile.WriteAt(record.WriteableRepr(), offset); err != nil {
+		fail(err)
+	}
+}
+
+//checkUniqueIndexes returns a DuplicateKeyError if writing `data` as `_id` would give it the same key
+//as another object in a unique index. Must be called under the write lock, along with the write itself.
+func (db *Access) checkUniqueIndexes(_id string, data datatypes.JS) error {
+	for _, index := range db.valueIndexes {
+		if !index.Unique {
+			continue
+		}
+		if err := db.checkUniqueKeys(index, _id, index.keysOf(data)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//checkUniqueBatch returns a DuplicateKeyError if writing every object in `objects` at once, `ids` being their _ids,
+//would break a unique index. Objects of the batch may take the keys others of the batch give up, but not share one.
+func (db *Access) checkUniqueBatch(ids []string, objects []datatypes.JS) error {
+	inBatch := make(map[string]bool, len(ids))
+	for _, _id := range ids {
+		inBatch[_id] = true
+	}
+	for _, index := range db.valueIndexes {
+		if !index.Unique {
+			continue
+		}
+		//Keys of the batch, and the _id of the object of the batch holding each
+		holders := make(map[string]string)
+		for i, _id := range ids {
+			for _, key := range index.keysOf(objects[i]) {
+				if holder, found := holders[key]; found && holder != _id {
+					return db.duplicateKey(index, key, holder)
+				}
+				holders[key] = _id
+				//Objects of the batch holding the key now have their new keys checked instead
+				for _, other := range index.idsWithKey(key) {
+					if other != _id && !inBatch[other] {
+						return db.duplicateKey(index, key, other)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (db *Access) checkUniqueKeys(index *valueIndex, _id string, keys []string) error {
+	for _, key := range keys {
+		for _, other := range index.idsWithKey(key) {
+			if other != _id {
+				return db.duplicateKey(index, key, other)
+			}
+		}
+	}
+	return nil
+}
+
+//duplicateKey returns the error for `key` of `index` being already held by the object with _id `other`
+func (db *Access) duplicateKey(index *valueIndex, key, other string) error {
+	err := &DuplicateKeyError{Index: index.Name, Key: datatypes.JS{}, ID: other}
+	for i, value := range datatypes.DecodeIndexKey(key) {
+		err.Key[index.Fields[i]] = value
+	}
+	if obj, readErr := db.getSingleObjectFromID(other); readErr == nil {
+		err.ID, _ = obj["id"].(string)
+	}
+	return err
+}
+
+//indexDocumentIn sets the keys of `_id` in `index`, as found in `data`
+func (db *Access) indexDocumentIn(index *valueIndex, _id string, data datatypes.JS) {
+	keys := index.keysOf(data)
+	index.set(_id, keys)
+	db.writeValueIndexRecord(&datatypes.ValueIndexRecord{Index: index.Number, ID: _id, Keys: keys})
+}
+
+//CreateIndex creates a value index. Objects already in the collection are indexed in the background,
+//the index is only used by queries once they all are (see Indexes).
+func (db *Access) CreateIndex(spec IndexSpec) (info IndexInfo, err error) {
+	if err := db.failed(); err != nil {
+		return IndexInfo{}, err
+	}
+	defer db.recoverFailure(&err)
+	if spec.Name == "" || len(spec.Fields) == 0 {
+		return IndexInfo{}, newError(ErrInvalidDocument, "an index needs a name and at least one field")
+	}
+	for _, field := range spec.Fields {
+		if field == "" {
+			return IndexInfo{}, newError(ErrInvalidDocument, "index fields cannot be empty")
+		}
+	}
+	if spec.Type == "" {
+		spec.Type = IndexTypeHash
+	}
+	if spec.Type != IndexTypeHash && spec.Type != IndexTypeBTree {
+		return IndexInfo{}, newError(ErrInvalidDocument, "unknown index type '%s'", spec.Type)
+	}
+
+	//A compaction running meanwhile would swap in value indexes without this one
+	db.compactionLock.Lock()
+	defer db.compactionLock.Unlock()
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if _, ok := db.valueIndexes[spec.Name]; ok {
+		return IndexInfo{}, newError(ErrConflict, "index '%s' already exists", spec.Name)
+	}
+	//Unique indexes are built right away, so objects already breaking the constraint fail the creation
+	index, err := newValueIndex(indexDefinition{IndexSpec: spec, Number: db.nextIndexNumber, Building: !spec.Unique})
+	if err != nil {
+		return IndexInfo{}, err
+	}
+	db.nextIndexNumber++
+	if spec.Unique {
+		if err := db.fillUniqueIndex(index); err != nil {
+			return IndexInfo{}, err
+		}
+	}
+	db.valueIndexes[spec.Name] = index
+	db.saveIndexDefinitions()
+	logging.Infof("Created index %s on %s %v", spec.Name, db.entry.name, spec.Fields)
+
+	if index.Building {
+		go db.buildIndex(spec.Name, index.Number)
+	}
+	return index.info(), nil
+}
+
+//fillUniqueIndex indexes every object of the collection in `index`, stopping at the first duplicate key.
+//Records already written for the index are left for compaction to drop, its number is not reused.
+func (db *Access) fillUniqueIndex(index *valueIndex) error {
+	defer db.syncFile(db.fileHandles.valueIndexFile)
+	for _, _id := range db.indexTable.GetAllIds() {
+		obj, err := db.getSingleObjectFromID(_id)
+		if err != nil {
+			continue
+		}
+		if err := db.checkUniqueKeys(index, _id, index.keysOf(obj)); err != nil {
+			return err
+		}
+		db.indexDocumentIn(index, _id, obj)
+	}
+	return nil
+}
+
+//buildIndex indexes the objects of the collection in batches, then marks the index as ready.
+//Objects written meanwhile are indexed by the writes themselves. The index is looked up again for every batch,
+//as a compaction may have swapped it for a new one, or it may have been dropped.
+func (db *Access) buildIndex(name string, number uint32) {
+	//Failures are logged and mark the collection as failed, there is no one else to tell
+	var err error
+	defer db.recoverFailure(&err)
+	var ids []string
+	db.readLocked(func() {
+		ids = db.indexTable.GetAllIds()
+	})
+
+	current := func() *valueIndex {
+		if index, ok := db.valueIndexes[name]; ok && index.Number == number {
+			return index
+		}
+		logging.Infof("Index %s of %s was dropped while building", name, db.entry.name)
+		return nil
+	}
+
+	for start := 0; start < len(ids); start += indexBuildBatchSize {
+		end := start + indexBuildBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		if !db.indexBatch(current, ids[start:end]) {
+			return
+		}
+	}
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if db.failed() != nil {
+		return
+	}
+	if index := current(); index != nil {
+		index.Building = false
+		db.saveIndexDefinitions()
+		logging.Infof("Built index %s of %s (%d objects)", name, db.entry.name, len(index.keys))
+	}
+}
+
+//indexBatch indexes the objects in `ids` in the index returned by `current`.
+//Returns false if the build must stop: the index is gone, or the collection was closed meanwhile.
+func (db *Access) indexBatch(current func() *valueIndex, ids []string) bool {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if db.failed() != nil {
+		return false
+	}
+	index := current()
+	if index == nil {
+		return false
+	}
+	for _, _id := range ids {
+		//Reading the object under the lock gets its latest version; objects since deleted are skipped
+		if obj, err := db.getSingleObjectFromID(_id); err == nil {
+			db.indexDocumentIn(index, _id, obj)
+		}
+	}
+	db.syncFile(db.fileHandles.valueIndexFile)
+	return true
+}
+
+//resumeIndexBuilds restarts the builds of indexes which were still building when the collection was closed
+func (db *Access) resumeIndexBuilds() {
+	for name, index := range db.valueIndexes {
+		if index.Building {
+			go db.buildIndex(name, index.Number)
+		}
+	}
+}
+
+//DropIndex removes a value index. Its records are left in the value index file until the next compaction.
+func (db *Access) DropIndex(name string) (err error) {
+	if err := db.failed(); err != nil {
+		return err
+	}
+	defer db.recoverFailure(&err)
+	db.compactionLock.Lock()
+	defer db.compactionLock.Unlock()
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if _, ok := db.valueIndexes[name]; !ok {
+		return newError(ErrNotFound, "no index named '%s'", name)
+	}
+	delete(db.valueIndexes, name)
+	db.saveIndexDefinitions()
+	return nil
+}
+
+//Indexes returns the value indexes of the collection, sorted by name
+func (db *Access) Indexes() []IndexInfo {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	infos := make([]IndexInfo, 0, len(db.valueIndexes))
+	for _, index := range db.valueIndexes {
+		infos = append(infos, index.info())
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+func (vi *valueIndex) info() IndexInfo {
+	state := IndexStateReady
+	if vi.Building {
+		state = IndexStateBuilding
+	}
+	return IndexInfo{IndexSpec: vi.IndexSpec, State: state}
+}
+
+//saveIndexDefinitions writes the definitions of the value indexes to the index definitions file.
+//The file is replaced in one go (rename), so a crash leaves either the old or the new definitions.
+func (db *Access) saveIndexDefinitions() {
+	definitions := make([]indexDefinition, 0, len(db.valueIndexes))
+	for _, index := range db.valueIndexes {
+		definitions = append(definitions, index.indexDefinition)
+	}
+	data, err := json.Marshal(definitions)
+	if err != nil {
+		fail(err)
+	}
+	path := db.entry.filesPath() + datatypes.IndexDefinitionsFileExtension
+	if err := ioutil.WriteFile(path+compactSuffix, data, 0755); err != nil {
+		fail(err)
+	}
+	syncPath(path + compactSuffix)
+	if err := os.Rename(path+compactSuffix, path); err != nil {
+		fail(err)
+	}
+}
+
+//loadIndexDefinitions returns empty value indexes for the definitions in the index definitions file of `base`
+func loadIndexDefinitions(base string) map[string]*valueIndex {
+	indexes := make(map[string]*valueIndex)
+	data, err := ioutil.ReadFile(base + datatypes.IndexDefinitionsFileExtension)
+	if os.IsNotExist(err) {
+		return indexes
+	}
+	var definitions []indexDefinition
+	if err == nil {
+		err = json.Unmarshal(data, &definitions)
+	}
+	if err != nil {
+		failf("Cannot load index definitions of %s: %v", base, err)
+	}
+	for _, definition := range definitions {
+		index, err := newValueIndex(definition)
+		if err != nil {
+			failf("Cannot load index %s of %s: %v", definition.Name, base, err)
+		}
+		indexes[index.Name] = index
+	}
+	return indexes
+}
+
+//loadValueIndexes fills the value indexes from the value index file.
+//If the file cannot be read through, the indexes are rebuilt from the objects themselves.
+func (db *Access) loadValueIndexes() {
+	db.valueIndexes = loadIndexDefinitions(db.entry.filesPath())
+	byNumber := make(map[uint32]*valueIndex)
+	for _, index := range db.valueIndexes {
+		byNumber[index.Number] = index
+		if index.Number >= db.nextIndexNumber {
+			db.nextIndexNumber = index.Number + 1
+		}
+	}
+
+	file := db.fileHandles.valueIndexFile
+	size := int64(getFileSize(file))
+	reader := bufio.NewReader(io.NewSectionReader(file, datatypes.FileHeaderSize, size))
+	for {
+		record, err := datatypes.ReadValueIndexRecord(reader)
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			log.Printf("Cannot read value index file of %s (%v), rebuilding value indexes", db.entry.name, err)
+			db.rebuildValueIndexes()
+			return
+		}
+		//Records of dropped indexes are skipped, but their number must not be handed out again
+		if record.Index >= db.nextIndexNumber {
+			db.nextIndexNumber = record.Index + 1
+		}
+		index, ok := byNumber[record.Index]
+		if !ok {
+			continue
+		}
+		if record.Deleted {
+			index.unset(record.ID)
+		} else {
+			index.set(record.ID, record.Keys)
+		}
+	}
+}
+
+//rebuildValueIndexes empties the value index file, then indexes every object again
+func (db *Access) rebuildValueIndexes() {
+	if err := db.fileHandles.valueIndexFile.Truncate(datatypes.FileHeaderSize); err != nil {
+		fail(err)
+	}
+	for name, index := range db.valueIndexes {
+		db.valueIndexes[name], _ = newValueIndex(index.indexDefinition)
+	}
+	for _, _id := range db.indexTable.GetAllIds() {
+		if obj, err := db.getSingleObjectFromID(_id); err == nil {
+			db.indexDocument(_id, obj)
+		}
+	}
+}
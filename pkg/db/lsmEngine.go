@@ -0,0 +1,713 @@
+package db
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"nosql-db/pkg/datatypes"
+	"nosql-db/pkg/logging"
+	"nosql-db/pkg/util"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+//LSMOptions tunes an LSMEngine. Zero values are replaced by defaults.
+type LSMOptions struct {
+	//MemtableSize is how many bytes of records the memtable holds before being flushed to a segment file
+	MemtableSize int
+	//MergeThreshold is how many segment files there may be before they get merged in the background
+	MergeThreshold int
+	//NoSync leaves flushing the memtable log to the operating system, see FsyncNever
+	NoSync bool
+}
+
+//Defaults of LSMOptions
+const (
+	defaultMemtableSize   = 4 << 20
+	defaultMergeThreshold = 4
+)
+
+//lsmManifest lists the segment files of an LSM collection, oldest first
+type lsmManifest struct {
+	Segments []string `json:"segments"`
+	//Next is the number of the next segment file to be written
+	Next int `json:"next"`
+}
+
+//LSMEngine is a log-structured merge storage engine, for write-heavy collections.
+//Writes go to a log, then to the memtable (in memory). Once full, the memtable is flushed to an immutable
+//segment file sorted by id, and segments are merged in the background once there are enough of them.
+//Reading an object goes through the memtable, then the segments from newest to oldest, skipping the segments
+//whose bloom filter rules the id out. Like MemoryEngine, it has no value indexes.
+type LSMEngine struct {
+	lock    sync.RWMutex
+	base    string
+	options LSMOptions
+	idGen   *IdGen
+
+	memtable     map[string]*datatypes.LSMRecord
+	memtableSize int
+	memlog       *os.File
+
+	//segments are ordered oldest first
+	segments    []*lsmSegment
+	nextSegment int
+	merging     bool
+	merges      sync.WaitGroup
+	closed      bool
+}
+
+//OpenLSMEngine opens the LSM collection whose files start with `base`, creating it if needed.
+//Segment files left over by an interrupted flush or merge are removed, and the memtable is rebuilt from its log.
+func OpenLSMEngine(base string, options LSMOptions) (*LSMEngine, error) {
+	if options.MemtableSize <= 0 {
+		options.MemtableSize = defaultMemtableSize
+	}
+	if options.MergeThreshold <= 1 {
+		options.MergeThreshold = defaultMergeThreshold
+	}
+	e := &LSMEngine{
+		base:     base,
+		options:  options,
+		idGen:    NewIDGen(),
+		memtable: make(map[string]*datatypes.LSMRecord),
+	}
+
+	manifest, err := e.loadManifest()
+	if err != nil {
+		return nil, err
+	}
+	e.nextSegment = manifest.Next
+	listed := make(map[string]bool)
+	for _, name := range manifest.Segments {
+		segment, err := openSegment(filepath.Join(filepath.Dir(base), name))
+		if err != nil {
+			e.closeSegments()
+			return nil, err
+		}
+		e.segments = append(e.segments, segment)
+		listed[name] = true
+	}
+	leftovers, _ := filepath.Glob(base + "-*" + datatypes.LSMSegmentExtension)
+	for _, path := range leftovers {
+		if !listed[filepath.Base(path)] {
+			logging.Infof("Removing unlisted segment file %s", path)
+			os.Remove(path)
+		}
+	}
+
+	if err := e.replayLog(); err != nil {
+		e.closeSegments()
+		return nil, err
+	}
+	return e, nil
+}
+
+//loadManifest reads the manifest, writing an empty one for new collections
+func (e *LSMEngine) loadManifest() (lsmManifest, error) {
+	manifest := lsmManifest{Next: 1}
+	data, err := ioutil.ReadFile(e.base + datatypes.LSMManifestExtension)
+	if os.IsNotExist(err) {
+		return manifest, e.saveManifest()
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &manifest)
+	}
+	return manifest, err
+}
+
+//saveManifest atomically replaces the manifest with the current list of segments
+func (e *LSMEngine) saveManifest() (err error) {
+	defer recoverFailure(&err)
+	manifest := lsmManifest{Segments: []string{}, Next: e.nextSegment}
+	if manifest.Next == 0 {
+		manifest.Next = 1
+	}
+	for _, segment := range e.segments {
+		manifest.Segments = append(manifest.Segments, filepath.Base(segment.path))
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	path := e.base + datatypes.LSMManifestExtension
+	if err := ioutil.WriteFile(path+compactSuffix, data, 0755); err != nil {
+		return err
+	}
+	syncPath(path + compactSuffix)
+	return os.Rename(path+compactSuffix, path)
+}
+
+//replayLog opens the memtable log and puts its records back in the memtable.
+//A torn record at the tail (crash while logging) is cut off: its write was never acknowledged.
+func (e *LSMEngine) replayLog() (err error) {
+	defer recoverFailure(&err)
+	file, err := os.OpenFile(e.base+datatypes.LSMLogExtension, os.O_CREATE|os.O_RDWR, 0755)
+	if err != nil {
+		return err
+	}
+	e.memlog = file
+	if getFileSize(file) == 0 {
+		return e.resetLog()
+	}
+	header := make([]byte, datatypes.FileHeaderSize)
+	if _, err := file.ReadAt(header, 0); err != nil {
+		return err
+	}
+	if _, err := datatypes.ParseFileHeader(header, datatypes.LSMLogMagic); err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(io.NewSectionReader(file, datatypes.FileHeaderSize, int64(getFileSize(file))-datatypes.FileHeaderSize))
+	end := int64(datatypes.FileHeaderSize)
+	for {
+		record, err := datatypes.ReadLSMRecord(r)
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("Discarding incomplete memtable log record at offset %d", end)
+				file.Truncate(end)
+			}
+			break
+		}
+		end += int64(len(record.WriteableRepr()))
+		e.addToMemtable(record)
+	}
+	return nil
+}
+
+//resetLog empties the memtable log
+func (e *LSMEngine) resetLog() error {
+	if err := e.memlog.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := e.memlog.WriteAt(datatypes.FileHeader(datatypes.LSMLogMagic), 0); err != nil {
+		return err
+	}
+	return e.memlog.Sync()
+}
+
+func (e *LSMEngine) addToMemtable(record *datatypes.LSMRecord) {
+	e.memtable[record.Key] = record
+	e.memtableSize += len(record.Key) + len(record.Value)
+}
+
+//put durably logs `records`, then adds them to the memtable, flushing it once full
+func (e *LSMEngine) put(records ...*datatypes.LSMRecord) (err error) {
+	if e.closed {
+		return ErrClosed
+	}
+	defer recoverFailure(&err)
+	var data []byte
+	for _, record := range records {
+		data = append(data, record.WriteableRepr()...)
+	}
+	if _, err := e.memlog.WriteAt(data, int64(getFileSize(e.memlog))); err != nil {
+		return err
+	}
+	if !e.options.NoSync {
+		if err := e.memlog.Sync(); err != nil {
+			return err
+		}
+	}
+	for _, record := range records {
+		e.addToMemtable(record)
+	}
+	if e.memtableSize >= e.options.MemtableSize {
+		return e.flush()
+	}
+	return nil
+}
+
+//segmentPath returns the path of the segment file numbered `number`
+func (e *LSMEngine) segmentPath(number int) string {
+	return fmt.Sprintf("%s-%06d%s", e.base, number, datatypes.LSMSegmentExtension)
+}
+
+//flush writes the memtable to a new segment file and empties it. Must be called with the lock held.
+//The segment is only listed in the manifest once complete, and the log only emptied once it is listed.
+func (e *LSMEngine) flush() error {
+	if len(e.memtable) == 0 {
+		return nil
+	}
+	path := e.segmentPath(e.nextSegment)
+	writer, err := newSegmentWriter(path, len(e.memtable))
+	if err != nil {
+		return err
+	}
+	for _, record := range e.sortedMemtable() {
+		writer.add(record)
+	}
+	if err := writer.finish(); err != nil {
+		writer.abort()
+		return err
+	}
+	segment, err := openSegment(path)
+	if err != nil {
+		return err
+	}
+	e.nextSegment++
+	e.segments = append(e.segments, segment)
+	if err := e.saveManifest(); err != nil {
+		return err
+	}
+	if err := e.resetLog(); err != nil {
+		return err
+	}
+	e.memtable = make(map[string]*datatypes.LSMRecord)
+	e.memtableSize = 0
+	e.mergeIfNeeded()
+	return nil
+}
+
+//mergeIfNeeded starts merging the segments in the background if there are enough of them,
+//unless a merge is already running. Must be called with the lock held.
+func (e *LSMEngine) mergeIfNeeded() {
+	if len(e.segments) >= e.options.MergeThreshold && !e.merging && !e.closed {
+		e.merging = true
+		e.merges.Add(1)
+		go e.merge(e.segments, e.nextSegment)
+		e.nextSegment++
+	}
+}
+
+//sortedMemtable returns the records of the memtable, sorted by key
+func (e *LSMEngine) sortedMemtable() []*datatypes.LSMRecord {
+	records := make([]*datatypes.LSMRecord, 0, len(e.memtable))
+	for _, record := range e.memtable {
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Key < records[j].Key })
+	return records
+}
+
+//merge rewrites `victims`, the oldest segments, into a single segment file numbered `number`, without holding the lock.
+//No older segment can hold a key of the victims, so deletions are dropped rather than carried over.
+//Segments flushed meanwhile are newer than the victims, and are kept after the merged segment.
+func (e *LSMEngine) merge(victims []*lsmSegment, number int) {
+	defer e.merges.Done()
+	merged, err := e.writeMerged(victims, number)
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.merging = false
+	if err != nil {
+		log.Printf("Merging segments of %s failed: %v", e.base, err)
+		return
+	}
+	if e.closed {
+		//The victims stay listed in the manifest, the merged segment is dropped
+		if merged != nil {
+			merged.close(true)
+		}
+		return
+	}
+	segments := make([]*lsmSegment, 0, len(e.segments)-len(victims)+1)
+	if merged != nil {
+		segments = append(segments, merged)
+	}
+	e.segments = append(segments, e.segments[len(victims):]...)
+	if err := e.saveManifest(); err != nil {
+		log.Printf("Merging segments of %s failed: %v", e.base, err)
+		return
+	}
+	//No reader can be going through the victims: they hold the lock while reading
+	for _, segment := range victims {
+		segment.close(true)
+	}
+	logging.Infof("Merged %d segments of %s", len(victims), e.base)
+	//Flushes may have outrun the merge
+	e.mergeIfNeeded()
+}
+
+//writeMerged writes the merged segment, returning nil if every record of the victims was a deletion
+func (e *LSMEngine) writeMerged(victims []*lsmSegment, number int) (*lsmSegment, error) {
+	cursors := make([]*lsmCursor, 0, len(victims))
+	keys := 0
+	for i := len(victims) - 1; i >= 0; i-- {
+		cursors = append(cursors, victims[i].cursor())
+		keys += int(victims[i].records)
+	}
+	path := e.segmentPath(number)
+	writer, err := newSegmentWriter(path, keys)
+	if err != nil {
+		return nil, err
+	}
+	err = mergeRecords(cursors, func(record *datatypes.LSMRecord) bool {
+		if !record.Deleted {
+			writer.add(record)
+		}
+		return true
+	})
+	if err == nil {
+		err = writer.finish()
+	}
+	if err != nil || writer.count == 0 {
+		writer.abort()
+		return nil, err
+	}
+	return openSegment(path)
+}
+
+//get returns the JSON of the object with id `id`, nil if there is none
+func (e *LSMEngine) get(id string) ([]byte, error) {
+	record, found := e.memtable[id]
+	for i := len(e.segments) - 1; !found && i >= 0; i-- {
+		var err error
+		if record, err = e.segments[i].get(id); err != nil {
+			return nil, err
+		}
+		found = record != nil
+	}
+	if !found || record.Deleted {
+		return nil, nil
+	}
+	return record.Value, nil
+}
+
+//each calls `fn` with the JSON of every object, in id order, until it returns false
+func (e *LSMEngine) each(fn func(jsonData []byte) bool) error {
+	cursors := []*lsmCursor{sliceCursor(e.sortedMemtable())}
+	for i := len(e.segments) - 1; i >= 0; i-- {
+		cursors = append(cursors, e.segments[i].cursor())
+	}
+	return mergeRecords(cursors, func(record *datatypes.LSMRecord) bool {
+		return record.Deleted || fn(record.Value)
+	})
+}
+
+//Write an object, given an id if it has none. `data` is a raw JSON string
+func (e *LSMEngine) Write(data string) (string, error) {
+	dat, err := parseDocument(data)
+	if err != nil {
+		return "", err
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.store(dat, data)
+}
+
+//store writes `dat`, parsed from `data`, giving it an id if it has none. Must be called with the lock held.
+func (e *LSMEngine) store(dat datatypes.JS, data string) (string, error) {
+	var id string
+	if value, found := dat["id"]; found {
+		var ok bool
+		if id, ok = value.(string); !ok {
+			return "", newError(ErrInvalidDocument, "id must be a string")
+		}
+	} else {
+		id = e.idGen.GetID(data)
+		dat["id"] = id
+	}
+	jsonData, err := json.Marshal(dat)
+	if err != nil {
+		return "", err
+	}
+	if err := e.put(&datatypes.LSMRecord{Key: id, Value: jsonData}); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+//Read the objects matching the query in `data`
+func (e *LSMEngine) Read(data string) ([]datatypes.JS, error) {
+	if len(data) == 0 {
+		return nil, newError(ErrInvalidDocument, "Empty request")
+	}
+	query, err := parseDocument(data)
+	if err != nil {
+		return nil, err
+	}
+
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	return e.findObjects(query, &Explain{})
+}
+
+//Find returns a page of the objects matching the query in `data`, see Access.Find
+func (e *LSMEngine) Find(data string, options ReadOptions) (ReadPage, error) {
+	return findPage(data, options, func(query datatypes.JS, explain *Explain) ([]datatypes.JS, error) {
+		e.lock.RLock()
+		defer e.lock.RUnlock()
+		return e.findObjects(query, explain)
+	})
+}
+
+//findObjects returns the objects matching `query`, going through every object unless the query is on the id
+func (e *LSMEngine) findObjects(query datatypes.JS, explain *Explain) ([]datatypes.JS, error) {
+	if e.closed {
+		return nil, ErrClosed
+	}
+	filter, err := ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	var objects []datatypes.JS
+	match := func(jsonData []byte) bool {
+		obj := util.GetJSON(string(jsonData))
+		explain.DocsExamined++
+		if filter.Match(obj) {
+			objects = append(objects, obj)
+		}
+		return true
+	}
+
+	if id, ok := query["id"].(string); ok {
+		explain.Plan = ExplainStep{Stage: stageIDLookup, Estimated: 1, Candidates: 1}
+		jsonData, err := e.get(id)
+		if err != nil {
+			return nil, err
+		}
+		if jsonData == nil {
+			return nil, newError(ErrNotFound, "Object does not exist")
+		}
+		match(jsonData)
+	} else {
+		//Segments may hold older versions of the same objects, so this is only an upper bound
+		estimated := len(e.memtable)
+		for _, segment := range e.segments {
+			estimated += int(segment.records)
+		}
+		explain.Plan = ExplainStep{Stage: stageCollectionScan, Estimated: estimated}
+		if err := e.each(match); err != nil {
+			return nil, err
+		}
+		explain.Plan.Candidates = explain.DocsExamined
+	}
+	explain.Candidates = explain.Plan.Candidates
+	explain.Matched = len(objects)
+	return objects, nil
+}
+
+//Update applies the patch or update operators in `data` to the object with id `id`
+func (e *LSMEngine) Update(id, data string) (datatypes.JS, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	jsonData, err := e.get(id)
+	if err != nil {
+		return nil, err
+	}
+	if jsonData == nil {
+		return nil, newError(ErrNotFound, "Object with id %s not found", id)
+	}
+	upd, err := parseUpdate(data)
+	if err != nil {
+		return nil, err
+	}
+	updated, err := upd.apply(util.GetJSON(string(jsonData)))
+	if err != nil {
+		return nil, err
+	}
+	//The id is what the object is found by, it cannot be patched away
+	updated["id"] = id
+	updatedData, err := json.Marshal(updated)
+	if err != nil {
+		return nil, err
+	}
+	if err := e.put(&datatypes.LSMRecord{Key: id, Value: updatedData}); err != nil {
+		return nil, err
+	}
+	return upd.doc, nil
+}
+
+//Delete all objects matching the query in `data`, by writing a deletion record (tombstone) for each
+func (e *LSMEngine) Delete(data string) (datatypes.JS, error) {
+	if len(data) == 0 {
+		return nil, newError(ErrInvalidDocument, "Empty request")
+	}
+	query, err := parseDocument(data)
+	if err != nil {
+		return nil, err
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	toDelete, err := e.findObjects(query, &Explain{})
+	if err != nil {
+		return nil, err
+	}
+	tombstones := make([]*datatypes.LSMRecord, len(toDelete))
+	for i, obj := range toDelete {
+		tombstones[i] = &datatypes.LSMRecord{Key: obj["id"].(string), Deleted: true}
+	}
+	if len(tombstones) > 0 {
+		if err := e.put(tombstones...); err != nil {
+			return nil, err
+		}
+	}
+	return datatypes.JS{"deleteCount": len(toDelete)}, nil
+}
+
+//Get returns the object with id `id`
+func (e *LSMEngine) Get(id string) (datatypes.JS, error) {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	return e.getObject(id)
+}
+
+//getObject returns the object with id `id`, an ErrNotFound if there is none. Must be called with the lock held.
+func (e *LSMEngine) getObject(id string) (datatypes.JS, error) {
+	if e.closed {
+		return nil, ErrClosed
+	}
+	jsonData, err := e.get(id)
+	if err != nil {
+		return nil, err
+	}
+	if jsonData == nil {
+		return nil, objectNotFound(id)
+	}
+	return util.GetJSON(string(jsonData)), nil
+}
+
+//Replace the object with id `id` by the one in `data`
+func (e *LSMEngine) Replace(id, data string) (datatypes.JS, error) {
+	obj, jsonData, err := replacement(id, data)
+	if err != nil {
+		return nil, err
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if _, err := e.getObject(id); err != nil {
+		return nil, err
+	}
+	if err := e.put(&datatypes.LSMRecord{Key: id, Value: jsonData}); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+//DeleteByID writes a deletion record for the object with id `id`, returning the object
+func (e *LSMEngine) DeleteByID(id string) (datatypes.JS, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	obj, err := e.getObject(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := e.put(&datatypes.LSMRecord{Key: id, Deleted: true}); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+//FindAndModify merges the patch in `update` into one of the objects matching `filter`, see StorageEngine
+func (e *LSMEngine) FindAndModify(filter, update string, options ModifyOptions) (ModifyResult, error) {
+	mod, err := parseModification(filter, update, options)
+	if err != nil {
+		return ModifyResult{}, err
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	matches, err := mod.matches(e.findObjects(mod.filter, &Explain{}))
+	if err != nil {
+		return ModifyResult{}, err
+	}
+	var getErr error
+	before, after, err := mod.apply(matches, func(id string) bool {
+		jsonData, err := e.get(id)
+		if err != nil {
+			getErr = err
+		}
+		return jsonData != nil
+	})
+	if getErr != nil {
+		return ModifyResult{}, getErr
+	}
+	if err != nil {
+		return ModifyResult{}, err
+	}
+	jsonData, err := json.Marshal(after)
+	if err != nil {
+		return ModifyResult{}, err
+	}
+	id, err := e.store(after, string(jsonData))
+	if err != nil {
+		return ModifyResult{}, err
+	}
+	return mod.result(before, after, id), nil
+}
+
+//UpdateMany applies the patch or update operators in `update` to every object matching `filter`, see StorageEngine.
+//The modified objects are put with a single append to the log, as Delete does with its tombstones.
+func (e *LSMEngine) UpdateMany(filter, update string) (UpdateResult, error) {
+	many, err := parseManyUpdate(filter, update)
+	if err != nil {
+		return UpdateResult{}, err
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	modified, result, err := many.apply(e.findObjects(many.filter, &Explain{}))
+	if err != nil || len(modified) == 0 {
+		return result, err
+	}
+	records := make([]*datatypes.LSMRecord, len(modified))
+	for i, obj := range modified {
+		jsonData, err := json.Marshal(obj)
+		if err != nil {
+			return UpdateResult{}, err
+		}
+		records[i] = &datatypes.LSMRecord{Key: obj["id"].(string), Value: jsonData}
+	}
+	if err := e.put(records...); err != nil {
+		return UpdateResult{}, err
+	}
+	return result, nil
+}
+
+//Scan calls `fn` with every object, in id order, until it returns false.
+//The engine is read-locked meanwhile: `fn` must not write to it.
+func (e *LSMEngine) Scan(fn func(obj datatypes.JS) bool) error {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	if e.closed {
+		return ErrClosed
+	}
+	return e.each(func(jsonData []byte) bool {
+		return fn(util.GetJSON(string(jsonData)))
+	})
+}
+
+//Close waits for a running merge, then closes every file. The memtable stays in its log until the next open.
+func (e *LSMEngine) Close() error {
+	e.lock.Lock()
+	if e.closed {
+		e.lock.Unlock()
+		return nil
+	}
+	//Set before waiting, so no write can start a merge meanwhile
+	e.closed = true
+	e.lock.Unlock()
+	e.merges.Wait()
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.closeSegments()
+	if e.memlog == nil {
+		return nil
+	}
+	//Writes made with NoSync are only guaranteed to be on disk once closed
+	err := e.memlog.Sync()
+	if closeErr := e.memlog.Close(); err == nil {
+		err = closeErr
+	}
+	e.memlog = nil
+	return err
+}
+
+func (e *LSMEngine) closeSegments() {
+	for _, segment := range e.segments {
+		segment.close(false)
+	}
+	e.segments = nil
+}
@@ -0,0 +1,317 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"nosql-db/pkg/datatypes"
+	"os"
+	"sort"
+)
+
+//lsmIndexInterval is how many records apart the keys of the sparse index of a segment are
+const lsmIndexInterval = 16
+
+//lsmIndexEntry is a key of a segment, and the offset of its record
+type lsmIndexEntry struct {
+	key    string
+	offset int64
+}
+
+//lsmSegment is an immutable segment file of an LSM collection, see datatypes.LSMFooter for its layout.
+//Records are read straight from the file; only the sparse index and the bloom filter are kept in memory.
+type lsmSegment struct {
+	path    string
+	file    *os.File
+	index   []lsmIndexEntry
+	bloom   *datatypes.BloomFilter
+	dataEnd int64
+	records int64
+}
+
+//segmentWriter writes a segment file, one record at a time, in increasing key order
+type segmentWriter struct {
+	file   *os.File
+	writer *bufio.Writer
+	offset int64
+	index  []lsmIndexEntry
+	bloom  *datatypes.BloomFilter
+	count  int64
+}
+
+//newSegmentWriter creates the segment file at `path`, sizing its bloom filter for at most `keys` keys
+func newSegmentWriter(path string, keys int) (*segmentWriter, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
+	if err != nil {
+		return nil, err
+	}
+	sw := &segmentWriter{
+		file:   file,
+		writer: bufio.NewWriter(file),
+		bloom:  datatypes.NewBloomFilter(keys),
+	}
+	sw.write(datatypes.FileHeader(datatypes.LSMSegmentMagic))
+	return sw, nil
+}
+
+func (sw *segmentWriter) write(data []byte) {
+	n, _ := sw.writer.Write(data)
+	sw.offset += int64(n)
+}
+
+//add the next record, whose key must be greater than the previous one's
+func (sw *segmentWriter) add(record *datatypes.LSMRecord) {
+	if sw.count%lsmIndexInterval == 0 {
+		sw.index = append(sw.index, lsmIndexEntry{key: record.Key, offset: sw.offset})
+	}
+	sw.bloom.Add(record.Key)
+	sw.write(record.WriteableRepr())
+	sw.count++
+}
+
+//finish writes the sparse index, the bloom filter and the footer, then syncs and closes the file
+func (sw *segmentWriter) finish() error {
+	var index bytes.Buffer
+	binary.Write(&index, binary.BigEndian, uint32(len(sw.index)))
+	for _, entry := range sw.index {
+		binary.Write(&index, binary.BigEndian, uint16(len(entry.key)))
+		index.WriteString(entry.key)
+		binary.Write(&index, binary.BigEndian, uint64(entry.offset))
+	}
+	bloom := sw.bloom.WriteableRepr()
+
+	footer := datatypes.LSMFooter{
+		IndexOffset: sw.offset,
+		BloomOffset: sw.offset + int64(index.Len()),
+		Records:     sw.count,
+		Checksum:    crc32.ChecksumIEEE(append(index.Bytes(), bloom...)),
+	}
+	sw.write(index.Bytes())
+	sw.write(bloom)
+	sw.write(footer.WriteableRepr())
+
+	err := sw.writer.Flush()
+	if err == nil {
+		err = sw.file.Sync()
+	}
+	if closeErr := sw.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+//abort gives up on the segment, removing its file
+func (sw *segmentWriter) abort() {
+	sw.file.Close()
+	os.Remove(sw.file.Name())
+}
+
+//openSegment opens the segment file at `path`, loading its sparse index and bloom filter
+func openSegment(path string) (*lsmSegment, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	segment, err := loadSegment(file)
+	if err != nil {
+		file.Close()
+		return nil, errors.New(path + ": " + err.Error())
+	}
+	segment.path = path
+	return segment, nil
+}
+
+func loadSegment(file *os.File) (*lsmSegment, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+	if size < datatypes.FileHeaderSize+datatypes.LSMFooterSize {
+		return nil, datatypes.ErrCorruptedLSMFooter
+	}
+	header := make([]byte, datatypes.FileHeaderSize)
+	if _, err := file.ReadAt(header, 0); err != nil {
+		return nil, err
+	}
+	if _, err := datatypes.ParseFileHeader(header, datatypes.LSMSegmentMagic); err != nil {
+		return nil, err
+	}
+
+	footerData := make([]byte, datatypes.LSMFooterSize)
+	if _, err := file.ReadAt(footerData, size-datatypes.LSMFooterSize); err != nil {
+		return nil, err
+	}
+	footer, err := datatypes.ParseLSMFooter(footerData)
+	if err != nil {
+		return nil, err
+	}
+	blocksEnd := size - datatypes.LSMFooterSize
+	if footer.IndexOffset < datatypes.FileHeaderSize || footer.BloomOffset < footer.IndexOffset || footer.BloomOffset > blocksEnd {
+		return nil, datatypes.ErrCorruptedLSMFooter
+	}
+	blocks := make([]byte, blocksEnd-footer.IndexOffset)
+	if _, err := file.ReadAt(blocks, footer.IndexOffset); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(blocks) != footer.Checksum {
+		return nil, datatypes.ErrCorruptedLSMFooter
+	}
+
+	index, err := parseSparseIndex(blocks[:footer.BloomOffset-footer.IndexOffset])
+	if err != nil {
+		return nil, err
+	}
+	bloom, err := datatypes.LoadBloomFilter(blocks[footer.BloomOffset-footer.IndexOffset:])
+	if err != nil {
+		return nil, err
+	}
+	return &lsmSegment{
+		file:    file,
+		index:   index,
+		bloom:   bloom,
+		dataEnd: footer.IndexOffset,
+		records: footer.Records,
+	}, nil
+}
+
+func parseSparseIndex(data []byte) ([]lsmIndexEntry, error) {
+	r := bytes.NewReader(data)
+	var count uint32
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return nil, datatypes.ErrCorruptedLSMFooter
+	}
+	index := make([]lsmIndexEntry, 0, count)
+	for i := uint32(0); i < count; i++ {
+		var keyLen uint16
+		if err := binary.Read(r, binary.BigEndian, &keyLen); err != nil {
+			return nil, datatypes.ErrCorruptedLSMFooter
+		}
+		key := make([]byte, keyLen)
+		var offset uint64
+		if _, err := io.ReadFull(r, key); err != nil {
+			return nil, datatypes.ErrCorruptedLSMFooter
+		}
+		if err := binary.Read(r, binary.BigEndian, &offset); err != nil {
+			return nil, datatypes.ErrCorruptedLSMFooter
+		}
+		index = append(index, lsmIndexEntry{key: string(key), offset: int64(offset)})
+	}
+	return index, nil
+}
+
+//get returns the record of `key` in the segment, nil if it has none
+func (s *lsmSegment) get(key string) (*datatypes.LSMRecord, error) {
+	if !s.bloom.MayContain(key) {
+		return nil, nil
+	}
+	//The record can only be after the last indexed key not greater than `key`
+	i := sort.Search(len(s.index), func(i int) bool { return s.index[i].key > key }) - 1
+	if i < 0 {
+		return nil, nil
+	}
+	end := s.dataEnd
+	if i+1 < len(s.index) {
+		end = s.index[i+1].offset
+	}
+	r := bufio.NewReader(io.NewSectionReader(s.file, s.index[i].offset, end-s.index[i].offset))
+	for {
+		record, err := datatypes.ReadLSMRecord(r)
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if record.Key == key {
+			return record, nil
+		}
+		if record.Key > key {
+			return nil, nil
+		}
+	}
+}
+
+//cursor returns a cursor going through every record of the segment, in key order
+func (s *lsmSegment) cursor() *lsmCursor {
+	r := bufio.NewReader(io.NewSectionReader(s.file, datatypes.FileHeaderSize, s.dataEnd-datatypes.FileHeaderSize))
+	return newLSMCursor(func() (*datatypes.LSMRecord, error) {
+		return datatypes.ReadLSMRecord(r)
+	})
+}
+
+//close the segment file, removing it if `remove` is set
+func (s *lsmSegment) close(remove bool) {
+	s.file.Close()
+	if remove {
+		os.Remove(s.path)
+	}
+}
+
+//lsmCursor goes through a sorted run of records: a segment, or the memtable
+type lsmCursor struct {
+	current *datatypes.LSMRecord
+	next    func() (*datatypes.LSMRecord, error)
+	err     error
+}
+
+//newLSMCursor returns a cursor over the records returned by `next`, until it returns io.EOF
+func newLSMCursor(next func() (*datatypes.LSMRecord, error)) *lsmCursor {
+	c := &lsmCursor{next: next}
+	c.advance()
+	return c
+}
+
+//advance moves the cursor to the next record, current is nil once past the last one
+func (c *lsmCursor) advance() {
+	c.current, c.err = c.next()
+	if c.err == io.EOF {
+		c.err = nil
+	}
+	if c.err != nil {
+		c.current = nil
+	}
+}
+
+//sliceCursor returns a cursor over `records`, which must be sorted by key
+func sliceCursor(records []*datatypes.LSMRecord) *lsmCursor {
+	return newLSMCursor(func() (*datatypes.LSMRecord, error) {
+		if len(records) == 0 {
+			return nil, io.EOF
+		}
+		record := records[0]
+		records = records[1:]
+		return record, nil
+	})
+}
+
+//mergeRecords calls `fn` with the records of every cursor, in key order, until it returns false.
+//Cursors are ordered newest first: when several hold the same key, only the newest record is passed on.
+func mergeRecords(cursors []*lsmCursor, fn func(record *datatypes.LSMRecord) bool) error {
+	for {
+		var newest *datatypes.LSMRecord
+		for _, c := range cursors {
+			if c.err != nil {
+				return c.err
+			}
+			if c.current != nil && (newest == nil || c.current.Key < newest.Key) {
+				newest = c.current
+			}
+		}
+		if newest == nil {
+			return nil
+		}
+		key := newest.Key
+		for _, c := range cursors {
+			if c.current != nil && c.current.Key == key {
+				c.advance()
+			}
+		}
+		if !fn(newest) {
+			return nil
+		}
+	}
+}
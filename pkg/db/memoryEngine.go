@@ -0,0 +1,284 @@
+package db
+
+import (
+	"encoding/json"
+	"nosql-db/pkg/datatypes"
+	"nosql-db/pkg/util"
+	"sync"
+)
+
+//MemoryEngine is a storage engine keeping objects in memory only, for caches and tests.
+//Objects are kept serialized, so callers never share them with the engine or with each other.
+//It has no value indexes: every query goes through every object.
+type MemoryEngine struct {
+	lock  sync.RWMutex
+	idGen *IdGen
+	//objects maps the (user-space) id of every object to its JSON
+	objects map[string][]byte
+}
+
+//NewMemoryEngine returns an empty MemoryEngine
+func NewMemoryEngine() *MemoryEngine {
+	return &MemoryEngine{
+		idGen:   NewIDGen(),
+		objects: make(map[string][]byte),
+	}
+}
+
+//Write an object, given an id if it has none. `data` is a raw JSON string
+func (m *MemoryEngine) Write(data string) (string, error) {
+	dat, err := parseDocument(data)
+	if err != nil {
+		return "", err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.store(dat, data)
+}
+
+//store writes `dat`, parsed from `data`, giving it an id if it has none. Must be called with the lock held.
+func (m *MemoryEngine) store(dat datatypes.JS, data string) (string, error) {
+	var id string
+	if value, found := dat["id"]; found {
+		var ok bool
+		if id, ok = value.(string); !ok {
+			return "", newError(ErrInvalidDocument, "id must be a string")
+		}
+	} else {
+		id = m.idGen.GetID(data)
+		dat["id"] = id
+	}
+	jsonData, err := json.Marshal(dat)
+	if err != nil {
+		return "", err
+	}
+	m.objects[id] = jsonData
+	return id, nil
+}
+
+//Read the objects matching the query in `data`
+func (m *MemoryEngine) Read(data string) ([]datatypes.JS, error) {
+	if len(data) == 0 {
+		return nil, newError(ErrInvalidDocument, "Empty request")
+	}
+	query, err := parseDocument(data)
+	if err != nil {
+		return nil, err
+	}
+
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.findObjects(query, &Explain{})
+}
+
+//Find returns a page of the objects matching the query in `data`, see Access.Find
+func (m *MemoryEngine) Find(data string, options ReadOptions) (ReadPage, error) {
+	return findPage(data, options, func(query datatypes.JS, explain *Explain) ([]datatypes.JS, error) {
+		m.lock.RLock()
+		defer m.lock.RUnlock()
+		return m.findObjects(query, explain)
+	})
+}
+
+//findObjects returns the objects matching `query`, going through every object unless the query is on the id
+func (m *MemoryEngine) findObjects(query datatypes.JS, explain *Explain) ([]datatypes.JS, error) {
+	filter, err := ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := m.objects
+	explain.Plan = ExplainStep{Stage: stageCollectionScan, Estimated: len(m.objects)}
+	if id, ok := query["id"].(string); ok {
+		jsonData, found := m.objects[id]
+		if !found {
+			return nil, newError(ErrNotFound, "Object does not exist")
+		}
+		candidates = map[string][]byte{id: jsonData}
+		explain.Plan = ExplainStep{Stage: stageIDLookup, Estimated: 1}
+	}
+	explain.Plan.Candidates = len(candidates)
+	explain.Candidates = len(candidates)
+
+	var objects []datatypes.JS
+	for _, jsonData := range candidates {
+		obj := util.GetJSON(string(jsonData))
+		explain.DocsExamined++
+		if filter.Match(obj) {
+			objects = append(objects, obj)
+		}
+	}
+	explain.Matched = len(objects)
+	return objects, nil
+}
+
+//Update applies the patch or update operators in `data` to the object with id `id`
+func (m *MemoryEngine) Update(id, data string) (datatypes.JS, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	jsonData, ok := m.objects[id]
+	if !ok {
+		return nil, newError(ErrNotFound, "Object with id %s not found", id)
+	}
+	upd, err := parseUpdate(data)
+	if err != nil {
+		return nil, err
+	}
+	updated, err := upd.apply(util.GetJSON(string(jsonData)))
+	if err != nil {
+		return nil, err
+	}
+	//The id is what the object is found by, it cannot be patched away
+	updated["id"] = id
+	updatedData, err := json.Marshal(updated)
+	if err != nil {
+		return nil, err
+	}
+	m.objects[id] = updatedData
+	return upd.doc, nil
+}
+
+//Delete all objects matching the query in `data`
+func (m *MemoryEngine) Delete(data string) (datatypes.JS, error) {
+	if len(data) == 0 {
+		return nil, newError(ErrInvalidDocument, "Empty request")
+	}
+	query, err := parseDocument(data)
+	if err != nil {
+		return nil, err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	toDelete, err := m.findObjects(query, &Explain{})
+	if err != nil {
+		return nil, err
+	}
+	for _, obj := range toDelete {
+		delete(m.objects, obj["id"].(string))
+	}
+	return datatypes.JS{"deleteCount": len(toDelete)}, nil
+}
+
+//Get returns the object with id `id`
+func (m *MemoryEngine) Get(id string) (datatypes.JS, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	jsonData, found := m.objects[id]
+	if !found {
+		return nil, objectNotFound(id)
+	}
+	return util.GetJSON(string(jsonData)), nil
+}
+
+//Replace the object with id `id` by the one in `data`
+func (m *MemoryEngine) Replace(id, data string) (datatypes.JS, error) {
+	obj, jsonData, err := replacement(id, data)
+	if err != nil {
+		return nil, err
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, found := m.objects[id]; !found {
+		return nil, objectNotFound(id)
+	}
+	m.objects[id] = jsonData
+	return obj, nil
+}
+
+//DeleteByID removes the object with id `id`, returning it
+func (m *MemoryEngine) DeleteByID(id string) (datatypes.JS, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	jsonData, found := m.objects[id]
+	if !found {
+		return nil, objectNotFound(id)
+	}
+	delete(m.objects, id)
+	return util.GetJSON(string(jsonData)), nil
+}
+
+//FindAndModify merges the patch in `update` into one of the objects matching `filter`, see StorageEngine
+func (m *MemoryEngine) FindAndModify(filter, update string, options ModifyOptions) (ModifyResult, error) {
+	mod, err := parseModification(filter, update, options)
+	if err != nil {
+		return ModifyResult{}, err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	matches, err := mod.matches(m.findObjects(mod.filter, &Explain{}))
+	if err != nil {
+		return ModifyResult{}, err
+	}
+	before, after, err := mod.apply(matches, func(id string) bool {
+		_, found := m.objects[id]
+		return found
+	})
+	if err != nil {
+		return ModifyResult{}, err
+	}
+	jsonData, err := json.Marshal(after)
+	if err != nil {
+		return ModifyResult{}, err
+	}
+	id, err := m.store(after, string(jsonData))
+	if err != nil {
+		return ModifyResult{}, err
+	}
+	return mod.result(before, after, id), nil
+}
+
+//UpdateMany applies the patch or update operators in `update` to every object matching `filter`, see StorageEngine
+func (m *MemoryEngine) UpdateMany(filter, update string) (UpdateResult, error) {
+	many, err := parseManyUpdate(filter, update)
+	if err != nil {
+		return UpdateResult{}, err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	modified, result, err := many.apply(m.findObjects(many.filter, &Explain{}))
+	if err != nil {
+		return UpdateResult{}, err
+	}
+	//Marshalled before storing any, so nothing is stored if one fails
+	data := make([][]byte, len(modified))
+	for i, obj := range modified {
+		if data[i], err = json.Marshal(obj); err != nil {
+			return UpdateResult{}, err
+		}
+	}
+	for i, obj := range modified {
+		m.objects[obj["id"].(string)] = data[i]
+	}
+	return result, nil
+}
+
+//Scan calls `fn` with every object until it returns false. Objects written or deleted meanwhile may or may not be seen.
+func (m *MemoryEngine) Scan(fn func(obj datatypes.JS) bool) error {
+	m.lock.RLock()
+	snapshot := make([][]byte, 0, len(m.objects))
+	for _, jsonData := range m.objects {
+		snapshot = append(snapshot, jsonData)
+	}
+	m.lock.RUnlock()
+
+	for _, jsonData := range snapshot {
+		if !fn(util.GetJSON(string(jsonData))) {
+			return nil
+		}
+	}
+	return nil
+}
+
+//Close drops every object
+func (m *MemoryEngine) Close() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.objects = make(map[string][]byte)
+	return nil
+}
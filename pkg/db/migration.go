@@ -0,0 +1,93 @@
+package db
+
+import (
+	"io/ioutil"
+	"log"
+	"nosql-db/pkg/datatypes"
+	"nosql-db/pkg/logging"
+	"os"
+)
+
+//formattedFiles maps the extension of each versioned file to the magic number identifying it
+var formattedFiles = map[string][4]byte{
+	datatypes.IndexFileExtension:      datatypes.IndexFileMagic,
+	datatypes.AttributeFileExtension:  datatypes.AttributeFileMagic,
+	datatypes.ValueIndexFileExtension: datatypes.ValueIndexFileMagic,
+}
+
+//getFormattedFile returns a versioned file in R/W mode, creating it (header included) if it does not exist
+func getFormattedFile(filename string, magic [4]byte) *os.File {
+	file := getFile(filename)
+	if getFileSize(file) == 0 {
+		writeFileHeader(file, magic)
+	}
+	return file
+}
+
+func writeFileHeader(file *os.File, magic [4]byte) {
+	if _, err := file.WriteAt(datatypes.FileHeader(magic), 0); err != nil {
+		fail(err)
+	}
+	file.Sync()
+}
+
+//needsMigration returns true if any of the collection's versioned files predates the current format
+func needsMigration(base string) bool {
+	for extension, magic := range formattedFiles {
+		data, err := ioutil.ReadFile(base + extension)
+		if err != nil || len(data) == 0 {
+			//Missing or empty files are simply created in the current format
+			continue
+		}
+		version, err := datatypes.ParseFileHeader(data, magic)
+		if err != nil || version < datatypes.FormatVersion {
+			return true
+		}
+		if version > datatypes.FormatVersion {
+			failf("%s was written in format version %d, this build only supports up to version %d",
+				base+extension, version, datatypes.FormatVersion)
+		}
+	}
+	return false
+}
+
+//migrateFiles upgrades a collection whose index and attribute files predate the current format.
+//The live documents are copied over exactly like a compaction would, which writes the index and attribute files
+//in the current format, and the new files are swapped in the same crash-safe way.
+func migrateFiles(base string) {
+	if !needsMigration(base) {
+		return
+	}
+	logging.Infof("Migrating %s to format version %d", base, datatypes.FormatVersion)
+
+	indexData, err := ioutil.ReadFile(base + datatypes.IndexFileExtension)
+	if err != nil && !os.IsNotExist(err) {
+		fail(err)
+	}
+	table := loadTableAnyFormat(indexData)
+	dbFile := getFile(base + datatypes.DBFileExtension)
+	defer dbFile.Close()
+
+	fresh := newCompactionTarget(base)
+	for _, _id := range table.GetAllIds() {
+		entry, _ := table.Get(_id)
+		data := make([]byte, entry.Size)
+		dbFile.ReadAt(data, entry.Offset)
+		if len(data) == 0 || data[0] == 0 {
+			log.Printf("Skipping object %s, its data is gone", _id)
+			continue
+		}
+		fresh.applyWrite(_id, data)
+	}
+	fresh.fileHandles.close()
+	swapCompactedFiles(base)
+	logging.Infof("Migrated %d objects", fresh.indexTable.Len())
+}
+
+//loadTableAnyFormat loads index file contents written in the current or any previous format
+func loadTableAnyFormat(data []byte) *datatypes.IndexTable {
+	if _, err := datatypes.ParseFileHeader(data, datatypes.IndexFileMagic); err == datatypes.ErrNoHeader {
+		return datatypes.LoadLegacyTable(string(data))
+	}
+	return datatypes.LoadTable(string(data))
+}
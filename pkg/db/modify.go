@@ -0,0 +1,186 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"nosql-db/pkg/datatypes"
+	"nosql-db/pkg/util"
+	"strings"
+)
+
+//ModifyOptions shape FindAndModify
+type ModifyOptions struct {
+	//Sort picks which of the objects matching the filter gets modified: the first one in this order.
+	//Objects sorting the same are told apart by their id, so the pick is always the same for the same objects.
+	Sort []SortKey
+	//Upsert inserts a new object if none matches the filter. It is made of the update (patch or operators) applied to
+	//the attributes the filter requires a plain value for, as {"id": "jo", "status": "new"} in {"id": "jo", "status": "new", "age": {"$gt": 3}}.
+	Upsert bool
+	//ReturnNew returns the object as modified (or inserted), rather than as it was before
+	ReturnNew bool
+}
+
+//ModifyResult is the outcome of FindAndModify
+type ModifyResult struct {
+	//Object is the object before being modified, or after if ReturnNew was set. nil for an upsert without ReturnNew.
+	Object datatypes.JS `json:"object"`
+	//ID is the id of the object modified or inserted
+	ID string `json:"id"`
+	//Upserted is set if no object matched the filter, and one was inserted
+	Upserted bool `json:"upserted"`
+}
+
+//Upsert applies the patch or update operators in `update` to an object matching the query in `filter`, or inserts one if none does.
+//Returns the object as stored.
+func Upsert(engine StorageEngine, filter, update string) (ModifyResult, error) {
+	return engine.FindAndModify(filter, update, ModifyOptions{Upsert: true, ReturnNew: true})
+}
+
+//modification is a FindAndModify being run, shared by every engine. Engines find the objects matching the filter
+//and store the object returned by apply, all under their write lock so nothing can change in between.
+type modification struct {
+	filter  datatypes.JS
+	update  *update
+	options ModifyOptions
+}
+
+func parseModification(filter, update string, options ModifyOptions) (*modification, error) {
+	m := &modification{options: options}
+	var err error
+	if m.filter, err = parseDocument(filter); err != nil {
+		return nil, err
+	}
+	if m.update, err = parseUpdate(update); err != nil {
+		return nil, err
+	}
+	//Checked up front, so the filter is known to be valid once the lock is held
+	if _, err := ParseQuery(m.filter); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+//matches drops the ErrNotFound returned by engines when a filter on the id finds nothing, which is no error here
+func (m *modification) matches(objects []datatypes.JS, err error) ([]datatypes.JS, error) {
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+	return objects, err
+}
+
+//apply picks the object to modify among `matches` and returns it, along with the object to store in its place.
+//`before` is nil when inserting; `exists` tells whether an object with a given id exists, so an upsert
+//cannot replace an object which did not match the filter.
+func (m *modification) apply(matches []datatypes.JS, exists func(id string) bool) (before, after datatypes.JS, err error) {
+	if len(matches) > 0 {
+		before = sortObjects(matches, m.options.Sort)[0].obj
+		if after, err = m.update.apply(copyObject(before)); err != nil {
+			return nil, nil, err
+		}
+		//The id is what the object is found by, it cannot be patched away
+		after["id"] = before["id"]
+		return before, after, nil
+	}
+
+	if !m.options.Upsert {
+		return nil, nil, newError(ErrNotFound, "no object matches the filter")
+	}
+	after = datatypes.JS{}
+	for key, value := range m.filter {
+		if strings.HasPrefix(key, "$") || strings.Contains(key, ".") {
+			continue
+		}
+		if obj, isObj := value.(datatypes.JS); isObj && isOperatorExpression(obj) {
+			continue
+		}
+		after[key] = value
+	}
+	if after, err = m.update.apply(after); err != nil {
+		return nil, nil, err
+	}
+	if id, found := after["id"]; found {
+		idStr, ok := id.(string)
+		if !ok {
+			return nil, nil, newError(ErrInvalidDocument, "id must be a string")
+		}
+		if exists(idStr) {
+			return nil, nil, newError(ErrConflict, "an object with id %s exists but does not match the filter", idStr)
+		}
+	}
+	return nil, after, nil
+}
+
+//result returns the outcome of the modification, once `after` was stored as `id`
+func (m *modification) result(before, after datatypes.JS, id string) ModifyResult {
+	result := ModifyResult{ID: id, Upserted: before == nil, Object: before}
+	if m.options.ReturnNew {
+		after["id"] = id
+		result.Object = after
+	}
+	return result
+}
+
+//copyObject returns a deep copy of `obj`
+func copyObject(obj datatypes.JS) datatypes.JS {
+	data, _ := json.Marshal(obj)
+	return util.GetJSON(string(data))
+}
+
+//UpdateResult is the outcome of UpdateMany
+type UpdateResult struct {
+	//Matched is how many objects matched the filter
+	Matched int `json:"matched"`
+	//Modified is how many of them the update changed. Objects it leaves as they were are not written again.
+	Modified int `json:"modified"`
+}
+
+//manyUpdate is an UpdateMany being run, shared by every engine like modification. Engines find the objects
+//matching the filter and store every object returned by apply at once, all under their write lock.
+type manyUpdate struct {
+	filter datatypes.JS
+	update *update
+}
+
+func parseManyUpdate(filter, update string) (*manyUpdate, error) {
+	m := &manyUpdate{}
+	var err error
+	if m.filter, err = parseDocument(filter); err != nil {
+		return nil, err
+	}
+	if m.update, err = parseUpdate(update); err != nil {
+		return nil, err
+	}
+	if _, err := ParseQuery(m.filter); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+//apply updates every object in `matches` and returns the ones the update changed, to be stored in their place.
+//The update is applied to all of them before anything gets stored, so if it fails on any object none is changed.
+func (m *manyUpdate) apply(matches []datatypes.JS, err error) ([]datatypes.JS, UpdateResult, error) {
+	if errors.Is(err, ErrNotFound) {
+		matches, err = nil, nil
+	}
+	if err != nil {
+		return nil, UpdateResult{}, err
+	}
+	var modified []datatypes.JS
+	for _, obj := range matches {
+		before, err := json.Marshal(obj)
+		if err != nil {
+			return nil, UpdateResult{}, err
+		}
+		after, err := m.update.apply(util.GetJSON(string(before)))
+		if err != nil {
+			return nil, UpdateResult{}, err
+		}
+		after["id"] = obj["id"]
+		//Keys are marshalled in order, so equal objects have the same JSON
+		if afterData, err := json.Marshal(after); err == nil && string(afterData) == string(before) {
+			continue
+		}
+		modified = append(modified, after)
+	}
+	return modified, UpdateResult{Matched: len(matches), Modified: len(modified)}, nil
+}
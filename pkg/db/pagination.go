@@ -0,0 +1,269 @@
+package db
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"nosql-db/pkg/datatypes"
+	"nosql-db/pkg/util"
+	"sort"
+	"strings"
+	"time"
+)
+
+//ErrInvalidCursor is returned when a cursor cannot be decoded, or was issued for another sort order
+var ErrInvalidCursor error = &Error{Kind: ErrInvalidDocument, Message: "invalid cursor"}
+
+//SortKey is a single key of a sort order: the dotted path of an attribute, and its direction
+type SortKey struct {
+	Path       string
+	Descending bool
+}
+
+//ReadOptions shape the result of a read.
+//A Limit of 0 means no limit. Cursor is the one returned with the previous page, if resuming a read.
+//Projection (if not nil) is applied last, so objects can be sorted on attributes it leaves out.
+//Explain fills in the Explain of the page, describing how the query was run.
+type ReadOptions struct {
+	Sort       []SortKey
+	Skip       int
+	Limit      int
+	Cursor     string
+	Projection *Projection
+	Explain    bool
+}
+
+//ReadPage is a page of results. Cursor resumes the read after the last object of the page, it is empty on the last page.
+type ReadPage struct {
+	Objects []datatypes.JS
+	Cursor  string
+	Explain *Explain
+}
+
+//cursor is the position of the last object of a page in the sort order.
+//Resuming from the position rather than an offset keeps pages stable while objects are written or deleted.
+type cursor struct {
+	Sort  string        `json:"s"`
+	After []interface{} `json:"a"`
+	ID    string        `json:"i"`
+}
+
+//ParseSort parses a sort order of the form "age,-brother.name": comma-separated paths, descending if prefixed by '-'
+func ParseSort(spec string) ([]SortKey, error) {
+	var keys []SortKey
+	if spec == "" {
+		return keys, nil
+	}
+	for _, part := range strings.Split(spec, ",") {
+		key := SortKey{Path: strings.TrimSpace(part)}
+		if strings.HasPrefix(key.Path, "-") {
+			key.Path = key.Path[1:]
+			key.Descending = true
+		} else {
+			key.Path = strings.TrimPrefix(key.Path, "+")
+		}
+		if key.Path == "" {
+			return nil, newError(ErrInvalidDocument, "empty path in sort order '%s'", spec)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+//formatSort is the inverse of ParseSort
+func formatSort(keys []SortKey) string {
+	parts := make([]string, len(keys))
+	for i, key := range keys {
+		parts[i] = key.Path
+		if key.Descending {
+			parts[i] = "-" + key.Path
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+//Find returns a page of the objects matching the query in `data`, as shaped by `options`.
+//Objects are ordered by the sort keys, then by id, so the order is the same from one page to the next.
+func (db *Access) Find(data string, options ReadOptions) (page ReadPage, err error) {
+	if err := db.failed(); err != nil {
+		return ReadPage{}, err
+	}
+	defer db.recoverFailure(&err)
+	return findPage(data, options, func(query datatypes.JS, explain *Explain) ([]datatypes.JS, error) {
+		db.lock.RLock()
+		defer db.lock.RUnlock()
+		return db.findObjects(query, explain)
+	})
+}
+
+//findPage reads the objects matching the query in `data` through `read`, which fills in `explain` as it goes,
+//then shapes them into a page as described by `options`
+func findPage(data string, options ReadOptions, read func(query datatypes.JS, explain *Explain) ([]datatypes.JS, error)) (ReadPage, error) {
+	began := time.Now()
+	if len(data) == 0 {
+		return ReadPage{}, newError(ErrInvalidDocument, "Empty request")
+	}
+	query, err := parseDocument(data)
+	if err != nil {
+		return ReadPage{}, err
+	}
+
+	var after *cursor
+	if options.Cursor != "" {
+		decoded, err := decodeCursor(options.Cursor)
+		if err != nil || decoded.Sort != formatSort(options.Sort) || len(decoded.After) != len(options.Sort) {
+			return ReadPage{}, ErrInvalidCursor
+		}
+		after = decoded
+	}
+
+	explain := &Explain{}
+	objects, err := read(query, explain)
+	if err != nil {
+		return ReadPage{}, err
+	}
+
+	sorted := sortObjects(objects, options.Sort)
+	start := 0
+	if after != nil {
+		//Skip past every object up to and including the last one of the previous page
+		start = sort.Search(len(sorted), func(i int) bool {
+			return compareSortPositions(sorted[i].values, sorted[i].id, after.After, after.ID, options.Sort) > 0
+		})
+	}
+	start += options.Skip
+	if start > len(sorted) {
+		start = len(sorted)
+	}
+	end := len(sorted)
+	if options.Limit > 0 && start+options.Limit < end {
+		end = start + options.Limit
+	}
+
+	page := ReadPage{Objects: make([]datatypes.JS, 0, end-start)}
+	for _, item := range sorted[start:end] {
+		page.Objects = append(page.Objects, options.Projection.Apply(item.obj))
+	}
+	//The cursor is taken from sort values computed before projecting, as the projection may drop them
+	if end < len(sorted) && end > start {
+		last := sorted[end-1]
+		page.Cursor = encodeCursor(&cursor{Sort: formatSort(options.Sort), After: last.values, ID: last.id})
+	}
+	if options.Explain {
+		explain.Returned = len(page.Objects)
+		explain.ElapsedMs = float64(time.Since(began).Microseconds()) / 1000
+		page.Explain = explain
+	}
+	return page, nil
+}
+
+//sortItem is an object along with the values it is sorted by
+type sortItem struct {
+	obj    datatypes.JS
+	values []interface{}
+	id     string
+}
+
+func sortObjects(objects []datatypes.JS, keys []SortKey) []sortItem {
+	items := make([]sortItem, len(objects))
+	for i, obj := range objects {
+		items[i] = sortItem{obj: obj, values: make([]interface{}, len(keys))}
+		for k, key := range keys {
+			items[i].values[k] = sortValue(obj, key)
+		}
+		items[i].id, _ = obj["id"].(string)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return compareSortPositions(items[i].values, items[i].id, items[j].values, items[j].id, keys) < 0
+	})
+	return items
+}
+
+//sortValue returns the value `obj` is sorted by for `key`: nil if missing, and for arrays,
+//the smallest element in ascending order and the largest in descending order
+func sortValue(obj datatypes.JS, key SortKey) interface{} {
+	values := expandArrays(util.ResolvePath(obj, key.Path))
+	var best interface{}
+	found := false
+	for _, value := range values {
+		if _, isArray := value.([]interface{}); isArray && len(values) > 1 {
+			continue
+		}
+		if !found {
+			best, found = value, true
+			continue
+		}
+		cmp := compareSortValues(value, best)
+		if (cmp < 0 && !key.Descending) || (cmp > 0 && key.Descending) {
+			best = value
+		}
+	}
+	return best
+}
+
+//compareSortPositions compares two positions in the sort order, falling back to ids for objects sorting equally
+func compareSortPositions(aValues []interface{}, aID string, bValues []interface{}, bID string, keys []SortKey) int {
+	for k, key := range keys {
+		cmp := compareSortValues(aValues[k], bValues[k])
+		if key.Descending {
+			cmp = -cmp
+		}
+		if cmp != 0 {
+			return cmp
+		}
+	}
+	return strings.Compare(aID, bID)
+}
+
+//sortTypeRank orders values of different types: missing and null first, then numbers, strings, objects, arrays and booleans
+func sortTypeRank(value interface{}) int {
+	switch value.(type) {
+	case nil:
+		return 0
+	case float64:
+		return 1
+	case string:
+		return 2
+	case datatypes.JS, map[string]interface{}:
+		return 3
+	case []interface{}:
+		return 4
+	case bool:
+		return 5
+	}
+	return 6
+}
+
+//compareSortValues is a total order over decoded JSON values, see sortTypeRank
+func compareSortValues(a, b interface{}) int {
+	aRank, bRank := sortTypeRank(a), sortTypeRank(b)
+	if aRank != bRank {
+		if aRank < bRank {
+			return -1
+		}
+		return 1
+	}
+	if cmp, ok := util.CompareValues(a, b); ok {
+		return cmp
+	}
+	//Objects and arrays are compared through their encoding, which has sorted keys
+	aJSON, _ := json.Marshal(a)
+	bJSON, _ := json.Marshal(b)
+	return strings.Compare(string(aJSON), string(bJSON))
+}
+
+func encodeCursor(c *cursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(encoded string) (*cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	c := &cursor{}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
@@ -0,0 +1,165 @@
+package db
+
+import (
+	"nosql-db/pkg/util"
+	"sort"
+)
+
+//objectLoadCost is the cost of loading a candidate object from the db file (read, checksum and JSON decoding),
+//relative to reading one item of an attribute chain, which is a read of its own as items are scattered through the file
+const objectLoadCost = 2
+
+//Stages of a query plan
+const (
+	stageCollectionScan = "collectionScan"
+	stageIDLookup       = "idLookup"
+	stageIndexLookup    = "indexLookup"
+	stageAttributeChain = "attributeChain"
+	stageIntersect      = "intersect"
+	stageUnion          = "union"
+)
+
+//queryStep is a step of a query plan, producing candidate IDs: through a value index, an attribute chain,
+//or by intersecting/unioning the IDs of other steps
+type queryStep struct {
+	stage    string
+	path     string
+	lookup   *indexLookup
+	children []*queryStep
+	//estimated is the number of IDs the step is expected to produce, and cost the work it takes to produce them
+	estimated int
+	cost      float64
+	//produced is the number of IDs actually produced, once run
+	produced int
+}
+
+//ExplainStep describes a step of the plan chosen for a query, as returned by Find with the Explain option.
+//Estimated is the number of candidates the planner expected, Candidates the number the step produced
+//(duplicates included, as in attribute chains holding stale IDs).
+type ExplainStep struct {
+	Stage      string        `json:"stage"`
+	Path       string        `json:"path,omitempty"`
+	Index      string        `json:"index,omitempty"`
+	Fields     int           `json:"fields,omitempty"`
+	Estimated  int           `json:"estimated"`
+	Candidates int           `json:"candidates"`
+	Children   []ExplainStep `json:"children,omitempty"`
+}
+
+//Explain describes how a query was run: the plan, how many distinct candidates it produced,
+//how many objects were loaded to check them against the query, how many matched and were returned, and how long it all took
+type Explain struct {
+	Plan         ExplainStep `json:"plan"`
+	Candidates   int         `json:"candidates"`
+	DocsExamined int         `json:"docsExamined"`
+	Matched      int         `json:"matched"`
+	Returned     int         `json:"returned"`
+	ElapsedMs    float64     `json:"elapsedMs"`
+}
+
+func (step *queryStep) explain() ExplainStep {
+	result := ExplainStep{Stage: step.stage, Path: step.path, Estimated: step.estimated, Candidates: step.produced}
+	if step.lookup != nil {
+		result.Index = step.lookup.index.Name
+		result.Fields = step.lookup.fields
+	}
+	for _, child := range step.children {
+		result.Children = append(result.Children, child.explain())
+	}
+	return result
+}
+
+//planCandidates works out the cheapest way of producing the candidates described by `plan`
+func (db *Access) planCandidates(plan *candidatePlan) *queryStep {
+	if plan.kind != planUnion {
+		return db.planConjunction(plan)
+	}
+	step := &queryStep{stage: stageUnion}
+	for _, child := range plan.children {
+		childStep := db.planCandidates(child)
+		step.children = append(step.children, childStep)
+		step.estimated += childStep.estimated
+		step.cost += childStep.cost
+	}
+	if total := db.indexTable.Len(); step.estimated > total {
+		step.estimated = total
+	}
+	return step
+}
+
+//planConjunction picks which steps to drive a conjunction from. Every object matching the query is produced by
+//any one of the steps able to answer a part of it (a value index lookup, an attribute chain or a union), so the
+//step producing the fewest candidates is enough. Other steps are only intersected with it if reading them is
+//cheaper than loading the candidates they are expected to rule out, assuming attributes are independent.
+func (db *Access) planConjunction(plan *candidatePlan) *queryStep {
+	conjunction := plan.conjunction()
+	var attributes []*candidatePlan
+	var options []*queryStep
+	for _, child := range conjunction {
+		if child.kind == planAttribute {
+			attributes = append(attributes, child)
+			//Reading a chain takes finding its head, then reading every item
+			length := db.attributes.Len("/" + child.path)
+			options = append(options, &queryStep{stage: stageAttributeChain, path: child.path, estimated: length, cost: float64(length + 1)})
+		} else {
+			options = append(options, db.planCandidates(child))
+		}
+	}
+	//Value indexes are in memory: looking them up costs next to nothing compared to reading files
+	for _, lookup := range db.indexLookups(attributes) {
+		options = append(options, &queryStep{stage: stageIndexLookup, lookup: lookup, estimated: lookup.count()})
+	}
+	sort.SliceStable(options, func(i, j int) bool {
+		if options[i].estimated != options[j].estimated {
+			return options[i].estimated < options[j].estimated
+		}
+		return options[i].cost < options[j].cost
+	})
+
+	total := float64(db.indexTable.Len())
+	if total < 1 {
+		total = 1
+	}
+	chosen := options[:1]
+	estimated := float64(options[0].estimated)
+	cost := options[0].cost
+	for _, option := range options[1:] {
+		selectivity := float64(option.estimated) / total
+		if selectivity > 1 {
+			selectivity = 1
+		}
+		if option.cost < objectLoadCost*estimated*(1-selectivity) {
+			chosen = append(chosen, option)
+			estimated *= selectivity
+			cost += option.cost
+		}
+	}
+	if len(chosen) == 1 {
+		return chosen[0]
+	}
+	return &queryStep{stage: stageIntersect, children: chosen, estimated: int(estimated), cost: cost}
+}
+
+//runStep returns the candidate IDs produced by the step, duplicates included
+func (db *Access) runStep(step *queryStep) []string {
+	var ids []string
+	switch step.stage {
+	case stageIndexLookup:
+		ids = step.lookup.run()
+	case stageAttributeChain:
+		ids = db.getAllIdsFromAttributeName(step.path)
+	default:
+		childrenIDs := make([][]string, len(step.children))
+		for i, child := range step.children {
+			childrenIDs[i] = db.runStep(child)
+		}
+		if step.stage == stageUnion {
+			ids = util.Union(childrenIDs)
+		} else {
+			//Children are sorted by estimated size, so the join goes through the smallest set
+			ids = util.InnerJoin(childrenIDs)
+		}
+	}
+	step.produced = len(ids)
+	return ids
+}
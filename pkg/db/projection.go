@@ -0,0 +1,149 @@
+package db
+
+import (
+	"nosql-db/pkg/datatypes"
+	"strings"
+)
+
+//Projection picks the parts of objects returned by a read. It either includes only the listed paths
+//(along with id, unless it is excluded), or returns everything but the listed paths.
+//Paths are dotted, and go through arrays of objects like queries do: "items.sku" keeps the sku of every item.
+type Projection struct {
+	root      *projectionNode
+	exclude   bool
+	excludeID bool
+}
+
+//projectionNode is a step in the tree of projected paths. A leaf is the end of a path, its whole subtree is projected.
+type projectionNode struct {
+	children map[string]*projectionNode
+	leaf     bool
+}
+
+//ParseProjection parses a projection of the form "name,brother.name" (include) or "-brother,-age" (exclude).
+//The two cannot be mixed, except for "-id" which drops the id from an inclusion.
+//Returns nil for an empty spec, meaning whole objects.
+func ParseProjection(spec string) (*Projection, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	var included, excluded []string
+	excludeID := false
+	for _, part := range strings.Split(spec, ",") {
+		path := strings.TrimSpace(part)
+		if strings.HasPrefix(path, "-") {
+			path = path[1:]
+			if path == "id" {
+				excludeID = true
+			}
+			excluded = append(excluded, path)
+		} else {
+			included = append(included, strings.TrimPrefix(path, "+"))
+		}
+		if path == "" || strings.HasPrefix(path, ".") || strings.HasSuffix(path, ".") || strings.Contains(path, "..") {
+			return nil, newError(ErrInvalidDocument, "invalid path in projection '%s'", spec)
+		}
+	}
+
+	projection := &Projection{root: &projectionNode{}, excludeID: excludeID}
+	paths := included
+	if len(included) == 0 {
+		projection.exclude = true
+		paths = excluded
+	} else if len(excluded) > 1 || (len(excluded) == 1 && !excludeID) {
+		return nil, newError(ErrInvalidDocument, "projection '%s' mixes included and excluded paths", spec)
+	}
+
+	for _, path := range paths {
+		node := projection.root
+		for _, segment := range strings.Split(path, ".") {
+			//A path already projected whole covers anything below it
+			if node.leaf {
+				break
+			}
+			if node.children == nil {
+				node.children = make(map[string]*projectionNode)
+			}
+			child, ok := node.children[segment]
+			if !ok {
+				child = &projectionNode{}
+				node.children[segment] = child
+			}
+			node = child
+		}
+		//Anything already below this path is covered by it
+		node.leaf = true
+		node.children = nil
+	}
+	return projection, nil
+}
+
+//Apply returns the projection of `obj`. `obj` may be modified, objects fresh out of the db file are expected.
+func (p *Projection) Apply(obj datatypes.JS) datatypes.JS {
+	if p == nil {
+		return obj
+	}
+	if p.exclude {
+		excludePaths(obj, p.root)
+		return obj
+	}
+	projected, _ := includePaths(obj, p.root)
+	result, _ := projected.(datatypes.JS)
+	if id, ok := obj["id"]; ok && !p.excludeID {
+		result["id"] = id
+	}
+	return result
+}
+
+//includePaths returns the parts of `value` under `node`, and false if there are none
+func includePaths(value interface{}, node *projectionNode) (interface{}, bool) {
+	if node.leaf {
+		return value, true
+	}
+	switch v := value.(type) {
+	case datatypes.JS:
+		projected := datatypes.JS{}
+		for k, child := range node.children {
+			if childValue, ok := v[k]; ok {
+				if projectedValue, ok := includePaths(childValue, child); ok {
+					projected[k] = projectedValue
+				}
+			}
+		}
+		return projected, true
+	case []interface{}:
+		//Paths go through arrays into the objects they hold, anything else in the array is left out
+		projected := []interface{}{}
+		for _, element := range v {
+			if _, isObj := element.(datatypes.JS); !isObj {
+				if _, isArray := element.([]interface{}); !isArray {
+					continue
+				}
+			}
+			if projectedElement, ok := includePaths(element, node); ok {
+				projected = append(projected, projectedElement)
+			}
+		}
+		return projected, true
+	}
+	//A path going through a value which is neither an object nor an array leads nowhere
+	return nil, false
+}
+
+//excludePaths removes the parts of `value` under `node`, in place
+func excludePaths(value interface{}, node *projectionNode) {
+	switch v := value.(type) {
+	case datatypes.JS:
+		for k, child := range node.children {
+			if child.leaf {
+				delete(v, k)
+			} else if childValue, ok := v[k]; ok {
+				excludePaths(childValue, child)
+			}
+		}
+	case []interface{}:
+		for _, element := range v {
+			excludePaths(element, node)
+		}
+	}
+}
@@ -0,0 +1,588 @@
+package db
+
+import (
+	"fmt"
+	"nosql-db/pkg/datatypes"
+	"nosql-db/pkg/util"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+//Filter is a parsed query, as found in the body of Read and Delete requests.
+//
+//A query maps attribute paths to either a value, meaning equality:
+//    {"name": "Jo", "brother": {"name": "Simon"}}
+//or an operator expression, where every key starts with '$':
+//    {"age": {"$gt": 50, "$lte": 60}, "status": {"$in": ["a", "b"]}, "brother.bike": {"$exists": true}}
+//
+//Supported operators are $eq, $ne, $gt, $gte, $lt, $lte, $in, $nin, $exists, $regex (with $options)
+//and $not, which negates an operator expression.
+//
+//Paths descend into arrays: {"tags": "example"} matches {"tags": ["example", "sample"]}, and
+//{"items.sku": "a"} matches {"items": [{"sku": "a"}, {"sku": "b"}]}. Array-specific operators are
+//$all (contains every value), $size (has exactly n elements) and $elemMatch (an element matches a sub-query).
+//
+//Queries can be combined with $and, $or and $nor, each taking an array of queries, and negated with $not:
+//    {"$or": [{"country": "FR"}, {"tier": "gold"}], "$not": {"status": "banned"}}
+//Every key of a query (combinators included) is implicitly ANDed.
+type Filter interface {
+	//Match returns true if `doc` satisfies the filter
+	Match(doc datatypes.JS) bool
+	//candidates returns how to narrow down the documents possibly matching the filter through the attribute chains,
+	//before loading any document. nil means every document is a candidate.
+	candidates() *candidatePlan
+}
+
+//Kinds of candidatePlan
+const (
+	planAttribute = "attribute"
+	planIntersect = "intersect"
+	planUnion     = "union"
+)
+
+//candidatePlan describes a set of candidate documents: those having an attribute (planAttribute),
+//or the intersection/union of other sets. For planAttribute, `condition` is the one the attribute's value
+//must satisfy, which a value index on the attribute can use.
+type candidatePlan struct {
+	kind      string
+	path      string
+	condition condition
+	children  []*candidatePlan
+}
+
+//conjunction returns the plans intersected by `plan`, nested intersections included.
+//An attribute plan is a conjunction of itself.
+func (plan *candidatePlan) conjunction() []*candidatePlan {
+	switch plan.kind {
+	case planAttribute, planUnion:
+		return []*candidatePlan{plan}
+	}
+	var plans []*candidatePlan
+	for _, child := range plan.children {
+		plans = append(plans, child.conjunction()...)
+	}
+	return plans
+}
+
+//andFilter matches documents matching every one of its filters
+type andFilter []Filter
+
+//orFilter matches documents matching at least one of its filters
+type orFilter []Filter
+
+//notFilter matches documents not matching its filter ($not, and $nor which is $not of $or)
+type notFilter struct {
+	filter Filter
+}
+
+//fieldFilter matches documents whose value at `path` satisfies `condition`
+type fieldFilter struct {
+	path      string
+	condition condition
+}
+
+//condition is a predicate over the values found at some path (none if missing, several if the path goes through arrays)
+type condition interface {
+	eval(values []interface{}) bool
+	//requiresValue returns true if the condition can only hold for a non-object value
+	requiresValue() bool
+}
+
+type comparisonCondition struct {
+	op    string
+	value interface{}
+}
+
+type membershipCondition struct {
+	values  []interface{}
+	negated bool
+}
+
+type existsCondition bool
+
+type regexCondition struct {
+	regex *regexp.Regexp
+}
+
+type notCondition struct {
+	condition condition
+}
+
+type allCondition struct {
+	values []interface{}
+}
+
+type sizeCondition int
+
+//elemMatchCondition holds if an element of the array matches `filter` (array of objects)
+//or `condition` (array of scalars, as in {"$elemMatch": {"$gte": 80, "$lt": 85}})
+type elemMatchCondition struct {
+	filter    Filter
+	condition condition
+}
+
+//allConditions holds when every one of its conditions does, as in {"$gt": 1, "$lt": 5}
+type allConditions []condition
+
+//ParseQuery turns the JSON body of a query into a Filter. Malformed queries are ErrInvalidDocument errors.
+func ParseQuery(query datatypes.JS) (Filter, error) {
+	filter, err := parseFields("", query)
+	return filter, invalid(err)
+}
+
+func parseFields(prefix string, query datatypes.JS) (Filter, error) {
+	filters := andFilter{}
+	for key, value := range query {
+		path := prefix + key
+		if strings.HasPrefix(key, "$") {
+			if prefix != "" {
+				return nil, fmt.Errorf("'%s' must be used at the top level of a query", key)
+			}
+			filter, err := parseCombinator(key, value)
+			if err != nil {
+				return nil, err
+			}
+			filters = append(filters, filter)
+			continue
+		}
+
+		//An empty object has no attribute to match on: it is compared to as a value, below
+		if obj, ok := value.(datatypes.JS); ok && len(obj) > 0 && !isOperatorExpression(obj) {
+			//Nested object: every attribute inside it is a condition on the nested path, as with util.FlattenJSON
+			if hasOperator(obj) {
+				return nil, fmt.Errorf("'%s' mixes operators and attributes", path)
+			}
+			nested, err := parseFields(path+".", obj)
+			if err != nil {
+				return nil, err
+			}
+			filters = append(filters, nested.(andFilter)...)
+			continue
+		}
+
+		cond, err := parseCondition(path, value)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, &fieldFilter{path: path, condition: cond})
+	}
+	return filters, nil
+}
+
+//parseCombinator parses a logical combinator ($and, $or, $nor, $not) and the queries it combines
+func parseCombinator(op string, value interface{}) (Filter, error) {
+	if op == "$not" {
+		query, ok := value.(datatypes.JS)
+		if !ok {
+			return nil, fmt.Errorf("$not expects a query object")
+		}
+		filter, err := ParseQuery(query)
+		if err != nil {
+			return nil, err
+		}
+		return &notFilter{filter: filter}, nil
+	}
+
+	if op != "$and" && op != "$or" && op != "$nor" {
+		return nil, fmt.Errorf("unknown top-level operator '%s'", op)
+	}
+	queries, ok := value.([]interface{})
+	if !ok || len(queries) == 0 {
+		return nil, fmt.Errorf("%s expects a non-empty array of queries", op)
+	}
+	filters := make([]Filter, len(queries))
+	for i, q := range queries {
+		query, ok := q.(datatypes.JS)
+		if !ok {
+			return nil, fmt.Errorf("%s expects an array of query objects", op)
+		}
+		filter, err := ParseQuery(query)
+		if err != nil {
+			return nil, err
+		}
+		filters[i] = filter
+	}
+
+	switch op {
+	case "$and":
+		return andFilter(filters), nil
+	case "$or":
+		return orFilter(filters), nil
+	default:
+		return &notFilter{filter: orFilter(filters)}, nil
+	}
+}
+
+//parseCondition parses the value associated with `path` in a query: an operator expression, or a value to compare to
+func parseCondition(path string, value interface{}) (condition, error) {
+	obj, ok := value.(datatypes.JS)
+	if !ok || !isOperatorExpression(obj) {
+		return &comparisonCondition{op: "$eq", value: value}, nil
+	}
+
+	conditions := allConditions{}
+	for op, operand := range obj {
+		var cond condition
+		switch op {
+		case "$eq", "$ne", "$gt", "$gte", "$lt", "$lte":
+			cond = &comparisonCondition{op: op, value: operand}
+		case "$in", "$nin":
+			values, ok := operand.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%s on '%s' expects an array", op, path)
+			}
+			cond = &membershipCondition{values: values, negated: op == "$nin"}
+		case "$exists":
+			exists, ok := operand.(bool)
+			if !ok {
+				return nil, fmt.Errorf("$exists on '%s' expects a boolean", path)
+			}
+			cond = existsCondition(exists)
+		case "$regex":
+			pattern, ok := operand.(string)
+			if !ok {
+				return nil, fmt.Errorf("$regex on '%s' expects a string", path)
+			}
+			if options, ok := obj["$options"].(string); ok && options != "" {
+				pattern = "(?" + options + ")" + pattern
+			}
+			regex, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("invalid $regex on '%s': %v", path, err)
+			}
+			cond = &regexCondition{regex: regex}
+		case "$options":
+			//Handled along with $regex
+			continue
+		case "$not":
+			negated, err := parseCondition(path, operand)
+			if err != nil {
+				return nil, err
+			}
+			cond = &notCondition{condition: negated}
+		case "$all":
+			values, ok := operand.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("$all on '%s' expects an array", path)
+			}
+			cond = &allCondition{values: values}
+		case "$size":
+			size, ok := operand.(float64)
+			if !ok || size < 0 || size != float64(int(size)) {
+				return nil, fmt.Errorf("$size on '%s' expects a positive integer", path)
+			}
+			cond = sizeCondition(size)
+		case "$elemMatch":
+			query, ok := operand.(datatypes.JS)
+			if !ok {
+				return nil, fmt.Errorf("$elemMatch on '%s' expects an object", path)
+			}
+			elemMatch := &elemMatchCondition{}
+			var err error
+			if isOperatorExpression(query) {
+				elemMatch.condition, err = parseCondition(path, query)
+			} else {
+				elemMatch.filter, err = ParseQuery(query)
+			}
+			if err != nil {
+				return nil, err
+			}
+			cond = elemMatch
+		default:
+			return nil, fmt.Errorf("unknown operator '%s' on '%s'", op, path)
+		}
+		conditions = append(conditions, cond)
+	}
+	return conditions, nil
+}
+
+//isOperatorExpression returns true if every key of `obj` is an operator, e.g. {"$gt": 5}
+func isOperatorExpression(obj datatypes.JS) bool {
+	if len(obj) == 0 {
+		return false
+	}
+	for k := range obj {
+		if !strings.HasPrefix(k, "$") {
+			return false
+		}
+	}
+	return true
+}
+
+func hasOperator(obj datatypes.JS) bool {
+	for k := range obj {
+		if strings.HasPrefix(k, "$") {
+			return true
+		}
+	}
+	return false
+}
+
+func (f andFilter) Match(doc datatypes.JS) bool {
+	for _, filter := range f {
+		if !filter.Match(doc) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f andFilter) candidates() *candidatePlan {
+	plan := &candidatePlan{kind: planIntersect}
+	for _, filter := range f {
+		//Filters which do not narrow anything down are simply left out of the intersection
+		if child := filter.candidates(); child != nil {
+			plan.children = append(plan.children, child)
+		}
+	}
+	if len(plan.children) == 0 {
+		return nil
+	}
+	return plan
+}
+
+func (f orFilter) Match(doc datatypes.JS) bool {
+	for _, filter := range f {
+		if filter.Match(doc) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f orFilter) candidates() *candidatePlan {
+	plan := &candidatePlan{kind: planUnion}
+	for _, filter := range f {
+		child := filter.candidates()
+		//If any branch may match any document, so may the union
+		if child == nil {
+			return nil
+		}
+		plan.children = append(plan.children, child)
+	}
+	return plan
+}
+
+func (f *notFilter) Match(doc datatypes.JS) bool {
+	return !f.filter.Match(doc)
+}
+
+func (f *notFilter) candidates() *candidatePlan {
+	//Documents not matching a filter can have any attribute
+	return nil
+}
+
+func (f *fieldFilter) Match(doc datatypes.JS) bool {
+	return f.condition.eval(util.ResolvePath(doc, f.path))
+}
+
+func (f *fieldFilter) candidates() *candidatePlan {
+	//ids are not recorded in the attribute chains (see writeAttributes), and neither are array positions
+	if f.condition.requiresValue() && f.path != "id" && !hasArrayPosition(f.path) {
+		return &candidatePlan{kind: planAttribute, path: f.path, condition: f.condition}
+	}
+	return nil
+}
+
+//hasArrayPosition returns true if a segment of `path` picks an element of an array, as in "items.0.sku"
+func hasArrayPosition(path string) bool {
+	for _, segment := range strings.Split(path, ".") {
+		if _, err := strconv.Atoi(segment); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+//expandArrays returns `values` along with the elements of those which are arrays:
+//a condition on a path holding an array holds if it holds for the array itself or any of its elements
+func expandArrays(values []interface{}) []interface{} {
+	expanded := values
+	for _, value := range values {
+		if array, ok := value.([]interface{}); ok {
+			expanded = append(expanded[:len(expanded):len(expanded)], array...)
+		}
+	}
+	return expanded
+}
+
+//anyEqual returns true if any of `values` (arrays expanded) equals `target`
+func anyEqual(values []interface{}, target interface{}) bool {
+	for _, value := range expandArrays(values) {
+		if valuesEqual(value, target) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *comparisonCondition) eval(values []interface{}) bool {
+	switch c.op {
+	case "$eq":
+		//null matches missing attributes too
+		return anyEqual(values, c.value) || (c.value == nil && len(values) == 0)
+	case "$ne":
+		return !anyEqual(values, c.value) && !(c.value == nil && len(values) == 0)
+	}
+	for _, value := range expandArrays(values) {
+		cmp, ok := util.CompareValues(value, c.value)
+		if !ok {
+			//Values of different types are never ordered relative to each other
+			continue
+		}
+		switch c.op {
+		case "$gt":
+			ok = cmp > 0
+		case "$gte":
+			ok = cmp >= 0
+		case "$lt":
+			ok = cmp < 0
+		case "$lte":
+			ok = cmp <= 0
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *comparisonCondition) requiresValue() bool {
+	switch c.op {
+	case "$ne":
+		return false
+	case "$eq":
+		return c.value != nil && !util.IsObj(c.value)
+	}
+	return true
+}
+
+func (c *membershipCondition) eval(values []interface{}) bool {
+	in := false
+	for _, candidate := range c.values {
+		if anyEqual(values, candidate) || (candidate == nil && len(values) == 0) {
+			in = true
+			break
+		}
+	}
+	return in != c.negated
+}
+
+func (c *membershipCondition) requiresValue() bool {
+	if c.negated {
+		return false
+	}
+	for _, candidate := range c.values {
+		if candidate == nil || util.IsObj(candidate) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c existsCondition) eval(values []interface{}) bool {
+	return (len(values) > 0) == bool(c)
+}
+
+func (c existsCondition) requiresValue() bool {
+	//The path may lead to a nested object, which has no attribute chain of its own
+	return false
+}
+
+func (c *regexCondition) eval(values []interface{}) bool {
+	for _, value := range expandArrays(values) {
+		if str, ok := value.(string); ok && c.regex.MatchString(str) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *regexCondition) requiresValue() bool {
+	return true
+}
+
+func (c *notCondition) eval(values []interface{}) bool {
+	return !c.condition.eval(values)
+}
+
+func (c *notCondition) requiresValue() bool {
+	return false
+}
+
+func (c allConditions) eval(values []interface{}) bool {
+	for _, cond := range c {
+		if !cond.eval(values) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c allConditions) requiresValue() bool {
+	for _, cond := range c {
+		if cond.requiresValue() {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *allCondition) eval(values []interface{}) bool {
+	if len(c.values) == 0 {
+		return false
+	}
+	for _, target := range c.values {
+		if !anyEqual(values, target) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *allCondition) requiresValue() bool {
+	return len(c.values) > 0
+}
+
+func (c sizeCondition) eval(values []interface{}) bool {
+	for _, value := range values {
+		if array, ok := value.([]interface{}); ok && len(array) == int(c) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c sizeCondition) requiresValue() bool {
+	return true
+}
+
+func (c *elemMatchCondition) eval(values []interface{}) bool {
+	for _, value := range values {
+		array, ok := value.([]interface{})
+		if !ok {
+			continue
+		}
+		for _, element := range array {
+			if c.filter != nil {
+				if obj, ok := element.(datatypes.JS); ok && c.filter.Match(obj) {
+					return true
+				}
+			} else if c.condition.eval([]interface{}{element}) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c *elemMatchCondition) requiresValue() bool {
+	return true
+}
+
+//valuesEqual compares two decoded JSON values. Numbers are all float64 once decoded, so deep equality is enough.
+func valuesEqual(a, b interface{}) bool {
+	return reflect.DeepEqual(a, b)
+}
@@ -0,0 +1,363 @@
+package db
+
+import (
+	"fmt"
+	"nosql-db/pkg/datatypes"
+	"nosql-db/pkg/util"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//update is a parsed update, as found in the body of PATCH requests and FindAndModify.
+//
+//An update is either a patch, merged into objects as per RFC 7396 (see util.MergeRFC7396):
+//    {"status": "claimed", "worker": null}
+//or a set of update operators, each mapping dotted paths to an operand:
+//    {"$inc": {"stats.views": 1}, "$set": {"author.name": "Jo"}, "$push": {"tags": "new"}, "$unset": {"draft": ""}}
+//
+//Supported operators are
+//  - $set and $unset, which set or remove the value at a path
+//  - $inc and $mul, which add to or multiply a number (missing values count as 0)
+//  - $min and $max, which set the value if the operand is lower (or greater) than it, or if it is missing
+//  - $push and $addToSet, which append to an array, $addToSet only values it does not hold yet.
+//    Several values are appended with $each, as in {"$push": {"tags": {"$each": ["a", "b"]}}}
+//  - $pull, which removes the elements of an array equal to a value, or matching a condition
+//    as found in queries: {"$pull": {"scores": {"$lt": 50}, "items": {"sku": "a"}}}
+//
+//Missing objects along a path are created. An update cannot mix operators and attributes, touch the id,
+//or change a path twice (as in "a" and "a.b").
+//Operators are applied while holding the collection's write lock, so concurrent updates are never lost.
+type update struct {
+	//doc is the update as given, merged as a patch if there are no operators
+	doc       datatypes.JS
+	operators []*updateOperator
+}
+
+//updateOperator is an operator applied to a single path, as in {"$inc": {"views": 1}}
+type updateOperator struct {
+	op       string
+	path     string
+	segments []string
+	operand  interface{}
+	//values appended by $push and $addToSet
+	values []interface{}
+	//pull tells whether $pull removes an element
+	pull func(element interface{}) bool
+}
+
+//parseUpdate parses the update in `data`. Malformed updates are ErrInvalidDocument errors.
+func parseUpdate(data string) (*update, error) {
+	doc, err := parseDocument(data)
+	if err != nil {
+		return nil, err
+	}
+	u, err := newUpdate(doc)
+	return u, invalid(err)
+}
+
+func newUpdate(doc datatypes.JS) (*update, error) {
+	u := &update{doc: doc}
+	if !hasOperator(doc) {
+		return u, nil
+	}
+	for op, value := range doc {
+		if !strings.HasPrefix(op, "$") {
+			return nil, fmt.Errorf("update mixes operators and attributes ('%s')", op)
+		}
+		fields, ok := value.(datatypes.JS)
+		if !ok {
+			return nil, fmt.Errorf("%s expects an object mapping paths to values", op)
+		}
+		for path, operand := range fields {
+			operator, err := parseUpdateOperator(op, path, operand)
+			if err != nil {
+				return nil, err
+			}
+			u.operators = append(u.operators, operator)
+		}
+	}
+
+	//Sorted by path so operators are always applied in the same order
+	sort.Slice(u.operators, func(i, j int) bool {
+		return u.operators[i].path < u.operators[j].path
+	})
+	for i, first := range u.operators {
+		for _, second := range u.operators[i+1:] {
+			if first.path == second.path || strings.HasPrefix(second.path, first.path+".") {
+				return nil, fmt.Errorf("update changes '%s' twice", first.path)
+			}
+		}
+	}
+	return u, nil
+}
+
+func parseUpdateOperator(op, path string, operand interface{}) (*updateOperator, error) {
+	operator := &updateOperator{op: op, path: path, segments: strings.Split(path, "."), operand: operand}
+	for _, segment := range operator.segments {
+		if segment == "" || strings.HasPrefix(segment, "$") {
+			return nil, fmt.Errorf("invalid path '%s' in %s", path, op)
+		}
+	}
+	if operator.segments[0] == "id" {
+		return nil, fmt.Errorf("the id cannot be updated")
+	}
+
+	switch op {
+	case "$set", "$unset", "$min", "$max":
+	case "$inc", "$mul":
+		if _, ok := operand.(float64); !ok {
+			return nil, fmt.Errorf("%s on '%s' expects a number", op, path)
+		}
+	case "$push", "$addToSet":
+		operator.values = []interface{}{operand}
+		if obj, ok := operand.(datatypes.JS); ok && hasOperator(obj) {
+			each, ok := obj["$each"].([]interface{})
+			if !ok || len(obj) > 1 {
+				return nil, fmt.Errorf("%s on '%s' expects a value, or an array in $each", op, path)
+			}
+			operator.values = each
+		}
+	case "$pull":
+		if obj, ok := operand.(datatypes.JS); ok && !isOperatorExpression(obj) {
+			//A query on the elements, as in {"items": {"sku": "a"}}
+			filter, err := ParseQuery(obj)
+			if err != nil {
+				return nil, err
+			}
+			operator.pull = func(element interface{}) bool {
+				obj, ok := element.(datatypes.JS)
+				return ok && filter.Match(obj)
+			}
+		} else {
+			cond, err := parseCondition(path, operand)
+			if err != nil {
+				return nil, err
+			}
+			operator.pull = func(element interface{}) bool {
+				return cond.eval([]interface{}{element})
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown update operator '%s'", op)
+	}
+	return operator, nil
+}
+
+//apply updates `obj` in place and returns it. Fails with an ErrInvalidDocument error if an operator does not
+//suit the value it applies to, as $inc on a string, in which case `obj` may have been partly updated.
+func (u *update) apply(obj datatypes.JS) (datatypes.JS, error) {
+	if u.operators == nil {
+		return util.MergeRFC7396(obj, copyObject(u.doc)), nil
+	}
+	for _, operator := range u.operators {
+		if err := operator.apply(obj); err != nil {
+			return nil, newError(ErrInvalidDocument, "%s on '%s': %v", operator.op, operator.path, err)
+		}
+	}
+	return obj, nil
+}
+
+func (o *updateOperator) apply(obj datatypes.JS) error {
+	//$unset and $pull have nothing to do on a missing value, the others create it
+	create := o.op != "$unset" && o.op != "$pull"
+	parent, err := o.parent(obj, create)
+	if err != nil || parent == nil {
+		return err
+	}
+	key := o.segments[len(o.segments)-1]
+	current, found, err := parent.get(key)
+	if err != nil {
+		return err
+	}
+
+	switch o.op {
+	case "$set":
+		return parent.set(key, copyValue(o.operand))
+	case "$unset":
+		if found {
+			parent.remove(key)
+		}
+		return nil
+	case "$inc", "$mul":
+		operand := o.operand.(float64)
+		if !found {
+			if o.op == "$mul" {
+				operand = 0
+			}
+			return parent.set(key, operand)
+		}
+		number, ok := current.(float64)
+		if !ok {
+			return fmt.Errorf("the value is not a number")
+		}
+		if o.op == "$inc" {
+			return parent.set(key, number+operand)
+		}
+		return parent.set(key, number*operand)
+	case "$min", "$max":
+		if !found {
+			return parent.set(key, copyValue(o.operand))
+		}
+		cmp, ok := util.CompareValues(o.operand, current)
+		if !ok {
+			return fmt.Errorf("the value cannot be compared to %v", o.operand)
+		}
+		if (o.op == "$min" && cmp < 0) || (o.op == "$max" && cmp > 0) {
+			return parent.set(key, copyValue(o.operand))
+		}
+		return nil
+	}
+
+	//Array operators
+	if !found && o.op == "$pull" {
+		return nil
+	}
+	var array []interface{}
+	if found {
+		var ok bool
+		if array, ok = current.([]interface{}); !ok {
+			return fmt.Errorf("the value is not an array")
+		}
+	}
+	switch o.op {
+	case "$push":
+		for _, value := range o.values {
+			array = append(array, copyValue(value))
+		}
+	case "$addToSet":
+		for _, value := range o.values {
+			if !containsValue(array, value) {
+				array = append(array, copyValue(value))
+			}
+		}
+	case "$pull":
+		kept := make([]interface{}, 0, len(array))
+		for _, element := range array {
+			if !o.pull(element) {
+				kept = append(kept, element)
+			}
+		}
+		array = kept
+	}
+	if array == nil {
+		array = []interface{}{}
+	}
+	return parent.set(key, array)
+}
+
+//parent returns the object or array holding the last segment of the path in `obj`. Missing objects along the way
+//are created if `create` is set, otherwise nil is returned.
+func (o *updateOperator) parent(obj datatypes.JS, create bool) (container, error) {
+	var parent container = objectContainer(obj)
+	for i, segment := range o.segments[:len(o.segments)-1] {
+		child, found, err := parent.get(segment)
+		if err != nil {
+			return nil, err
+		}
+		if !found || child == nil {
+			if !create {
+				return nil, nil
+			}
+			child = datatypes.JS{}
+			if err := parent.set(segment, child); err != nil {
+				return nil, err
+			}
+		}
+		switch c := child.(type) {
+		case datatypes.JS:
+			parent = objectContainer(c)
+		case []interface{}:
+			parent = arrayContainer(c)
+		default:
+			return nil, fmt.Errorf("'%s' is neither an object nor an array", strings.Join(o.segments[:i+1], "."))
+		}
+	}
+	return parent, nil
+}
+
+//container is an object or an array, whose values are found by key or index
+type container interface {
+	get(key string) (value interface{}, found bool, err error)
+	set(key string, value interface{}) error
+	remove(key string)
+}
+
+type objectContainer datatypes.JS
+
+func (c objectContainer) get(key string) (interface{}, bool, error) {
+	value, found := c[key]
+	return value, found, nil
+}
+
+func (c objectContainer) set(key string, value interface{}) error {
+	c[key] = value
+	return nil
+}
+
+func (c objectContainer) remove(key string) {
+	delete(c, key)
+}
+
+//arrayContainer is an array, whose elements are picked by index as in "items.0.sku". Its length cannot change.
+type arrayContainer []interface{}
+
+func (c arrayContainer) index(key string) (int, error) {
+	i, err := strconv.Atoi(key)
+	if err != nil || i < 0 {
+		return 0, fmt.Errorf("'%s' is not an array index", key)
+	}
+	return i, nil
+}
+
+func (c arrayContainer) get(key string) (interface{}, bool, error) {
+	i, err := c.index(key)
+	if err != nil || i >= len(c) {
+		return nil, false, err
+	}
+	return c[i], true, nil
+}
+
+func (c arrayContainer) set(key string, value interface{}) error {
+	i, err := c.index(key)
+	if err != nil {
+		return err
+	}
+	if i >= len(c) {
+		return fmt.Errorf("index %d is out of the array", i)
+	}
+	c[i] = value
+	return nil
+}
+
+//remove sets the element to null, so the index of the others does not change
+func (c arrayContainer) remove(key string) {
+	if i, err := c.index(key); err == nil && i < len(c) {
+		c[i] = nil
+	}
+}
+
+//containsValue tells whether `array` holds `value`
+func containsValue(array []interface{}, value interface{}) bool {
+	for _, element := range array {
+		if valuesEqual(element, value) {
+			return true
+		}
+	}
+	return false
+}
+
+//copyValue returns a deep copy of a decoded JSON value, so operands are never shared between objects
+func copyValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case datatypes.JS:
+		return copyObject(v)
+	case []interface{}:
+		copied := make([]interface{}, len(v))
+		for i, element := range v {
+			copied[i] = copyValue(element)
+		}
+		return copied
+	}
+	return value
+}
@@ -0,0 +1,235 @@
+package db
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"nosql-db/pkg/datatypes"
+	"nosql-db/pkg/logging"
+	"sort"
+)
+
+//Kinds of problems reported by Verify
+const (
+	problemCorruptedIndexEntry = "corruptedIndexEntry"
+	problemOutOfBounds         = "outOfBounds"
+	problemZeroedData          = "zeroedData"
+	problemChecksumMismatch    = "checksumMismatch"
+	problemDanglingPointer     = "danglingPointer"
+	problemBrokenAttributeFile = "brokenAttributeFile"
+	problemOrphanRecord        = "orphanRecord"
+)
+
+//verifyChunkSize is the number of bytes read at a time when scanning the db file for orphan records
+const verifyChunkSize = 4096
+
+//VerifyProblem is a single inconsistency found by Verify
+type VerifyProblem struct {
+	Kind   string `json:"kind"`
+	File   string `json:"file"`
+	Offset int64  `json:"offset"`
+	ID     string `json:"id,omitempty"`
+	Detail string `json:"detail"`
+}
+
+//VerifyReport is the outcome of Verify
+type VerifyReport struct {
+	Collection string          `json:"collection"`
+	Documents  int             `json:"documents"`
+	Problems   []VerifyProblem `json:"problems"`
+	Repaired   bool            `json:"repaired"`
+}
+
+//Verify walks the collection's three files and reports index entries pointing at zeroed or mismatched data,
+//dangling attribute-chain pointers and orphan records (data in the db file no index entry points to).
+//
+//If `repair` is true and problems were found, index entries with bad data are dropped, then the collection is
+//compacted, which rewrites the attribute chains from scratch and drops orphan records.
+func (db *Access) Verify(repair bool) (report VerifyReport, err error) {
+	if err := db.failed(); err != nil {
+		return VerifyReport{}, err
+	}
+	defer db.recoverFailure(&err)
+
+	var badIDs []string
+	if repair {
+		report, badIDs = db.verifyAndDrop()
+	} else {
+		db.readLocked(func() {
+			report, badIDs = db.verify()
+		})
+	}
+	if !repair || len(report.Problems) == 0 {
+		return report, nil
+	}
+
+	logging.Infof("Repairing %s: dropped %d index entries, compacting", db.entry.name, len(badIDs))
+	if _, err := db.Compact(); err != nil {
+		return report, err
+	}
+	report.Repaired = true
+	return report, nil
+}
+
+//verify checks the collection's files, returning the report and the IDs of objects which cannot be read back.
+//Must be called with the lock held.
+func (db *Access) verify() (VerifyReport, []string) {
+	report := VerifyReport{
+		Collection: db.entry.name,
+		Problems:   []VerifyProblem{},
+	}
+	referenced, badIDs := db.verifyIndex(&report)
+	db.verifyAttributes(&report)
+	db.verifyOrphans(&report, referenced)
+	report.Documents = db.indexTable.Len() - len(badIDs)
+	return report, badIDs
+}
+
+//verifyAndDrop verifies the collection, then drops the index entries of objects which cannot be read back.
+//Only the index entries are dropped: their data is unusable anyway, and is left for compaction to discard.
+func (db *Access) verifyAndDrop() (VerifyReport, []string) {
+	//Hold the write lock so the entries found to be bad are still the ones being dropped
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	report, badIDs := db.verify()
+	for _, _id := range badIDs {
+		db.DeleteIndex(_id)
+	}
+	return report, badIDs
+}
+
+//verifyIndex checks every entry of the index file against the db file.
+//Returns the entries pointing inside the db file, and the IDs of objects which cannot be read back.
+func (db *Access) verifyIndex(report *VerifyReport) ([]datatypes.IndexData, []string) {
+	indexFileName := db.fileHandles.indexFile.Name()
+	dbFileName := db.fileHandles.dbFile.Name()
+	dbFileSize := int64(getFileSize(db.fileHandles.dbFile))
+	contents := getFileContents(db.fileHandles.indexFile)
+
+	var referenced []datatypes.IndexData
+	var bad []string
+	for i := datatypes.FileHeaderSize; i+datatypes.IndexEntrySize <= len(contents); i += datatypes.IndexEntrySize {
+		ie, err := datatypes.FromWriteableRepr(contents[i:i+datatypes.IndexEntrySize], int64(i))
+		if err == datatypes.ErrEmptyIndexEntry {
+			continue
+		}
+		if err != nil {
+			report.Problems = append(report.Problems, VerifyProblem{
+				Kind: problemCorruptedIndexEntry, File: indexFileName, Offset: int64(i), Detail: err.Error(),
+			})
+			continue
+		}
+
+		indexData := ie.GetIndexData()
+		//Only the last entry written for an ID is live, earlier ones are leftovers
+		if current, err := db.indexTable.Get(ie.GetID()); err != nil || current.IndexFileOffset != indexData.IndexFileOffset {
+			continue
+		}
+
+		problem := VerifyProblem{File: dbFileName, Offset: indexData.Offset, ID: ie.GetID()}
+		if indexData.Offset < 0 || indexData.Offset+int64(indexData.Size) > dbFileSize {
+			problem.Kind = problemOutOfBounds
+			problem.Detail = fmt.Sprintf("%d bytes at offset %d, db file is %d bytes", indexData.Size, indexData.Offset, dbFileSize)
+		} else if _, err := db.readDbData(&indexData); err != nil {
+			problem.Kind = problemChecksumMismatch
+			problem.Detail = err.Error()
+			if isZeroed(db.readRaw(indexData.Offset, indexData.Size)) {
+				problem.Kind = problemZeroedData
+				problem.Detail = "index entry points at deleted data"
+			}
+		}
+
+		if problem.Kind != "" {
+			report.Problems = append(report.Problems, problem)
+			bad = append(bad, ie.GetID())
+		}
+		if problem.Kind != problemOutOfBounds {
+			referenced = append(referenced, indexData)
+		}
+	}
+	return referenced, bad
+}
+
+//verifyAttributes walks every record of the attribute file, checking each chain pointer
+//lands on the start of a (non-head) record further down the file
+func (db *Access) verifyAttributes(report *VerifyReport) {
+	attrFileName := db.fileHandles.attributesFile.Name()
+	size := int64(getFileSize(db.fileHandles.attributesFile))
+	reader := bufio.NewReader(io.NewSectionReader(db.fileHandles.attributesFile, datatypes.FileHeaderSize, size))
+
+	//Map from record offset to whether it is the head of a chain
+	records := make(map[int64]bool)
+	pointers := make(map[int64]int64)
+	offset := int64(datatypes.FileHeaderSize)
+	for offset < size {
+		record, err := datatypes.ReadAttributeRecord(reader)
+		if err != nil {
+			report.Problems = append(report.Problems, VerifyProblem{
+				Kind: problemBrokenAttributeFile, File: attrFileName, Offset: offset, Detail: err.Error(),
+			})
+			break
+		}
+		records[offset] = record.IsHead()
+		if record.Next != 0 {
+			pointers[offset] = record.Next
+		}
+		offset += int64(record.Size())
+	}
+
+	for from, to := range pointers {
+		isHead, exists := records[to]
+		if to <= from || !exists || isHead {
+			report.Problems = append(report.Problems, VerifyProblem{
+				Kind: problemDanglingPointer, File: attrFileName, Offset: from,
+				Detail: fmt.Sprintf("points at offset %d, which is not an attribute chain item", to),
+			})
+		}
+	}
+}
+
+//verifyOrphans reports non-zeroed stretches of the db file which no index entry points to.
+//These are left behind by crashes before the index entry was written: deletes and updates zero the records they drop.
+func (db *Access) verifyOrphans(report *VerifyReport, referenced []datatypes.IndexData) {
+	dbFileName := db.fileHandles.dbFile.Name()
+	dbFileSize := int64(getFileSize(db.fileHandles.dbFile))
+
+	sorted := make([]datatypes.IndexData, len(referenced))
+	copy(sorted, referenced)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Offset < sorted[j].Offset })
+
+	gapStart := int64(0)
+	for _, indexData := range append(sorted, datatypes.IndexData{Offset: dbFileSize}) {
+		for start := gapStart; start < indexData.Offset; start += verifyChunkSize {
+			size := indexData.Offset - start
+			if size > verifyChunkSize {
+				size = verifyChunkSize
+			}
+			if !isZeroed(db.readRaw(start, int(size))) {
+				report.Problems = append(report.Problems, VerifyProblem{
+					Kind: problemOrphanRecord, File: dbFileName, Offset: start,
+					Detail: fmt.Sprintf("data between offsets %d and %d is not referenced by the index", gapStart, indexData.Offset),
+				})
+				break
+			}
+		}
+		if end := indexData.Offset + int64(indexData.Size); end > gapStart {
+			gapStart = end
+		}
+	}
+}
+
+//readRaw reads `size` bytes at `offset` of the db file, without any checks
+func (db *Access) readRaw(offset int64, size int) []byte {
+	data := make([]byte, size)
+	db.fileHandles.dbFile.ReadAt(data, offset)
+	return data
+}
+
+func isZeroed(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
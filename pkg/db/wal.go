@@ -0,0 +1,134 @@
+package db
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"log"
+	"nosql-db/pkg/logging"
+	"os"
+)
+
+//Operations recorded in the write-ahead log
+const (
+	walOpWrite  = "write"
+	walOpDelete = "delete"
+	//walOpWriteMany writes several objects at once, Data being the array of their documents in the order of IDs
+	walOpWriteMany = "writeMany"
+)
+
+//walHeaderSize is the size of the framing preceding each record: payload length followed by its CRC32
+const walHeaderSize = 8
+
+//walRecord is a single logical operation, as recorded in the write-ahead log.
+//A record holds everything needed to redo the operation without re-deriving anything (IDs, timestamps...)
+type walRecord struct {
+	Op string `json:"op"`
+	//IDs holds the internal `_id` of every object touched by the operation
+	IDs []string `json:"ids"`
+	//Data is the final serialized document for writes
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+//WAL is a per-collection write-ahead log.
+//Every logical operation is appended and synced before any of the .db, .index and .attr files are touched,
+//and the log is emptied once all three files have been synced. On startup, a non-empty log therefore means
+//an operation may have been partially applied, and replaying it brings the three files back in line.
+type WAL struct {
+	file *os.File
+	//sync is turned off with FsyncNever, leaving it to the operating system
+	sync bool
+}
+
+//NewWAL wraps the collection's log file, syncing it after every change if `sync` is set
+func NewWAL(file *os.File, sync bool) *WAL {
+	return &WAL{file: file, sync: sync}
+}
+
+//begin durably records `record` before it gets applied
+func (w *WAL) begin(record walRecord) {
+	payload, err := json.Marshal(record)
+	if err != nil {
+		fail(err)
+	}
+	frame := make([]byte, walHeaderSize, walHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(payload))
+	frame = append(frame, payload...)
+
+	if _, err := w.file.WriteAt(frame, int64(getFileSize(w.file))); err != nil {
+		fail(err)
+	}
+	if w.sync {
+		if err := w.file.Sync(); err != nil {
+			fail(err)
+		}
+	}
+}
+
+//commit marks every logged operation as fully applied by emptying the log
+func (w *WAL) commit() {
+	if err := w.file.Truncate(0); err != nil {
+		fail(err)
+	}
+	if w.sync {
+		if err := w.file.Sync(); err != nil {
+			fail(err)
+		}
+	}
+}
+
+//records returns every complete record in the log.
+//A torn record at the tail (crash while logging) is discarded: its operation was never started.
+func (w *WAL) records() []walRecord {
+	data := []byte(getFileContents(w.file))
+
+	var records []walRecord
+	for offset := 0; offset+walHeaderSize <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[offset : offset+4]))
+		checksum := binary.BigEndian.Uint32(data[offset+4 : offset+8])
+		start := offset + walHeaderSize
+		if start+length > len(data) || crc32.ChecksumIEEE(data[start:start+length]) != checksum {
+			log.Printf("Discarding incomplete WAL record at offset %d", offset)
+			break
+		}
+		var record walRecord
+		if err := json.Unmarshal(data[start:start+length], &record); err != nil {
+			log.Printf("Discarding unreadable WAL record at offset %d: %v", offset, err)
+			break
+		}
+		records = append(records, record)
+		offset = start + length
+	}
+	return records
+}
+
+//replayWAL redoes every operation left in the log by a previous run, then empties it.
+//Redoing is safe even if the operation had fully completed: writes overwrite the object's index slot,
+//deletes skip objects already gone, and duplicate attribute entries are already tolerated by queries.
+func (db *Access) replayWAL() {
+	records := db.wal.records()
+	for _, record := range records {
+		logging.Infof("Replaying %s of %v from WAL", record.Op, record.IDs)
+		switch record.Op {
+		case walOpWrite:
+			db.applyWrite(record.IDs[0], record.Data)
+		case walOpDelete:
+			db.applyDelete(record.IDs)
+		case walOpWriteMany:
+			var docs []json.RawMessage
+			if err := json.Unmarshal(record.Data, &docs); err != nil || len(docs) != len(record.IDs) {
+				log.Printf("Unreadable WAL writes of %v, skipping", record.IDs)
+				continue
+			}
+			for i, _id := range record.IDs {
+				db.applyWrite(_id, docs[i])
+			}
+		default:
+			log.Printf("Unknown WAL operation '%s', skipping", record.Op)
+		}
+	}
+	if getFileSize(db.wal.file) > 0 {
+		db.wal.commit()
+	}
+}
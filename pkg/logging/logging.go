@@ -0,0 +1,47 @@
+package logging
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+)
+
+//Log levels, from the most to the least verbose. Errors are logged with the log package directly,
+//and are shown whatever the level.
+const (
+	//LevelDebug also shows what happens on every request and every write
+	LevelDebug = "debug"
+	//LevelInfo shows what happens to collections: creations, compactions, migrations...
+	LevelInfo = "info"
+	//LevelError only shows errors
+	LevelError = "error"
+)
+
+var levels = map[string]int32{LevelDebug: 0, LevelInfo: 1, LevelError: 2}
+
+//level is shared by the whole process, as is the output of the log package
+var level int32 = levels[LevelInfo]
+
+//SetLevel sets the minimum level of messages to log
+func SetLevel(name string) error {
+	l, ok := levels[name]
+	if !ok {
+		return fmt.Errorf("unknown log level '%s'", name)
+	}
+	atomic.StoreInt32(&level, l)
+	return nil
+}
+
+//Debugf logs a message at debug level
+func Debugf(format string, v ...interface{}) {
+	if atomic.LoadInt32(&level) <= levels[LevelDebug] {
+		log.Output(2, fmt.Sprintf(format, v...))
+	}
+}
+
+//Infof logs a message at info level
+func Infof(format string, v ...interface{}) {
+	if atomic.LoadInt32(&level) <= levels[LevelInfo] {
+		log.Output(2, fmt.Sprintf(format, v...))
+	}
+}
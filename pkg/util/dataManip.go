@@ -2,9 +2,13 @@ package util
 
 import (
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
 	"nosql-db/pkg/datatypes"
+	"nosql-db/pkg/logging"
 	"reflect"
+	"strconv"
+	"strings"
 )
 
 //InnerJoin takes an array of arrays of strings, inner-joins them,
@@ -40,6 +44,21 @@ func InnerJoin(data [][]string) []string {
 	return result
 }
 
+//Union takes an array of arrays of strings, and returns every string found in at least one of them, once
+func Union(data [][]string) []string {
+	var result []string
+	seen := make(map[string]struct{})
+	for _, array := range data {
+		for _, s := range array {
+			if _, ok := seen[s]; !ok {
+				seen[s] = struct{}{}
+				result = append(result, s)
+			}
+		}
+	}
+	return result
+}
+
 //FlattenJSON takes a json object and flattens it.
 //Going from
 // {
@@ -99,6 +118,87 @@ func flattenRec(key string, data datatypes.JS) map[string]interface{} {
 	return flattened
 }
 
+//ResolvePath returns every value found at the dotted `path` in `data`.
+//Arrays met along the way are descended into, so
+//    ResolvePath({"items": [{"sku": "a"}, {"sku": "b"}]}, "items.sku")
+//returns ["a", "b"]. A numeric path segment picks a single element of an array, as in "items.0.sku".
+//Returns an empty slice if nothing is found at `path`.
+func ResolvePath(data datatypes.JS, path string) []interface{} {
+	return resolvePath(data, strings.Split(path, "."))
+}
+
+func resolvePath(value interface{}, segments []string) []interface{} {
+	if len(segments) == 0 {
+		return []interface{}{value}
+	}
+	switch v := value.(type) {
+	case datatypes.JS:
+		child, ok := v[segments[0]]
+		if !ok {
+			return nil
+		}
+		return resolvePath(child, segments[1:])
+	case []interface{}:
+		if i, err := strconv.Atoi(segments[0]); err == nil {
+			if i < 0 || i >= len(v) {
+				return nil
+			}
+			return resolvePath(v[i], segments[1:])
+		}
+		var values []interface{}
+		for _, element := range v {
+			values = append(values, resolvePath(element, segments)...)
+		}
+		return values
+	}
+	return nil
+}
+
+//AttributePaths returns the dotted path of every attribute in `data`.
+//Nested objects are descended into, and so are objects inside arrays:
+//    {"tags": ["a"], "items": [{"sku": "a", "qty": 1}]}
+//has paths "tags", "items", "items.sku" and "items.qty".
+func AttributePaths(data datatypes.JS) []string {
+	var paths []string
+	seen := make(map[string]struct{})
+	collectAttributePaths("", data, seen, &paths)
+	return paths
+}
+
+func collectAttributePaths(path string, value interface{}, seen map[string]struct{}, paths *[]string) {
+	addPath := func() {
+		if _, ok := seen[path]; !ok {
+			seen[path] = struct{}{}
+			*paths = append(*paths, path)
+		}
+	}
+	switch v := value.(type) {
+	case datatypes.JS:
+		if path != "" {
+			addPath()
+		}
+		for k, child := range v {
+			childPath := k
+			if path != "" {
+				childPath = path + "." + k
+			}
+			collectAttributePaths(childPath, child, seen, paths)
+		}
+	case []interface{}:
+		addPath()
+		for _, element := range v {
+			//Attributes of objects in the array live under the array's path
+			if IsObj(element) {
+				collectAttributePaths(path, element, seen, paths)
+			} else if array, ok := element.([]interface{}); ok {
+				collectAttributePaths(path, array, seen, paths)
+			}
+		}
+	default:
+		addPath()
+	}
+}
+
 //IsJSONObj returns true if element at `data[k]` is a json object
 func IsJSONObj(k string, data map[string]interface{}) bool {
 	obj := make(map[string]interface{})
@@ -106,19 +206,26 @@ func IsJSONObj(k string, data map[string]interface{}) bool {
 	return reflect.TypeOf(data[k]) == reflect.TypeOf(obj)
 }
 
-//GetJSON object from string
+//GetJSON object from string. Panics if `data` is not a JSON object: only use it on data known to be valid,
+//such as objects read back from the db file, and ParseJSON on anything coming from users.
 func GetJSON(data string) datatypes.JS {
+	dat, err := ParseJSON(data)
+	if err != nil {
+		panic(err)
+	}
+	return dat
+}
+
+//ParseJSON returns the JSON object in `data`, or an error if it holds anything else
+func ParseJSON(data string) (datatypes.JS, error) {
 	var dat map[string]interface{}
 	if err := json.Unmarshal([]byte(data), &dat); err != nil {
-		//TODO handle this more graciously. Namely, check if it is a
-		//JSON formatting issue, and return error to user.
-		//UPDATE: this will definitely be needed if, when deleting elements from the db,
-		//this is only done in the index file, and not the attribute file. In that case,
-		//lookups in the attribute file will give hits to IDs which no longer exist in the
-		//index file.
-		panic(err)
+		return nil, fmt.Errorf("invalid JSON object: %v", err)
+	}
+	if dat == nil {
+		return nil, errors.New("invalid JSON object: null")
 	}
-	return ConvertToJSON(dat)
+	return ConvertToJSON(dat), nil
 }
 
 //ConvertToJSON recursively descends a map[string]interface{}, converting all
@@ -129,6 +236,13 @@ func ConvertToJSON(data map[string]interface{}) datatypes.JS {
 }
 
 func convertToJSON(data interface{}) interface{} {
+	//Objects nested in arrays need converting too
+	if array, ok := data.([]interface{}); ok {
+		for i, item := range array {
+			array[i] = convertToJSON(item)
+		}
+		return array
+	}
 	if !isJSPrimitive(data) {
 		return data
 	}
@@ -208,7 +322,7 @@ func mergeRFC7396(target, patch interface{}) interface{} {
 //   }
 func MergeRFC7396(target, patch datatypes.JS) datatypes.JS {
 	result := mergeRFC7396(target, patch)
-	log.Printf("Merge result is %v", result)
+	logging.Debugf("Merge result is %v", result)
 	return result.(datatypes.JS)
 	//return mergeRFC7396(inPrimitiveFormTarget, inPrimitiveFormPatch).(datatypes.JS)
 }
@@ -227,3 +341,34 @@ func UniqueIDs(ids []string) []string {
 	}
 	return ids[:j]
 }
+
+//CompareValues compares two decoded JSON values of the same type (numbers, strings or booleans).
+//Returns -1, 0 or 1 as a is less than, equal to or greater than b, and false if the values cannot be ordered
+//relative to each other (different types, objects, arrays, null).
+func CompareValues(a, b interface{}) (int, bool) {
+	switch aVal := a.(type) {
+	case float64:
+		if bVal, ok := b.(float64); ok {
+			return compareOrdered(aVal < bVal, aVal > bVal), true
+		}
+	case string:
+		if bVal, ok := b.(string); ok {
+			return compareOrdered(aVal < bVal, aVal > bVal), true
+		}
+	case bool:
+		if bVal, ok := b.(bool); ok {
+			return compareOrdered(!aVal && bVal, aVal && !bVal), true
+		}
+	}
+	return 0, false
+}
+
+func compareOrdered(less, greater bool) int {
+	if less {
+		return -1
+	}
+	if greater {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"nosql-db/pkg/datatypes"
+	"nosql-db/pkg/db"
+	"sort"
+	"testing"
+)
+
+//testOptions returns options for a throwaway data directory
+func testOptions(t *testing.T) db.Options {
+	return db.Options{DataDir: t.TempDir(), Fsync: db.FsyncNever}
+}
+
+//newTestCollection creates a collection in the data directory of `options`, filled with `docs`
+func newTestCollection(t *testing.T, options db.Options, docs ...string) *db.Collection {
+	db.InitCollections(options)
+	collection := db.CreateCollection("test", options)
+	for _, doc := range docs {
+		if _, err := collection.Db.Write(doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return collection
+}
+
+//names returns the sorted `name` of every object
+func names(objects []datatypes.JS) []string {
+	result := []string{}
+	for _, obj := range objects {
+		result = append(result, obj["name"].(string))
+	}
+	sort.Strings(result)
+	return result
+}
+
+func TestQueryOperators(t *testing.T) {
+	collection := newTestCollection(t, testOptions(t),
+		`{"name": "Jo", "age": 53, "status": "a", "brother": {"name": "Simon", "age": 55}}`,
+		`{"name": "Al", "age": 20, "status": "b", "prefs": {}}`,
+		`{"name": "Bo", "age": 35, "status": "c", "nickname": "Bobby", "prefs": {"lang": "en"}}`,
+	)
+
+	cases := []struct {
+		query    string
+		expected []string
+	}{
+		{`{"age": {"$gt": 50}}`, []string{"Jo"}},
+		{`{"age": {"$gte": 20, "$lt": 53}}`, []string{"Al", "Bo"}},
+		{`{"status": {"$in": ["a", "b"]}}`, []string{"Al", "Jo"}},
+		{`{"status": {"$nin": ["a", "b"]}}`, []string{"Bo"}},
+		{`{"status": {"$ne": "a"}}`, []string{"Al", "Bo"}},
+		{`{"nickname": {"$exists": false}}`, []string{"Al", "Jo"}},
+		{`{"brother": {"$exists": true}}`, []string{"Jo"}},
+		{`{"name": {"$regex": "^[ab]", "$options": "i"}}`, []string{"Al", "Bo"}},
+		{`{"age": {"$not": {"$gt": 30}}}`, []string{"Al"}},
+		{`{"brother.age": {"$lt": 60}, "status": "a"}`, []string{"Jo"}},
+		{`{"brother": {"name": "Simon"}}`, []string{"Jo"}},
+		{`{"prefs": {}}`, []string{"Al"}},
+	}
+
+	for _, c := range cases {
+		objects, err := collection.Db.Read(c.query)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", c.query, err)
+			continue
+		}
+		if got := names(objects); !equalStrings(got, c.expected) {
+			t.Errorf("%s: expected %v, got %v", c.query, c.expected, got)
+		}
+	}
+
+	if _, err := collection.Db.Read(`{"age": {"$between": [1, 2]}}`); err == nil {
+		t.Errorf("Expected an error for an unknown operator")
+	}
+}
+
+func TestQueryCombinators(t *testing.T) {
+	collection := newTestCollection(t, testOptions(t),
+		`{"name": "Jo", "country": "FR", "tier": "silver"}`,
+		`{"name": "Al", "country": "UK", "tier": "gold"}`,
+		`{"name": "Bo", "country": "UK", "tier": "bronze"}`,
+		`{"name": "Cy", "country": "FR", "tier": "gold", "banned": true}`,
+	)
+
+	cases := []struct {
+		query    string
+		expected []string
+	}{
+		{`{"$or": [{"country": "FR"}, {"tier": "gold"}]}`, []string{"Al", "Cy", "Jo"}},
+		{`{"$or": [{"country": "FR"}, {"tier": "gold"}], "$not": {"banned": true}}`, []string{"Al", "Jo"}},
+		{`{"$and": [{"country": "UK"}, {"$or": [{"tier": "gold"}, {"tier": "silver"}]}]}`, []string{"Al"}},
+		{`{"$nor": [{"country": "FR"}, {"tier": "gold"}]}`, []string{"Bo"}},
+		{`{"$or": [{"banned": {"$exists": false}}, {"tier": "gold"}], "country": "FR"}`, []string{"Cy", "Jo"}},
+	}
+
+	for _, c := range cases {
+		objects, err := collection.Db.Read(c.query)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", c.query, err)
+			continue
+		}
+		if got := names(objects); !equalStrings(got, c.expected) {
+			t.Errorf("%s: expected %v, got %v", c.query, c.expected, got)
+		}
+	}
+
+	if _, err := collection.Db.Read(`{"$or": {"country": "FR"}}`); err == nil {
+		t.Errorf("Expected an error for $or without an array")
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestQueryArrays(t *testing.T) {
+	collection := newTestCollection(t, testOptions(t),
+		`{"name": "Jo", "tags": ["example", "sample"], "items": [{"sku": "a", "qty": 1}, {"sku": "b", "qty": 5}]}`,
+		`{"name": "Al", "tags": ["sample"], "items": [{"sku": "a", "qty": 5}]}`,
+		`{"name": "Bo", "tags": [], "scores": [82, 95]}`,
+	)
+
+	cases := []struct {
+		query    string
+		expected []string
+	}{
+		{`{"tags": "example"}`, []string{"Jo"}},
+		{`{"tags": ["sample"]}`, []string{"Al"}},
+		{`{"tags": {"$all": ["sample", "example"]}}`, []string{"Jo"}},
+		{`{"tags": {"$size": 0}}`, []string{"Bo"}},
+		{`{"tags": {"$in": ["example", "other"]}}`, []string{"Jo"}},
+		{`{"items.sku": "b"}`, []string{"Jo"}},
+		{`{"items.0.qty": 5}`, []string{"Al"}},
+		{`{"items": {"$elemMatch": {"sku": "a", "qty": {"$gte": 5}}}}`, []string{"Al"}},
+		{`{"items.sku": "a", "items.qty": 5}`, []string{"Al", "Jo"}},
+		{`{"scores": {"$elemMatch": {"$gte": 80, "$lt": 85}}}`, []string{"Bo"}},
+	}
+
+	for _, c := range cases {
+		objects, err := collection.Db.Read(c.query)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", c.query, err)
+			continue
+		}
+		if got := names(objects); !equalStrings(got, c.expected) {
+			t.Errorf("%s: expected %v, got %v", c.query, c.expected, got)
+		}
+	}
+}
+
+func TestReadPagination(t *testing.T) {
+	collection := newTestCollection(t, testOptions(t),
+		`{"name": "Jo", "age": 53, "brother": {"age": 55}}`,
+		`{"name": "Al", "age": 20}`,
+		`{"name": "Bo", "age": 35}`,
+		`{"name": "Cy", "age": 35}`,
+		`{"name": "Di", "age": 62, "brother": {"age": 30}}`,
+	)
+
+	sortKeys, err := db.ParseSort("-age,name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := db.ReadOptions{Sort: sortKeys, Limit: 2}
+	page, err := db.Find(collection.Db, `{}`, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := pageNames(page); !equalStrings(got, []string{"Di", "Jo"}) {
+		t.Errorf("first page: expected [Di Jo], got %v", got)
+	}
+
+	//Objects written before the cursor position must not shift the following pages
+	collection.Db.Write(`{"name": "Ed", "age": 70}`)
+
+	options.Cursor = page.Cursor
+	page, err = db.Find(collection.Db, `{}`, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := pageNames(page); !equalStrings(got, []string{"Bo", "Cy"}) {
+		t.Errorf("second page: expected [Bo Cy], got %v", got)
+	}
+
+	options.Cursor = page.Cursor
+	page, err = db.Find(collection.Db, `{}`, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := pageNames(page); !equalStrings(got, []string{"Al"}) || page.Cursor != "" {
+		t.Errorf("last page: expected [Al] and no cursor, got %v (cursor %q)", got, page.Cursor)
+	}
+
+	//Missing values sort first, skip applies after the sort
+	sortKeys, _ = db.ParseSort("brother.age,name")
+	page, err = db.Find(collection.Db, `{"age": {"$lt": 65}}`, db.ReadOptions{Sort: sortKeys, Skip: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := pageNames(page); !equalStrings(got, []string{"Cy", "Di", "Jo"}) {
+		t.Errorf("skip: expected [Cy Di Jo], got %v", got)
+	}
+
+	//A cursor only makes sense with the sort order it was issued for
+	if _, err := db.Find(collection.Db, `{}`, db.ReadOptions{Cursor: options.Cursor}); err != db.ErrInvalidCursor {
+		t.Errorf("expected ErrInvalidCursor, got %v", err)
+	}
+}
+
+func pageNames(page db.ReadPage) []string {
+	result := []string{}
+	for _, obj := range page.Objects {
+		result = append(result, obj["name"].(string))
+	}
+	return result
+}
+
+func TestReadProjection(t *testing.T) {
+	collection := newTestCollection(t, testOptions(t),
+		`{"name": "Jo", "age": 53, "brother": {"name": "Simon", "age": 55}, "items": [{"sku": "a", "qty": 1}, "loose"]}`,
+	)
+
+	cases := []struct {
+		fields   string
+		keepsID  bool
+		expected string
+	}{
+		{"name,brother.name", true, `{"brother":{"name":"Simon"},"name":"Jo"}`},
+		{"brother,brother.age", true, `{"brother":{"age":55,"name":"Simon"}}`},
+		{"items.sku,-id", false, `{"items":[{"sku":"a"}]}`},
+		{"-brother.age,-items,-id", false, `{"age":53,"brother":{"name":"Simon"},"name":"Jo"}`},
+	}
+
+	for _, c := range cases {
+		projection, err := db.ParseProjection(c.fields)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", c.fields, err)
+			continue
+		}
+		page, err := db.Find(collection.Db, `{"name": "Jo"}`, db.ReadOptions{Projection: projection})
+		if err != nil || len(page.Objects) != 1 {
+			t.Errorf("%s: expected a single object, got %v (%v)", c.fields, page.Objects, err)
+			continue
+		}
+		obj := page.Objects[0]
+		if _, ok := obj["id"]; ok != c.keepsID {
+			t.Errorf("%s: expected id to be kept: %v", c.fields, c.keepsID)
+		}
+		delete(obj, "id")
+		if got, _ := json.Marshal(obj); string(got) != c.expected {
+			t.Errorf("%s: expected %s, got %s", c.fields, c.expected, got)
+		}
+	}
+
+	if _, err := db.ParseProjection("name,-age"); err == nil {
+		t.Error("expected an error when mixing included and excluded paths")
+	}
+}
+
+func TestQueryPlanner(t *testing.T) {
+	var docs []string
+	for i := 0; i < 60; i++ {
+		docs = append(docs, fmt.Sprintf(`{"name": "n%d", "status": "active", "age": %d}`, i, i))
+	}
+	docs = append(docs, `{"name": "Jo", "status": "active", "vip": true}`, `{"name": "Al", "status": "closed", "vip": true}`)
+	options := testOptions(t)
+	collection := newTestCollection(t, options, docs...)
+
+	cases := []struct {
+		query        string
+		stage        string
+		path         string
+		docsExamined int
+		expected     []string
+	}{
+		//Only the short vip chain is read, rather than intersecting it with the status chain
+		{`{"status": "active", "vip": true}`, "attributeChain", "vip", 2, []string{"Jo"}},
+		{`{"$or": [{"vip": true}, {"age": 3}]}`, "union", "", 62, []string{"Al", "Jo", "n3"}},
+		{`{}`, "collectionScan", "", 62, nil},
+	}
+	check := func(collection *db.Collection) {
+		for _, c := range cases {
+			page, err := db.Find(collection.Db, c.query, db.ReadOptions{Explain: true})
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", c.query, err)
+				continue
+			}
+			explain := page.Explain
+			if explain == nil || explain.Plan.Stage != c.stage || explain.Plan.Path != c.path {
+				t.Errorf("%s: expected a %s plan on '%s', got %+v", c.query, c.stage, c.path, explain)
+				continue
+			}
+			if explain.DocsExamined != c.docsExamined || explain.Returned != len(page.Objects) {
+				t.Errorf("%s: expected %d objects examined and %d returned, got %+v", c.query, c.docsExamined, len(page.Objects), explain)
+			}
+			if c.expected != nil && !equalStrings(names(page.Objects), c.expected) {
+				t.Errorf("%s: expected %v, got %v", c.query, c.expected, names(page.Objects))
+			}
+		}
+	}
+	check(collection)
+
+	//Chain lengths are counted again when loading the collection
+	reloaded := db.LoadCollections(options)["test"]
+	check(&reloaded)
+
+	//A value index narrows things down further than the vip chain
+	createIndexes(t, &reloaded, db.IndexSpec{Name: "byName", Fields: []string{"name"}})
+	page, _ := db.Find(reloaded.Db, `{"name": "Jo", "vip": true}`, db.ReadOptions{Explain: true})
+	if page.Explain.Plan.Stage != "indexLookup" || page.Explain.Plan.Index != "byName" || page.Explain.DocsExamined != 1 {
+		t.Errorf("Expected a lookup of the byName index, got %+v", page.Explain)
+	}
+}
+
+//TestAttributeChains checks attribute chains are found back after reloading the collection, and that items
+//appended afterwards are linked to the right chain, attributes sharing a prefix included
+func TestAttributeChains(t *testing.T) {
+	options := testOptions(t)
+	collection := newTestCollection(t, options,
+		`{"name": "Jo", "surname": "Walker", "brother": {"name": "Simon"}}`,
+		`{"name": "Al"}`,
+	)
+	reloaded := db.LoadCollections(options)["test"]
+	reloaded.Db.Write(`{"name": "Bo", "surname": "Smith"}`)
+	reloaded.Db.Write(`{"surname": "Jones", "brother": {"name": "Cy"}}`)
+	collection = &reloaded
+
+	cases := []struct {
+		query    string
+		expected int
+	}{
+		{`{"name": {"$gte": ""}}`, 3},
+		{`{"surname": {"$gte": ""}}`, 3},
+		{`{"brother.name": {"$gte": ""}}`, 2},
+	}
+	for _, c := range cases {
+		page, err := db.Find(collection.Db, c.query, db.ReadOptions{Explain: true})
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", c.query, err)
+			continue
+		}
+		if len(page.Objects) != c.expected || page.Explain.Plan.Candidates != c.expected {
+			t.Errorf("%s: expected %d objects from the attribute chain, got %+v", c.query, c.expected, page.Explain)
+		}
+	}
+	if report, err := collection.Db.(*db.Access).Verify(false); err != nil || len(report.Problems) != 0 {
+		t.Errorf("Expected no problems, got %v (%v)", report.Problems, err)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"nosql-db/pkg/api"
+	"nosql-db/pkg/config"
+	"strings"
+	"testing"
+)
+
+//TestRoutes goes through a document's lifecycle with the REST routes, and checks unknown routes and methods are refused
+func TestRoutes(t *testing.T) {
+	cfg := config.Default()
+	cfg.DataDir = t.TempDir()
+	s, err := api.NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return resp
+	}
+
+	steps := []struct {
+		method, path, body string
+		status             int
+		//contains is expected to be found in the response body
+		contains string
+	}{
+		{"POST", "/collections", `{"name": "people"}`, http.StatusNoContent, ""},
+		{"POST", "/collections/people/docs", `{"id": "jo", "age": 53}`, http.StatusOK, `"id":"jo"`},
+		{"GET", "/collections/people/docs/jo", ``, http.StatusOK, `"age":53`},
+		{"PUT", "/collections/people/docs/a%2Fb", `{"age": 20}`, http.StatusNotFound, "notFound"},
+		{"POST", "/collections/people/docs", `{"id": "a/b", "age": 19}`, http.StatusOK, `"id":"a/b"`},
+		{"PUT", "/collections/people/docs/a%2Fb", `{"age": 20}`, http.StatusOK, `"id":"a/b"`},
+		{"GET", "/collections/people/docs/a%2Fb", ``, http.StatusOK, `"age":20`},
+		{"PUT", "/collections/people/docs/jo", `{"id": "al"}`, http.StatusBadRequest, "invalidDocument"},
+		{"PATCH", "/collections/people/docs/jo", `{"age": 53.5}`, http.StatusOK, `"age":53.5`},
+		{"PATCH", "/collections/people/docs/jo", `{"$inc": {"age": 0.5}}`, http.StatusOK, `"$inc"`},
+		{"PATCH", "/collections/people/docs/jo", `{"$inc": {"id": 1}}`, http.StatusBadRequest, "invalidDocument"},
+		{"POST", "/collections/people/query", `{"age": {"$gt": 50}}`, http.StatusOK, `"id":"jo"`},
+		{"DELETE", "/collections/people/docs/jo", ``, http.StatusOK, `"age":54`},
+		{"GET", "/collections/people/docs/jo", ``, http.StatusNotFound, "notFound"},
+		{"POST", "/collections/people/docs/jo", ``, http.StatusMethodNotAllowed, "methodNotAllowed"},
+		{"GET", "/collections/people", ``, http.StatusMethodNotAllowed, "methodNotAllowed"},
+		{"GET", "/collections/people/nothing", ``, http.StatusNotFound, "unknownRoute"},
+		{"GET", "/nothing", ``, http.StatusNotFound, "unknownRoute"},
+		{"POST", "/collections/people/upsert", `{"filter": {"id": "bo"}, "update": {"age": 7}}`, http.StatusOK, `"upserted":true`},
+		{"POST", "/collections/people/findAndModify", `{"filter": {"id": "bo"}, "update": {"age": 8}, "returnNew": true}`, http.StatusOK, `"age":8`},
+		{"POST", "/collections/people/findAndModify", `{"filter": {"id": "zz"}, "update": {}}`, http.StatusNotFound, "notFound"},
+		{"POST", "/collections/people/findAndModify", `{"filter": {}}`, http.StatusBadRequest, "invalidRequest"},
+		{"POST", "/collections/people/updateMany", `{"filter": {}, "update": {"$set": {"seen": true}}}`, http.StatusOK, `{"matched":2,"modified":2}`},
+		{"POST", "/collections/people/updateMany", `{"filter": {}, "update": {"seen": true}}`, http.StatusOK, `{"matched":2,"modified":0}`},
+		{"DELETE", "/collections/people", ``, http.StatusOK, `"dropped":"people"`},
+		{"GET", "/collections", ``, http.StatusOK, `[]`},
+		{"POST", "/collections/people/query", `{}`, http.StatusNotFound, "collectionMissing"},
+	}
+	for _, step := range steps {
+		resp := do(step.method, step.path, step.body)
+		if resp.Code != step.status || !strings.Contains(resp.Body.String(), step.contains) {
+			t.Errorf("%s %s: expected %d with %s, got %d %s", step.method, step.path, step.status, step.contains, resp.Code, resp.Body)
+		}
+	}
+	if allow := do("DELETE", "/collections/people/query", ``).Header().Get("Allow"); allow != "POST" {
+		t.Errorf("Expected POST to be the only method allowed, got %s", allow)
+	}
+}
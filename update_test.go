@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"nosql-db/pkg/db"
+	"sync"
+	"testing"
+)
+
+//TestUpdateOperators applies update operators on every storage engine: concurrent increments must all be kept
+func TestUpdateOperators(t *testing.T) {
+	for _, engine := range []string{db.EngineFile, db.EngineMemory, db.EngineLSM} {
+		t.Run(engine, func(t *testing.T) {
+			options := testOptions(t)
+			db.InitCollections(options)
+			collection, err := db.CreateCollectionWithEngine("test", engine, options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			store := collection.Db
+			defer store.Close()
+			store.Write(`{"id": "jo", "name": "Jo", "views": 0, "tags": ["a", "b"], "scores": [40, 60, 80],
+				"items": [{"sku": "a", "qty": 1}, {"sku": "b", "qty": 2}], "draft": true}`)
+
+			var wg sync.WaitGroup
+			for w := 0; w < 4; w++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := 0; i < 25; i++ {
+						if _, err := store.Update("jo", `{"$inc": {"views": 1}}`); err != nil {
+							t.Error(err)
+							return
+						}
+					}
+				}()
+			}
+			wg.Wait()
+
+			_, err = store.Update("jo", `{
+				"$set": {"author.name": "Jo"},
+				"$unset": {"draft": "", "nothing.here": ""},
+				"$mul": {"price": 2},
+				"$max": {"best": 12},
+				"$min": {"name": "Al"},
+				"$push": {"history": {"$each": ["created", "updated"]}},
+				"$addToSet": {"tags": {"$each": ["b", "c", "c"]}},
+				"$pull": {"scores": {"$lt": 50}, "items": {"sku": "a"}, "missing": 1}
+			}`)
+			if err == nil {
+				_, err = store.Update("jo", `{"$set": {"items.0.qty": 5}}`)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			obj, _ := store.Get("jo")
+			got, _ := json.Marshal(obj)
+			expected := `{"author":{"name":"Jo"},"best":12,"history":["created","updated"],"id":"jo","items":[{"qty":5,"sku":"b"}],` +
+				`"name":"Al","price":0,"scores":[60,80],"tags":["a","b","c"],"views":100}`
+			if string(got) != expected {
+				t.Errorf("Expected %s, got %s", expected, got)
+			}
+
+			for _, update := range []string{
+				`{"$inc": {"name": 1}}`,
+				`{"$inc": {"views": "1"}}`,
+				`{"$push": {"name": "x"}}`,
+				`{"$set": {"id": "al"}}`,
+				`{"$set": {"a": 1}, "$inc": {"a.b": 1}}`,
+				`{"$set": {"a": 1}, "b": 2}`,
+				`{"$rename": {"a": "b"}}`,
+				`{"$set": {"name.first": "Jo"}}`,
+			} {
+				if _, err := store.Update("jo", update); !errors.Is(err, db.ErrInvalidDocument) {
+					t.Errorf("Expected %s to be refused, got %v", update, err)
+				}
+			}
+			if after, _ := store.Get("jo"); after["views"] != 100.0 || after["name"] != "Al" {
+				t.Errorf("Expected refused updates to change nothing, got %v", after)
+			}
+
+			//Patches cannot change the id either: it is kept, and no copy is written under another one
+			for _, patch := range []string{`{"id": "al", "name": "Bo"}`, `{"id": null}`} {
+				if _, err := store.Update("jo", patch); err != nil {
+					t.Errorf("Unexpected error patching the id with %s: %v", patch, err)
+				}
+			}
+			if all, _ := store.Read(`{}`); len(all) != 1 || all[0]["id"] != "jo" || all[0]["name"] != "Bo" {
+				t.Errorf("Expected jo to be the only object, patched in place, got %v", all)
+			}
+
+			result, err := db.Upsert(store, `{"id": "counter", "kind": "stats"}`, `{"$inc": {"n": 1}}`)
+			if err == nil {
+				result, err = db.Upsert(store, `{"id": "counter", "kind": "stats"}`, `{"$inc": {"n": 1}}`)
+			}
+			if err != nil || result.Object["n"] != 2.0 || result.Object["kind"] != "stats" {
+				t.Errorf("Expected the counter to be upserted then incremented, got %+v (%v)", result, err)
+			}
+		})
+	}
+}
+
+//TestUpdateMany updates every matching object on every storage engine, all of them or none
+func TestUpdateMany(t *testing.T) {
+	for _, engine := range []string{db.EngineFile, db.EngineMemory, db.EngineLSM} {
+		t.Run(engine, func(t *testing.T) {
+			options := testOptions(t)
+			db.InitCollections(options)
+			collection, err := db.CreateCollectionWithEngine("test", engine, options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			store := collection.Db
+			defer store.Close()
+			for i := 0; i < 50; i++ {
+				store.Write(fmt.Sprintf(`{"id": "u%02d", "plan": "free", "credits": %d}`, i, i%5))
+			}
+			store.Write(`{"id": "odd", "plan": "free", "credits": "none"}`)
+
+			if _, err := store.UpdateMany(`{"plan": "free"}`, `{"$inc": {"credits": 10}}`); !errors.Is(err, db.ErrInvalidDocument) {
+				t.Errorf("Expected $inc on a string to fail, got %v", err)
+			}
+			if objects, _ := store.Read(`{"credits": {"$gte": 10}}`); len(objects) != 0 {
+				t.Errorf("Expected a failed update to change nothing, got %d objects changed", len(objects))
+			}
+
+			store.DeleteByID("odd")
+			result, err := store.UpdateMany(`{"plan": "free"}`, `{"$max": {"credits": 2}, "$set": {"plan": "trial"}}`)
+			if err != nil || result.Matched != 50 || result.Modified != 50 {
+				t.Errorf("Expected 50 objects matched and modified, got %+v (%v)", result, err)
+			}
+			result, err = store.UpdateMany(`{"credits": {"$lte": 2}}`, `{"credits": 2}`)
+			if err != nil || result.Matched != 30 || result.Modified != 0 {
+				t.Errorf("Expected 30 objects matched and none modified, got %+v (%v)", result, err)
+			}
+			result, err = store.UpdateMany(`{"id": "nobody"}`, `{"credits": 2}`)
+			if err != nil || result.Matched != 0 {
+				t.Errorf("Expected nothing to match, got %+v (%v)", result, err)
+			}
+			if objects, _ := store.Read(`{"plan": "trial", "credits": {"$gte": 2}}`); len(objects) != 50 {
+				t.Errorf("Expected 50 updated objects, got %d", len(objects))
+			}
+		})
+	}
+}
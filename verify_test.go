@@ -0,0 +1,43 @@
+package main
+
+import (
+	"nosql-db/pkg/db"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerifyAndRepair(t *testing.T) {
+	options := testOptions(t)
+	db.InitCollections(options)
+	collection := db.CreateCollection("checked", options)
+	for _, id := range []string{"a", "b", "c"} {
+		collection.Db.Write(`{"id": "` + id + `", "n": 1}`)
+	}
+	//Copies superseded by updates are not orphan records
+	collection.Db.Update("b", `{"n": 2}`)
+	collection.Db.Replace("c", `{"n": 3}`)
+
+	if report, err := collection.Db.(*db.Access).Verify(false); err != nil || len(report.Problems) != 0 {
+		t.Fatalf("Expected no problems on an updated collection, got %v (%v)", report.Problems, err)
+	}
+
+	//Flip a byte of the first record, as a torn write would
+	dbPath := filepath.Join(options.DataDir, "checked", "checked.db")
+	f, err := os.OpenFile(dbPath, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte("X"), 3)
+	f.Close()
+
+	report, err := collection.Db.(*db.Access).Verify(true)
+	if err != nil || len(report.Problems) != 1 || report.Problems[0].Kind != "checksumMismatch" || !report.Repaired {
+		t.Fatalf("Expected a repaired checksum mismatch, got %+v (%v)", report, err)
+	}
+
+	report, err = collection.Db.(*db.Access).Verify(false)
+	if err != nil || len(report.Problems) != 0 || report.Documents != 2 {
+		t.Errorf("Expected 2 documents and no problems after repair, got %+v (%v)", report, err)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"nosql-db/pkg/db"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+//TestWALReplay simulates a crash right after an operation was logged, but before it was applied,
+//and checks the operation is redone when the collection is loaded again
+func TestWALReplay(t *testing.T) {
+	options := testOptions(t)
+	db.InitCollections(options)
+	if db.CreateCollection("crashed", options) == nil {
+		t.Fatal("could not create collection")
+	}
+
+	//_ids are the md5 of the user-space ids "job-1", "job-2" and "job-3"
+	var frame []byte
+	for _, payload := range []string{
+		`{"op":"write","ids":["ac15a52e59f363d653442a598ffab484"],"data":{"id":"job-1","state":"queued"}}`,
+		`{"op":"writeMany","ids":["6c49804e493119932adad96a70b8822b","02ef992fdda1e50134008724c05bde16"],` +
+			`"data":[{"id":"job-2","state":"queued"},{"id":"job-3","state":"queued"}]}`,
+	} {
+		header := make([]byte, 8)
+		binary.BigEndian.PutUint32(header[0:4], uint32(len(payload)))
+		binary.BigEndian.PutUint32(header[4:8], crc32.ChecksumIEEE([]byte(payload)))
+		frame = append(append(frame, header...), payload...)
+	}
+	//Torn trailing record, which must be discarded
+	frame = append(frame, 0, 0, 0, 42, 1)
+
+	walPath := filepath.Join(options.DataDir, "crashed", "crashed.wal")
+	if err := os.WriteFile(walPath, frame, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	collection := db.LoadCollections(options)["crashed"]
+	objects, err := collection.Db.Read(`{"state": "queued"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 3 {
+		t.Errorf("Expected the logged writes to be replayed, got %v", objects)
+	}
+
+	if info, _ := os.Stat(walPath); info.Size() != 0 {
+		t.Errorf("Expected WAL to be emptied after replay, size is %d", info.Size())
+	}
+}